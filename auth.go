@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// authUser is the identity carried by a verified JWT
+type authUser struct {
+    ID    string
+    Admin bool
+}
+
+// userClaims are the JWT claims read by the server; the user ID is the standard subject claim
+type userClaims struct {
+    Admin bool `json:"admin"`
+    jwt.RegisteredClaims
+}
+
+// userContextKey is the context key under which withUser stores the authenticated user
+type userContextKey struct{}
+
+// userFromContext returns the user authenticated by withUser, if any
+func userFromContext(ctx context.Context) (authUser, bool) {
+    user, ok := ctx.Value(userContextKey{}).(authUser)
+    return user, ok
+}
+
+// parseUserToken verifies an HS256-signed token and returns the user it identifies
+func parseUserToken(token string, secret []byte) (authUser, error) {
+    var claims userClaims
+    _, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+        return secret, nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+    if err != nil {
+        return authUser{}, err
+    }
+    if claims.Subject == "" {
+        return authUser{}, errors.New("token has no subject")
+    }
+    return authUser{ID: claims.Subject, Admin: claims.Admin}, nil
+}
+
+// withUser is a middleware that authenticates the bearer JWT and stores the user in the request
+// context; requests that modify data must carry a valid token, while reads stay public. It does
+// nothing when no JWT secret is configured.
+func (s *Server) withUser(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if len(s.jwtSecret) == 0 {
+            next(w, r)
+            return
+        }
+
+        token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if !ok || strings.TrimSpace(token) == "" {
+            switch r.Method {
+            case http.MethodGet, http.MethodHead, http.MethodOptions:
+                next(w, r)
+            default:
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                respondWithError(w, http.StatusUnauthorized, "missing_token", "Missing bearer token")
+            }
+            return
+        }
+
+        user, err := parseUserToken(strings.TrimSpace(token), s.jwtSecret)
+        if err != nil {
+            w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+            respondWithError(w, http.StatusUnauthorized, "invalid_token", "Invalid bearer token")
+            return
+        }
+
+        next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+    }
+}
+
+// canModify reports whether the request may change a review written by authorID; everyone may
+// when authentication is disabled, otherwise only the author or an admin
+func (s *Server) canModify(r *http.Request, authorID string) bool {
+    if len(s.jwtSecret) == 0 {
+        return true
+    }
+    user, ok := userFromContext(r.Context())
+    return ok && (user.Admin || user.ID == authorID)
+}
+
+// isAdmin reports whether the request may use moderation endpoints that span many users' reviews;
+// everyone may when authentication is disabled
+func (s *Server) isAdmin(r *http.Request) bool {
+    if len(s.jwtSecret) == 0 {
+        return true
+    }
+    user, ok := userFromContext(r.Context())
+    return ok && user.Admin
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Backups are named after the time they were taken so their names sort oldest first
+const (
+    backupFilePrefix = "reviews-"
+    backupFileSuffix = ".db"
+    backupTimeLayout = "20060102T150405Z"
+)
+
+// backupLoop writes a backup of store into dir every interval and prunes all but the newest keep
+// backups until ctx is done. Backups read a snapshot of the database, so requests keep being served
+// while one is written.
+func backupLoop(ctx context.Context, store ReviewStore, dir string, interval time.Duration, keep int) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            runBackup(ctx, store, dir, keep)
+        }
+    }
+}
+
+// runBackup writes one backup, prunes the old ones and logs the outcome
+func runBackup(ctx context.Context, store ReviewStore, dir string, keep int) {
+    start := time.Now()
+    path, err := backupDatabase(ctx, store, dir, start)
+    if err != nil {
+        logger.Error("database backup failed", "path", path, "error", err.Error())
+        return
+    }
+    logger.Info("database backup written", "path", path, "duration_ms", time.Since(start).Milliseconds())
+
+    removed, err := pruneBackups(dir, keep)
+    for _, old := range removed {
+        logger.Info("old database backup removed", "path", old)
+    }
+    if err != nil {
+        logger.Error("pruning database backups failed", "dir", dir, "error", err.Error())
+    }
+}
+
+// backupDatabase writes a backup of store taken at now into dir, creating dir if needed, and returns its path
+func backupDatabase(ctx context.Context, store ReviewStore, dir string, now time.Time) (string, error) {
+    path := filepath.Join(dir, backupFilePrefix+now.UTC().Format(backupTimeLayout)+backupFileSuffix)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return path, err
+    }
+    return path, store.Backup(ctx, path)
+}
+
+// pruneBackups removes all but the newest keep backups in dir and returns the paths it removed;
+// other files in dir are left alone
+func pruneBackups(dir string, keep int) ([]string, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    // ReadDir sorts by name, which for backups is oldest first
+    var backups []string
+    for _, entry := range entries {
+        name := entry.Name()
+        if entry.Type().IsRegular() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+            backups = append(backups, filepath.Join(dir, name))
+        }
+    }
+    if len(backups) <= keep {
+        return nil, nil
+    }
+
+    var (
+        removed []string
+        errs    []error
+    )
+    for _, path := range backups[:len(backups)-keep] {
+        if err := os.Remove(path); err != nil {
+            errs = append(errs, err)
+            continue
+        }
+        removed = append(removed, path)
+    }
+    return removed, errors.Join(errs...)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// statsCacheEntry is a computed stats result and when it stops being served
+type statsCacheEntry struct {
+    stats   *ReviewStats
+    expires time.Time
+}
+
+// statsCache keeps recently computed /stats results per product for a short time. Every write
+// that can change the figures invalidates it, so cached results are only ever stale by the
+// writes of other processes sharing the database.
+type statsCache struct {
+    mu         sync.Mutex
+    ttl        time.Duration
+    entries    map[string]statsCacheEntry
+    generation uint64
+}
+
+// newStatsCache creates a cache serving results for ttl; a zero ttl disables caching
+func newStatsCache(ttl time.Duration) *statsCache {
+    return &statsCache{ttl: ttl, entries: make(map[string]statsCacheEntry)}
+}
+
+// enabled reports whether results are cached at all
+func (c *statsCache) enabled() bool {
+    return c.ttl > 0
+}
+
+// get returns the cached stats of a product, or "" for every product, when they have not expired;
+// otherwise it returns the generation to pass to set once the stats are computed
+func (c *statsCache) get(productID string) (*ReviewStats, uint64, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[productID]
+    if !ok || time.Now().After(entry.expires) {
+        return nil, c.generation, false
+    }
+    return entry.stats, c.generation, true
+}
+
+// set caches stats computed at generation, unless a write invalidated the cache in the meantime;
+// the stats must not be modified afterwards since they are shared between requests
+func (c *statsCache) set(productID string, stats *ReviewStats, generation uint64) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if generation != c.generation {
+        return
+    }
+    c.entries[productID] = statsCacheEntry{stats: stats, expires: time.Now().Add(c.ttl)}
+}
+
+// snapshot returns the unexpired cached stats by product, along with the generation to pass to set
+// when replacing them
+func (c *statsCache) snapshot() (map[string]*ReviewStats, uint64) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    now := time.Now()
+    stats := make(map[string]*ReviewStats, len(c.entries))
+    for productID, entry := range c.entries {
+        if now.Before(entry.expires) {
+            stats[productID] = entry.stats
+        }
+    }
+    return stats, c.generation
+}
+
+// invalidate drops every cached result after a write
+func (c *statsCache) invalidate() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.generation++
+    clear(c.entries)
+}
+
+// listCache keeps every publicly listed review in id order, with replies and images attached, so
+// that unfiltered listings are served without querying the database. Every write invalidates it
+// and the next listing reloads it, so like statsCache it only misses other processes' writes.
+type listCache struct {
+    mu         sync.RWMutex
+    enabled    bool
+    reviews    []Review
+    loaded     bool
+    generation uint64
+}
+
+// newListCache creates a list cache, which stays empty unless enabled
+func newListCache(enabled bool) *listCache {
+    return &listCache{enabled: enabled}
+}
+
+// get returns the cached reviews when they are loaded; otherwise it returns the generation to
+// pass to set once they are
+func (c *listCache) get() ([]Review, uint64, bool) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    return c.reviews, c.generation, c.loaded
+}
+
+// set caches reviews loaded at generation, unless a write invalidated the cache in the meantime;
+// the reviews must not be modified afterwards since they are shared between requests
+func (c *listCache) set(reviews []Review, generation uint64) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if generation != c.generation {
+        return
+    }
+    c.reviews = reviews
+    c.loaded = true
+}
+
+// invalidate drops the cached reviews after a write
+func (c *listCache) invalidate() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.generation++
+    c.reviews = nil
+    c.loaded = false
+}
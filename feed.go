@@ -0,0 +1,88 @@
+package main
+
+import (
+    "encoding/xml"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// Default and maximum number of reviews in the /reviews.rss feed
+const (
+    defaultFeedItems = 20
+    maxFeedItems     = 100
+)
+
+// rssFeed is the root element of an RSS 2.0 document
+type rssFeed struct {
+    XMLName xml.Name   `xml:"rss"`
+    Version string     `xml:"version,attr"`
+    Channel rssChannel `xml:"channel"`
+}
+
+// rssChannel describes the feed and holds its items, newest first
+type rssChannel struct {
+    Title         string    `xml:"title"`
+    Link          string    `xml:"link"`
+    Description   string    `xml:"description"`
+    LastBuildDate string    `xml:"lastBuildDate,omitempty"` // Creation time of the newest review
+    Items         []rssItem `xml:"item"`
+}
+
+// rssItem is a single review in the feed
+type rssItem struct {
+    Title       string  `xml:"title"`
+    Link        string  `xml:"link"`
+    Description string  `xml:"description"`
+    PubDate     string  `xml:"pubDate"`
+    GUID        rssGUID `xml:"guid"`
+}
+
+// rssGUID identifies an item; it is the review's permalink
+type rssGUID struct {
+    Value       string `xml:",chardata"`
+    IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// newReviewFeed builds an RSS feed of reviews, linking each to its GET /review URL under baseURL
+func newReviewFeed(reviews []Review, baseURL, productID string) rssFeed {
+    channel := rssChannel{
+        Title:       "ReviewX reviews",
+        Link:        baseURL + "/reviews",
+        Description: "The latest reviews",
+        Items:       make([]rssItem, 0, len(reviews)),
+    }
+    if productID != "" {
+        channel.Title = fmt.Sprintf("ReviewX reviews of %s", productID)
+        channel.Description = fmt.Sprintf("The latest reviews of %s", productID)
+    }
+    if len(reviews) > 0 {
+        channel.LastBuildDate = reviews[0].CreatedAt.Format(time.RFC1123Z)
+    }
+
+    for _, review := range reviews {
+        title := fmt.Sprintf("Review by %s", review.Name)
+        if review.Rating != nil {
+            title = fmt.Sprintf("%s, rated %d", title, *review.Rating)
+        }
+        link := fmt.Sprintf("%s/review?id=%d", baseURL, review.ID)
+        channel.Items = append(channel.Items, rssItem{
+            Title:       title,
+            Link:        link,
+            Description: review.Review,
+            PubDate:     review.CreatedAt.Format(time.RFC1123Z),
+            GUID:        rssGUID{Value: link, IsPermaLink: true},
+        })
+    }
+    return rssFeed{Version: "2.0", Channel: channel}
+}
+
+// requestBaseURL returns the scheme and host the request was made to, followed by the /t/{tenant}
+// prefix it was routed through, for building absolute links
+func requestBaseURL(r *http.Request) string {
+    scheme := "http"
+    if r.TLS != nil {
+        scheme = "https"
+    }
+    return scheme + "://" + r.Host + tenantPrefixFromContext(r.Context())
+}
@@ -0,0 +1,2190 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/csv"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "maps"
+    "net/http"
+    "path"
+    "reflect"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Default and maximum page sizes for listing reviews
+const (
+    defaultLimit = 50
+    maxLimit     = 500
+)
+
+// Default and maximum number of reviews returned by /reviews/top
+const (
+    defaultTopReviews = 5
+    maxTopReviews     = 50
+)
+
+// maxBodyBytes caps the size of JSON request bodies; bulk imports get a larger allowance
+const (
+    maxBodyBytes     = 64 << 10
+    maxBulkBodyBytes = 4 << 20
+)
+
+// maxIdempotencyKeyLength caps the Idempotency-Key header accepted when submitting reviews
+const maxIdempotencyKeyLength = 255
+
+// maxBatchSize caps how many reviews a single batch operation may touch
+const maxBatchSize = 500
+
+// jsonLinesFlushInterval is how many rows the JSON Lines export writes between flushes
+const jsonLinesFlushInterval = 100
+
+// readinessTimeout bounds how long the readiness probe waits for the database
+const readinessTimeout = 2 * time.Second
+
+// reviewsHandler handles POST, PUT, PATCH and GET requests for reviews
+func (s *Server) reviewsHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodPost:
+        s.handlePostReview(w, r)
+    case http.MethodPut:
+        s.handlePutReview(w, r)
+    case http.MethodPatch:
+        s.handlePatchReview(w, r)
+    case http.MethodGet:
+        s.handleGetReviews(w, r)
+    default:
+        respondMethodNotAllowed(w, "GET, POST, PUT, PATCH")
+    }
+}
+
+// handlePostReview handles the submission of a new review
+func (s *Server) handlePostReview(w http.ResponseWriter, r *http.Request) {
+    // Parse the JSON request body
+    var newReview Review
+    trapped, status, err := s.decodeSubmission(w, r, &newReview)
+    if err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Validate the review fields
+    if errs := s.checkSubmission(&newReview); len(errs) > 0 {
+        respondWithError(w, errs[0].status(), errs[0].Code, errs[0].Message)
+        return
+    }
+
+    // The author always comes from the token, never from the payload, and only admins may vouch
+    // for a verified purchase
+    user, _ := userFromContext(r.Context())
+    newReview.AuthorID = user.ID
+    newReview.Verified = newReview.Verified && s.isAdmin(r)
+
+    // Bots fill in the hidden honeypot field; pretend to accept their review without storing it
+    if trapped {
+        honeypotSubmissions.Inc()
+        logger.Info("discarded review with honeypot field filled in", "request_id", requestIDFromContext(r.Context()), "field", s.honeypotField)
+        s.respondWithDecoy(w, r, &newReview)
+        return
+    }
+
+    // Save the review to the database and record the ID it was assigned; a retried request
+    // carrying the same idempotency key gets the review saved the first time instead
+    var (
+        id       int
+        replayed bool
+    )
+    if key := r.Header.Get("Idempotency-Key"); key != "" && s.idempotencyWindow > 0 {
+        if !validToken(key, maxIdempotencyKeyLength) {
+            respondWithError(w, http.StatusBadRequest, "invalid_idempotency_key", fmt.Sprintf("Invalid Idempotency-Key header. Must be 1 to %d printable ASCII characters.", maxIdempotencyKeyLength))
+            return
+        }
+        id, replayed, err = s.store.SaveIdempotent(r.Context(), &newReview, key, s.idempotencyWindow)
+    } else {
+        id, err = s.store.Save(r.Context(), &newReview)
+    }
+    if errors.Is(err, errDuplicateReview) {
+        respondWithError(w, http.StatusConflict, "duplicate_review", "Duplicate review. An identical review was submitted recently.")
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to save review")
+        return
+    }
+    if replayed {
+        w.Header().Set("Idempotent-Replayed", "true")
+    } else {
+        reviewsSubmitted.Inc()
+        s.statsCache.invalidate()
+        s.listCache.invalidate()
+    }
+
+    // Respond with the review as stored, including server-populated fields
+    review, err := s.store.GetByID(r.Context(), id)
+    if replayed && errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("The review saved with this idempotency key, id %d, has since been deleted", id))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load saved review")
+        return
+    }
+    reviews := []Review{*review}
+    if err := s.attachRelated(r.Context(), reviews); err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load replies and images")
+        return
+    }
+    if !replayed && reviews[0].Status == reviewPublished {
+        s.webhooks.notify(reviews[0])
+    }
+    respondWithJSON(w, http.StatusCreated, reviews[0])
+}
+
+// respondWithDecoy answers a submission caught by the honeypot exactly as if review had been
+// stored, with the id the next review will get, so bots cannot tell they were caught
+func (s *Server) respondWithDecoy(w http.ResponseWriter, r *http.Request, review *Review) {
+    id, err := s.store.NextID(r.Context())
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to save review")
+        return
+    }
+    review.ID = id
+    review.CreatedAt = time.Now().UTC()
+    if review.Status == "" {
+        review.Status = reviewPublished
+    }
+    review.Email = ""
+    respondWithJSON(w, http.StatusCreated, review)
+}
+
+// decodeSubmission decodes a submitted review into review, accepting the honeypot field alongside
+// the review fields and reporting whether it was filled in
+func (s *Server) decodeSubmission(w http.ResponseWriter, r *http.Request, review *Review) (bool, int, error) {
+    if s.honeypotField == "" {
+        status, err := decodeJSONBody(w, r, review)
+        return false, status, err
+    }
+
+    var fields map[string]json.RawMessage
+    if status, err := decodeJSONBody(w, r, &fields); err != nil {
+        return false, status, err
+    }
+    value, ok := fields[s.honeypotField]
+    delete(fields, s.honeypotField)
+    trapped := ok && string(value) != "null" && string(value) != `""`
+
+    // Decode the remaining fields as strictly as any other body
+    body, err := json.Marshal(fields)
+    if err != nil {
+        return false, http.StatusBadRequest, &codedError{"invalid_json", "Invalid request payload"}
+    }
+    status, err := decodeJSON(bytes.NewReader(body), review, maxBodyBytes)
+    return trapped, status, err
+}
+
+// checkSubmission runs every check a submitted review must pass, trimming its fields, masking
+// blocked words when the filter is in mask mode and detecting the language, and returns the
+// rejected fields in order
+func (s *Server) checkSubmission(review *Review) []fieldError {
+    errs := reviewFieldErrors(review, s.maxRating, s.ratingOptional, s.minReviewLength)
+    if err := s.profanity.applyText(&review.Name); err != nil {
+        errs = append(errs, newFieldError("name", err))
+    }
+    if err := s.profanity.applyText(&review.Review); err != nil {
+        errs = append(errs, newFieldError("review", err))
+    }
+
+    // Tag the review with the language it is written in unless the client said so
+    if review.Language == "" {
+        review.Language = detectLanguage(review.Review)
+    }
+    return errs
+}
+
+// status returns the HTTP status a submission rejected for this field error is answered with
+func (e fieldError) status() int {
+    if e.Code == errorCode(errProfanity, "") {
+        return http.StatusUnprocessableEntity
+    }
+    return http.StatusBadRequest
+}
+
+// validateReviewHandler handles checking a review as if it were submitted, without storing it
+func (s *Server) validateReviewHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    var review Review
+    if status, err := decodeJSONBody(w, r, &review); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Report every rejected field at once so a form can highlight them all
+    if errs := s.checkSubmission(&review); len(errs) > 0 {
+        respondWithJSON(w, http.StatusOK, map[string]interface{}{"valid": false, "errors": errs})
+        return
+    }
+    respondWithJSON(w, http.StatusOK, map[string]interface{}{"valid": true})
+}
+
+// bulkImportHandler handles importing an array of reviews in one all-or-nothing request
+func (s *Server) bulkImportHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    partial, err := parseBatchMode(r)
+    if err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Parse the JSON array from the request body
+    var reviews []Review
+    if status, err := decodeJSONBodyWithLimit(w, r, &reviews, maxBulkBodyBytes); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+    if len(reviews) == 0 {
+        respondWithError(w, http.StatusBadRequest, "invalid_batch_size", "Invalid request payload. Must contain at least one review.")
+        return
+    }
+    if len(reviews) > maxBatchSize {
+        respondWithError(w, http.StatusBadRequest, "invalid_batch_size", fmt.Sprintf("Invalid request payload. Must contain at most %d reviews.", maxBatchSize))
+        return
+    }
+
+    // Only admins may import reviews marked as verified purchases
+    if !s.isAdmin(r) {
+        for i := range reviews {
+            reviews[i].Verified = false
+        }
+    }
+
+    user, _ := userFromContext(r.Context())
+    if partial {
+        s.importEach(w, r, reviews, user.ID)
+        return
+    }
+
+    // Validate every entry before touching the database
+    for i := range reviews {
+        if errs := s.checkSubmission(&reviews[i]); len(errs) > 0 {
+            respondWithErrorAt(w, errs[0].status(), errs[0].Code, errs[0].Message, i)
+            return
+        }
+        reviews[i].AuthorID = user.ID
+    }
+
+    ids, err := s.store.SaveAll(r.Context(), reviews)
+    if err != nil {
+        logger.Error("failed to import reviews", "request_id", requestIDFromContext(r.Context()), "error", err.Error())
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to import reviews")
+        return
+    }
+    reviewsSubmitted.Add(float64(len(ids)))
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    respondWithJSON(w, http.StatusCreated, map[string]interface{}{"success": true, "ids": ids})
+}
+
+// importEach saves every valid review of a ?mode=partial import on its own, reporting the outcome
+// of each entry instead of rejecting the whole batch over one bad entry
+func (s *Server) importEach(w http.ResponseWriter, r *http.Request, reviews []Review, authorID string) {
+    results := make([]batchResult, len(reviews))
+    saved := 0
+    for i := range reviews {
+        if errs := s.checkSubmission(&reviews[i]); len(errs) > 0 {
+            results[i] = failedEntry(i, errs[0].status(), errs[0].Code, errs[0].Message)
+            continue
+        }
+        reviews[i].AuthorID = authorID
+
+        id, err := s.store.Save(r.Context(), &reviews[i])
+        if errors.Is(err, errDuplicateReview) {
+            results[i] = failedEntry(i, http.StatusConflict, "duplicate_review", "Duplicate review. An identical review was submitted recently.")
+            continue
+        }
+        if err != nil {
+            results[i] = failedEntry(i, http.StatusInternalServerError, "internal_error", "Failed to save review")
+            continue
+        }
+        results[i] = batchResult{Index: i, ID: id, Success: true}
+        saved++
+    }
+
+    if saved > 0 {
+        reviewsSubmitted.Add(float64(saved))
+        s.statsCache.invalidate()
+        s.listCache.invalidate()
+    }
+    respondWithBatchResults(w, results)
+}
+
+// Batch processing modes accepted by the mode query parameter of the bulk endpoints
+const (
+    batchTransactional = "transactional"
+    batchPartial       = "partial"
+)
+
+// parseBatchMode reports whether a bulk request asks for ?mode=partial, which processes each
+// entry on its own; the default transactional mode applies every entry or none
+func parseBatchMode(r *http.Request) (bool, error) {
+    switch r.URL.Query().Get("mode") {
+    case "", batchTransactional:
+        return false, nil
+    case batchPartial:
+        return true, nil
+    }
+    return false, &codedError{"invalid_mode", "Invalid mode value. Must be transactional or partial."}
+}
+
+// batchResult is the outcome of one entry of a bulk request processed with ?mode=partial
+type batchResult struct {
+    Index   int        `json:"index"`           // Position of the entry in the request
+    ID      int        `json:"id,omitempty"`    // Review the entry created or deleted
+    Success bool       `json:"success"`
+    Error   *errorBody `json:"error,omitempty"` // Why the entry failed
+}
+
+// failedEntry reports the entry at index of a partial batch as failed with an error
+func failedEntry(index, status int, code, message string) batchResult {
+    return batchResult{Index: index, Error: &errorBody{Code: code, Message: message, Status: status}}
+}
+
+// respondWithBatchResults responds with the per-entry results of a partial batch; success is only
+// true when every entry succeeded
+func respondWithBatchResults(w http.ResponseWriter, results []batchResult) {
+    failed := 0
+    for _, result := range results {
+        if !result.Success {
+            failed++
+        }
+    }
+    respondWithJSON(w, http.StatusOK, map[string]interface{}{
+        "success":   failed == 0,
+        "succeeded": len(results) - failed,
+        "failed":    failed,
+        "results":   results,
+    })
+}
+
+// handlePutReview handles editing an existing review
+func (s *Server) handlePutReview(w http.ResponseWriter, r *http.Request) {
+    // Parse the JSON request body
+    var updated Review
+    if status, err := decodeJSONBody(w, r, &updated); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Only the author or an admin may edit a review
+    existing, err := s.store.GetByID(r.Context(), updated.ID)
+    if errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", updated.ID))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    if !s.canModify(r, existing.AuthorID) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only the author or an admin may edit this review")
+        return
+    }
+
+    // Validate the review fields; drafts stay drafts until published through /reviews/publish, and
+    // an author's edit goes back to moderation so approved text cannot be swapped afterwards
+    updated.Status = existing.Status
+    updated.Approved = existing.Approved && s.isAdmin(r)
+    if errs := s.checkSubmission(&updated); len(errs) > 0 {
+        respondWithError(w, errs[0].status(), errs[0].Code, errs[0].Message)
+        return
+    }
+
+    if err := s.store.Update(r.Context(), &updated); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", updated.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to update review")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Respond with the updated record as stored
+    review, err := s.store.GetByID(r.Context(), updated.ID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load updated review")
+        return
+    }
+    reviews := []Review{*review}
+    if err := s.attachRelated(r.Context(), reviews); err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load replies and images")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, reviews[0])
+}
+
+// handlePatchReview handles changing only the rating of an existing review
+func (s *Server) handlePatchReview(w http.ResponseWriter, r *http.Request) {
+    // Parse the JSON request body; other review fields are rejected as unknown
+    var requestData struct {
+        ID     int            `json:"id"`
+        Rating flexibleRating `json:"rating"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    if err := validateRating(int(requestData.Rating), s.maxRating); err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_rating"), err.Error())
+        return
+    }
+
+    // Only the author or an admin may change the rating
+    existing, err := s.store.GetByID(r.Context(), requestData.ID)
+    if errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", requestData.ID))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    if !s.canModify(r, existing.AuthorID) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only the author or an admin may edit this review")
+        return
+    }
+
+    if err := s.store.UpdateRating(r.Context(), requestData.ID, int(requestData.Rating)); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", requestData.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to update rating")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Respond with the updated record as stored
+    review, err := s.store.GetByID(r.Context(), requestData.ID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load updated review")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, review)
+}
+
+// handleGetReviews handles fetching a page of submitted reviews
+func (s *Server) handleGetReviews(w http.ResponseWriter, r *http.Request) {
+    // Parse pagination parameters from the query string
+    limit, err := parseIntParam(r, "limit", s.defaultLimit)
+    if err != nil || limit < 1 || limit > maxLimit {
+        respondWithError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf("Invalid limit value. Must be between 1 and %d.", maxLimit))
+        return
+    }
+    offset, err := parseIntParam(r, "offset", 0)
+    if err != nil || offset < 0 {
+        respondWithError(w, http.StatusBadRequest, "invalid_offset", "Invalid offset value. Must be a non-negative integer.")
+        return
+    }
+
+    // Parse the optional keyset cursor, which pages by id and so excludes offsets and other sort orders
+    var after int
+    query := r.URL.Query()
+    if query.Has("after") {
+        after, err = parseIntParam(r, "after", 0)
+        if err != nil || after < 0 {
+            respondWithError(w, http.StatusBadRequest, "invalid_after", "Invalid after value. Must be a non-negative integer.")
+            return
+        }
+        if query.Has("offset") || query.Get("sort") != "" {
+            respondWithError(w, http.StatusBadRequest, "invalid_pagination", "Invalid pagination. The after cursor cannot be combined with offset or sort.")
+            return
+        }
+    }
+
+    // Fall back to the configured sort order when the client names none; the cursor always pages by id
+    sort := query.Get("sort")
+    if sort == "" && !query.Has("after") {
+        sort = s.defaultSort
+    }
+
+    // Parse the optional filters on the reviews' content and status
+    filter, status, err := s.parseListingFilter(r)
+    if err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+    filter.AfterID = after
+
+    // Parse the optional list of fields to include in each review
+    var fields []string
+    if value := query.Get("fields"); value != "" {
+        if fields, err = parseFieldList(value); err != nil {
+            respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_fields"), err.Error())
+            return
+        }
+    }
+
+    // Load one extra review to learn whether another page follows; the total counts every
+    // matching review, not just those after the cursor. Unfiltered public listings in id order
+    // are served from the list cache when it is enabled, already carrying replies and images.
+    var reviews []Review
+    var total int
+    cached := s.listCache.enabled && sort == "" && isPublicListing(filter)
+    if cached {
+        reviews, total, err = s.cachedPage(r.Context(), w, filter.AfterID, limit+1, offset)
+    } else {
+        reviews, total, err = s.store.Load(r.Context(), filter, sort, limit+1, offset)
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load reviews")
+        return
+    }
+    hasMore := len(reviews) > limit
+    if hasMore {
+        reviews = reviews[:limit]
+    }
+    // Clients map over the list, so an empty page must encode as [] rather than null whatever the store returned
+    if reviews == nil {
+        reviews = []Review{}
+    }
+    if !cached {
+        if err := s.attachRelated(r.Context(), reviews); err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load replies and images")
+            return
+        }
+    }
+
+    // Results in id order can be continued with a cursor, whichever way the page was requested
+    var nextCursor *int
+    if hasMore && sort == "" {
+        nextCursor = &reviews[len(reviews)-1].ID
+    }
+
+    // Expose the pagination metadata as headers for generic HTTP clients
+    w.Header().Set("X-Total-Count", strconv.Itoa(total))
+    switch {
+    case query.Has("after"):
+        if nextCursor != nil {
+            w.Header().Set("Link", cursorLink(r, *nextCursor))
+        }
+    case query.Has("limit") || query.Has("offset"):
+        w.Header().Set("Link", paginationLinks(r, total, limit, offset))
+    }
+
+    // Trim each review down to the requested fields
+    var payload interface{} = reviews
+    if fields != nil {
+        if payload, err = selectFields(reviews, fields); err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to select fields")
+            return
+        }
+    }
+
+    // Respond with the page and enough metadata to build page controls
+    response := map[string]interface{}{
+        "reviews":     payload,
+        "total":       total,
+        "limit":       limit,
+        "offset":      offset,
+        "next_cursor": nextCursor,
+    }
+    respondWithETag(w, r, response)
+}
+
+// parseReviewFilter parses the optional review filters shared by listings and statistics from
+// the query string; the moderation status and cursor are left to the caller
+func (s *Server) parseReviewFilter(r *http.Request) (reviewFilter, error) {
+    var filter reviewFilter
+    var err error
+
+    // Parse the optional minimum rating filter
+    if r.URL.Query().Get("minRating") != "" {
+        minRating, err := parseIntParam(r, "minRating", 0)
+        if err != nil || minRating < 1 || minRating > s.maxRating {
+            return filter, &codedError{"invalid_min_rating", fmt.Sprintf("Invalid minRating value. Must be between 1 and %d.", s.maxRating)}
+        }
+        filter.MinRating = minRating
+    }
+
+    // Parse the optional creation time range; either end may be left open
+    if filter.From, err = parseTimeParam(r, "from"); err != nil {
+        return filter, &codedError{"invalid_from", "Invalid from value. Must be an RFC 3339 time or a YYYY-MM-DD date."}
+    }
+    if filter.To, err = parseTimeParam(r, "to"); err != nil {
+        return filter, &codedError{"invalid_to", "Invalid to value. Must be an RFC 3339 time or a YYYY-MM-DD date."}
+    }
+    if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+        return filter, &codedError{"invalid_range", "Invalid time range. to must be later than from."}
+    }
+
+    // Parse the optional product filter
+    filter.ProductID = strings.TrimSpace(r.URL.Query().Get("productId"))
+
+    // Parse the optional language filter
+    if lang := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("lang"))); lang != "" {
+        if !languageCodePattern.MatchString(lang) {
+            return filter, &codedError{"invalid_lang", "Invalid lang value. Must be an ISO 639-1 or 639-3 code such as en."}
+        }
+        filter.Language = lang
+    }
+
+    // Parse the optional reviewer name, trimmed like submitted names are
+    filter.Name = strings.TrimSpace(r.URL.Query().Get("name"))
+
+    // Parse the optional text search term
+    filter.Search = strings.TrimSpace(r.URL.Query().Get("search"))
+
+    // Parse the optional verified purchase filter
+    if value := r.URL.Query().Get("verifiedOnly"); value != "" {
+        verifiedOnly, err := strconv.ParseBool(value)
+        if err != nil {
+            return filter, &codedError{"invalid_verified_only", "Invalid verifiedOnly value. Must be true or false."}
+        }
+        filter.VerifiedOnly = verifiedOnly
+    }
+    return filter, nil
+}
+
+// parseListingFilter parses the filters of a review listing along with the moderation status it
+// lists, restricting drafts to their author and hiding blocked reviewers from the public; on
+// failure it also returns the HTTP status to respond with
+func (s *Server) parseListingFilter(r *http.Request) (reviewFilter, int, error) {
+    filter, err := s.parseReviewFilter(r)
+    if err != nil {
+        return filter, http.StatusBadRequest, err
+    }
+
+    // Only approved reviews are listed unless a moderator asks for another status
+    switch status := r.URL.Query().Get("status"); status {
+    case "", statusApproved, statusPending, statusAll, statusDraft:
+        filter.Status = status
+    default:
+        return filter, http.StatusBadRequest, &codedError{"invalid_status", "Invalid status value. Must be approved, pending, all or draft."}
+    }
+    if (filter.Status == statusPending || filter.Status == statusAll) && !s.isAdmin(r) {
+        return filter, http.StatusForbidden, &codedError{"forbidden", "Only admins may list reviews awaiting moderation"}
+    }
+
+    // Drafts are private, so users other than admins only list their own
+    user, ok := userFromContext(r.Context())
+    if filter.Status == statusDraft && !s.isAdmin(r) {
+        if !ok {
+            return filter, http.StatusUnauthorized, &codedError{"unauthorized", "Listing drafts requires a user token"}
+        }
+        filter.AuthorID = user.ID
+    }
+
+    // Reviews by blocked reviewers are only listed to admins, whatever the status
+    filter.HideBlocked = !user.Admin
+    return filter, 0, nil
+}
+
+// countReviewsHandler handles counting the reviews a listing with the same filters would return,
+// without loading any of them
+func (s *Server) countReviewsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    filter, status, err := s.parseListingFilter(r)
+    if err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    count, err := s.store.Count(r.Context(), filter)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to count reviews")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, map[string]int{"count": count})
+}
+
+// isPublicListing reports whether filter selects the default public listing of approved reviews,
+// paged with at most a cursor, which is the only listing the list cache holds
+func isPublicListing(filter reviewFilter) bool {
+    public := reviewFilter{Status: filter.Status, HideBlocked: true, AfterID: filter.AfterID}
+    return filter == public && (filter.Status == "" || filter.Status == statusApproved)
+}
+
+// cachedPage returns up to limit cached reviews after the afterID cursor and offset, with the
+// number of all cached reviews; the list is reloaded first if a write invalidated it
+func (s *Server) cachedPage(ctx context.Context, w http.ResponseWriter, afterID, limit, offset int) ([]Review, int, error) {
+    all, generation, hit := s.listCache.get()
+    if hit {
+        w.Header().Set("X-Cache", "HIT")
+    } else {
+        var err error
+        if all, err = s.loadListing(ctx); err != nil {
+            return nil, 0, err
+        }
+        s.listCache.set(all, generation)
+        w.Header().Set("X-Cache", "MISS")
+    }
+
+    // The cached reviews are in id order, so the cursor can be found by binary search
+    start, _ := slices.BinarySearchFunc(all, afterID+1, func(review Review, id int) int { return review.ID - id })
+    start = min(start+offset, len(all))
+    end := min(start+limit, len(all))
+
+    // Copy the page since the cached reviews are shared between requests
+    return slices.Clone(all[start:end]), len(all), nil
+}
+
+// loadListing loads every publicly listed review in id order, with replies and images attached
+func (s *Server) loadListing(ctx context.Context) ([]Review, error) {
+    reviews, _, err := s.store.Load(ctx, reviewFilter{Status: statusApproved, HideBlocked: true}, "", -1, 0)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.attachRelated(ctx, reviews); err != nil {
+        return nil, err
+    }
+    return reviews, nil
+}
+
+// parseFieldList parses a comma-separated list of review fields, ignoring blanks and repeats, and
+// rejects fields that are unknown or never returned
+func parseFieldList(value string) ([]string, error) {
+    selectable := slices.DeleteFunc(reviewFieldNames(), func(name string) bool { return name == "email" })
+    var fields []string
+    for _, field := range strings.Split(value, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" || slices.Contains(fields, field) {
+            continue
+        }
+        if !slices.Contains(selectable, field) {
+            return nil, &codedError{"invalid_fields", fmt.Sprintf("Invalid fields value. Unknown field %q; must be among %s.", field, strings.Join(selectable, ", "))}
+        }
+        fields = append(fields, field)
+    }
+    if len(fields) == 0 {
+        return nil, &codedError{"invalid_fields", "Invalid fields value. Must name at least one field."}
+    }
+    return fields, nil
+}
+
+// selectFields encodes each review as an object holding only the given fields; fields a review
+// omits when empty, such as replies, stay omitted
+func selectFields(reviews []Review, fields []string) ([]map[string]json.RawMessage, error) {
+    selected := make([]map[string]json.RawMessage, len(reviews))
+    for i, review := range reviews {
+        encoded, err := json.Marshal(review)
+        if err != nil {
+            return nil, err
+        }
+        var all map[string]json.RawMessage
+        if err := json.Unmarshal(encoded, &all); err != nil {
+            return nil, err
+        }
+        selected[i] = make(map[string]json.RawMessage, len(fields))
+        for _, field := range fields {
+            if value, ok := all[field]; ok {
+                selected[i][field] = value
+            }
+        }
+    }
+    return selected, nil
+}
+
+// respondWithETag responds with payload tagged with a hash of its JSON encoding, or with 304 Not
+// Modified when the request's If-None-Match already names that tag, so polling clients only
+// download the body when it changed
+func respondWithETag(w http.ResponseWriter, r *http.Request, payload interface{}) {
+    body, err := marshalResponse(w, payload)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to marshal JSON response")
+        return
+    }
+    sum := sha256.Sum256(body)
+    etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "no-cache")
+    if etagMatches(r.Header.Get("If-None-Match"), etag) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(append(body, '\n'))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag or is "*", using the weak
+// comparison that conditional GETs call for
+func etagMatches(ifNoneMatch, etag string) bool {
+    for _, candidate := range strings.Split(ifNoneMatch, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// paginationLinks builds an RFC 5988 Link header value with first, prev, next and last page URLs,
+// keeping the /t/{tenant} prefix the request was routed through
+func paginationLinks(r *http.Request, total, limit, offset int) string {
+    pageURL := func(pageOffset int) string {
+        u := *r.URL
+        query := u.Query()
+        query.Set("limit", strconv.Itoa(limit))
+        query.Set("offset", strconv.Itoa(pageOffset))
+        u.RawQuery = query.Encode()
+        return tenantPrefixFromContext(r.Context()) + u.RequestURI()
+    }
+
+    var links []string
+    link := func(pageOffset int, rel string) {
+        links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, pageURL(pageOffset), rel))
+    }
+
+    lastOffset := 0
+    if total > 0 {
+        lastOffset = (total - 1) / limit * limit
+    }
+    link(0, "first")
+    if offset > 0 {
+        link(max(offset-limit, 0), "prev")
+    }
+    if offset+limit < total {
+        link(offset+limit, "next")
+    }
+    link(lastOffset, "last")
+    return strings.Join(links, ", ")
+}
+
+// cursorLink builds a Link header value pointing at the page after the given cursor, keeping the
+// /t/{tenant} prefix the request was routed through
+func cursorLink(r *http.Request, cursor int) string {
+    u := *r.URL
+    query := u.Query()
+    query.Set("after", strconv.Itoa(cursor))
+    u.RawQuery = query.Encode()
+    return fmt.Sprintf(`<%s%s>; rel="next"`, tenantPrefixFromContext(r.Context()), u.RequestURI())
+}
+
+// parseIntParam reads an integer query parameter, returning def when it is absent
+func parseIntParam(r *http.Request, name string, def int) (int, error) {
+    value := r.URL.Query().Get(name)
+    if value == "" {
+        return def, nil
+    }
+    return strconv.Atoi(value)
+}
+
+// exportFilter selects the reviews streamed by an export: every published review for admins, and
+// only approved reviews for everyone else. Like listings, reviews by blocked reviewers are only
+// exported to users with an admin token.
+func (s *Server) exportFilter(r *http.Request) reviewFilter {
+    user, _ := userFromContext(r.Context())
+    if s.isAdmin(r) {
+        return reviewFilter{Status: statusAll, HideBlocked: !user.Admin}
+    }
+    return reviewFilter{Status: statusApproved, HideBlocked: true}
+}
+
+// exportJSONLinesHandler handles streaming every review as one JSON object per line; rows are
+// written as they are read so memory use does not grow with the number of reviews
+func (s *Server) exportJSONLinesHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.Header().Set("Content-Disposition", "attachment; filename=reviews.jsonl")
+
+    // Flush periodically so clients receive rows while the export is still running; a large
+    // export may take longer than the server's write timeout, so it is lifted for this response
+    encoder := json.NewEncoder(w)
+    controller := http.NewResponseController(w)
+    controller.SetWriteDeadline(time.Time{})
+    written := 0
+    err := s.store.ForEach(r.Context(), s.exportFilter(r), func(review Review) error {
+        if err := encoder.Encode(review); err != nil {
+            return err
+        }
+        if written++; written%jsonLinesFlushInterval == 0 {
+            return controller.Flush()
+        }
+        return nil
+    })
+
+    // Headers are already sent at this point, so the failure can only be logged
+    if err != nil {
+        logger.Error("failed to export reviews as JSON Lines", "request_id", requestIDFromContext(r.Context()), "error", err.Error())
+    }
+}
+
+// parseTimeParam reads a time query parameter given as RFC 3339 or as a UTC date, returning the
+// zero time when it is absent
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+    value := r.URL.Query().Get(name)
+    if value == "" {
+        return time.Time{}, nil
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    return time.Parse(time.DateOnly, value)
+}
+
+// exportCSVHandler handles streaming every review as a CSV attachment
+func (s *Server) exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/csv")
+    w.Header().Set("Content-Disposition", "attachment; filename=reviews.csv")
+
+    // A large export may take longer than the server's write timeout, so it is lifted for this response
+    http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+    // The csv writer quotes fields containing commas, quotes or newlines
+    writer := csv.NewWriter(w)
+    writer.Write([]string{"id", "product_id", "name", "review", "rating"})
+    err := s.store.ForEach(r.Context(), s.exportFilter(r), func(review Review) error {
+        return writer.Write([]string{strconv.Itoa(review.ID), review.ProductID, review.Name, review.Review, formatRating(review.Rating)})
+    })
+    writer.Flush()
+
+    // Headers are already sent at this point, so the failure can only be logged
+    if err == nil {
+        err = writer.Error()
+    }
+    if err != nil {
+        logger.Error("failed to export reviews as CSV", "request_id", requestIDFromContext(r.Context()), "error", err.Error())
+    }
+}
+
+// formatRating formats a rating for the CSV export, leaving the cell empty when there is none
+func formatRating(rating *int) string {
+    if rating == nil {
+        return ""
+    }
+    return strconv.Itoa(*rating)
+}
+
+// getReviewHandler handles fetching a single review by the id query parameter
+func (s *Server) getReviewHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    id, err := strconv.Atoi(r.URL.Query().Get("id"))
+    if err != nil {
+        respondWithError(w, http.StatusBadRequest, "invalid_id", "Missing or invalid id parameter")
+        return
+    }
+
+    review, err := s.store.GetByID(r.Context(), id)
+    if errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+
+    visible, err := s.reviewVisible(r, review)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    if !visible {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id))
+        return
+    }
+
+    // Nest the review's replies and images in the response
+    reviews := []Review{*review}
+    if err := s.attachRelated(r.Context(), reviews); err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load replies and images")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, reviews[0])
+}
+
+// reviewVisible reports whether the caller of r may see review: drafts and reviews awaiting
+// moderation are only shown to their author, and reviews by blocked reviewers or hidden after
+// being flagged to admins
+func (s *Server) reviewVisible(r *http.Request, review *Review) (bool, error) {
+    if (review.Status == reviewDraft || !review.Approved) && !s.canModify(r, review.AuthorID) {
+        return false, nil
+    }
+    if user, _ := userFromContext(r.Context()); user.Admin {
+        return true, nil
+    }
+    blocked, err := s.store.IsBlocked(r.Context(), review.Name)
+    if err != nil || blocked {
+        return false, err
+    }
+    // Flagged reviews stay hidden until a moderator has looked at them
+    if !review.Approved {
+        hidden, err := s.store.IsHidden(r.Context(), review.ID)
+        return !hidden, err
+    }
+    return true, nil
+}
+
+// attachRelated loads the replies to and the images of the given reviews and nests them in each review
+func (s *Server) attachRelated(ctx context.Context, reviews []Review) error {
+    ids := make([]int, len(reviews))
+    for i, review := range reviews {
+        ids[i] = review.ID
+    }
+    replies, err := s.store.LoadReplies(ctx, ids)
+    if err != nil {
+        return err
+    }
+    images, err := s.store.LoadImages(ctx, ids)
+    if err != nil {
+        return err
+    }
+    for i := range reviews {
+        reviews[i].Replies = replies[reviews[i].ID]
+        reviews[i].Images = images[reviews[i].ID]
+    }
+    return nil
+}
+
+// topReviewsHandler handles listing the highest-rated public reviews for highlights
+func (s *Server) topReviewsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    n, err := parseIntParam(r, "n", defaultTopReviews)
+    if err != nil || n < 1 || n > maxTopReviews {
+        respondWithError(w, http.StatusBadRequest, "invalid_n", fmt.Sprintf("Invalid n value. Must be between 1 and %d.", maxTopReviews))
+        return
+    }
+
+    reviews, err := s.store.Top(r.Context(), n)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load reviews")
+        return
+    }
+    if err := s.attachRelated(r.Context(), reviews); err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load replies and images")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, map[string][]Review{"reviews": reviews})
+}
+
+// feedHandler handles rendering the newest approved reviews, optionally of one product, as an RSS feed
+func (s *Server) feedHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    n, err := parseIntParam(r, "n", defaultFeedItems)
+    if err != nil || n < 1 || n > maxFeedItems {
+        respondWithError(w, http.StatusBadRequest, "invalid_n", fmt.Sprintf("Invalid n value. Must be between 1 and %d.", maxFeedItems))
+        return
+    }
+    productID := strings.TrimSpace(r.URL.Query().Get("productId"))
+
+    filter := reviewFilter{ProductID: productID, Status: statusApproved, HideBlocked: true}
+    reviews, _, err := s.store.Load(r.Context(), filter, "newest", n, 0)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load reviews")
+        return
+    }
+
+    body, err := xml.MarshalIndent(newReviewFeed(reviews, requestBaseURL(r), productID), "", "  ")
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to render feed")
+        return
+    }
+    w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte(xml.Header))
+    w.Write(body)
+}
+
+// historyHandler handles listing the audit log of the review named in the path
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    id, err := strconv.Atoi(r.PathValue("id"))
+    if err != nil {
+        respondWithError(w, http.StatusBadRequest, "invalid_id", "Invalid review id in path")
+        return
+    }
+
+    // Admins see every history; anyone else only that of a review they may see, so none once it
+    // is deleted
+    review, err := s.store.GetByID(r.Context(), id)
+    exists := !errors.Is(err, errReviewNotFound)
+    if err != nil && exists {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    visible := s.isAdmin(r)
+    if exists && !visible {
+        visible, err = s.reviewVisible(r, review)
+        if err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+            return
+        }
+    }
+    if !visible {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id))
+        return
+    }
+
+    entries, err := s.store.History(r.Context(), id)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review history")
+        return
+    }
+    if entries == nil {
+        entries = []AuditEntry{}
+    }
+
+    // Reviews saved before the audit log existed have no entries, so only report a missing
+    // review when it is not in the database either
+    if len(entries) == 0 && !exists {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id))
+        return
+    }
+    respondWithJSON(w, http.StatusOK, entries)
+}
+
+// replyHandler handles posting a public reply to a review
+func (s *Server) replyHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    // Parse the JSON request body to get the review and the reply text
+    var requestData struct {
+        ReviewID int    `json:"reviewId"`
+        Text     string `json:"text"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    reply := Reply{ReviewID: requestData.ReviewID, Text: requestData.Text}
+    if err := validateReply(&reply); err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_text"), err.Error())
+        return
+    }
+    if err := s.profanity.applyText(&reply.Text); err != nil {
+        respondWithError(w, http.StatusUnprocessableEntity, errorCode(err, "blocked_language"), err.Error())
+        return
+    }
+
+    // The author always comes from the token, never from the payload
+    user, _ := userFromContext(r.Context())
+    reply.AuthorID = user.ID
+
+    id, err := s.store.SaveReply(r.Context(), &reply)
+    if errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", reply.ReviewID))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to save reply")
+        return
+    }
+    reply.ID = id
+    s.listCache.invalidate()
+    respondWithJSON(w, http.StatusCreated, reply)
+}
+
+// publishHandler handles publishing a draft review, checking it as strictly as any submission
+func (s *Server) publishHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    // Parse the JSON request body to get the ID of the draft to publish
+    var requestData struct {
+        ID int `json:"id"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Only the author or an admin may publish a draft
+    review, err := s.store.GetByID(r.Context(), requestData.ID)
+    if errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", requestData.ID))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    if !s.canModify(r, review.AuthorID) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only the author or an admin may publish this review")
+        return
+    }
+    if review.Status != reviewDraft {
+        respondWithError(w, http.StatusConflict, "not_draft", fmt.Sprintf("Review %d is already published", review.ID))
+        return
+    }
+
+    // Drafts may be incomplete, so they are validated in full only now
+    review.Status = reviewPublished
+    if errs := s.checkSubmission(review); len(errs) > 0 {
+        respondWithError(w, errs[0].status(), errs[0].Code, errs[0].Message)
+        return
+    }
+    if err := s.store.Publish(r.Context(), review); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusConflict, "not_draft", fmt.Sprintf("Review %d is already published", review.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to publish review")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Respond with the published review as stored
+    published, err := s.store.GetByID(r.Context(), review.ID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load published review")
+        return
+    }
+    reviews := []Review{*published}
+    if err := s.attachRelated(r.Context(), reviews); err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load replies and images")
+        return
+    }
+    s.webhooks.notify(reviews[0])
+    respondWithJSON(w, http.StatusOK, reviews[0])
+}
+
+// deleteReviewHandler handles the deletion of a review by ID
+func (s *Server) deleteReviewHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        respondMethodNotAllowed(w, "DELETE")
+        return
+    }
+
+    // Parse the JSON request body to get the ID of the review to delete
+    var requestData struct {
+        ID int `json:"id"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+    s.deleteReview(w, r, requestData.ID)
+}
+
+// deleteReviewByPathHandler handles DELETE /reviews/{id}, the body-less form of /delete-review
+func (s *Server) deleteReviewByPathHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        respondMethodNotAllowed(w, "DELETE")
+        return
+    }
+
+    id, err := strconv.Atoi(r.PathValue("id"))
+    if err != nil {
+        respondWithError(w, http.StatusBadRequest, "invalid_id", "Invalid review id in path")
+        return
+    }
+    s.deleteReview(w, r, id)
+}
+
+// deleteReview soft-deletes the review with the given id on behalf of its author or an admin
+func (s *Server) deleteReview(w http.ResponseWriter, r *http.Request, id int) {
+    if id <= 0 {
+        respondWithError(w, http.StatusBadRequest, "invalid_id", "Invalid id value. Must be a positive integer.")
+        return
+    }
+
+    // Only the author or an admin may delete a review
+    existing, err := s.store.GetByID(r.Context(), id)
+    if errors.Is(err, errReviewNotFound) {
+        respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    if !s.canModify(r, existing.AuthorID) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only the author or an admin may delete this review")
+        return
+    }
+
+    // Remove the review from the database; it may have been deleted since it was loaded
+    if err := s.store.Delete(r.Context(), id); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to delete review")
+        return
+    }
+    reviewsDeleted.Inc()
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Respond with success
+    respondWithJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// deleteReviewsHandler handles the deletion of several reviews by ID in one request
+func (s *Server) deleteReviewsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        respondMethodNotAllowed(w, "DELETE")
+        return
+    }
+
+    if !s.isAdmin(r) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only admins may delete several reviews at once")
+        return
+    }
+    partial, err := parseBatchMode(r)
+    if err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Parse the JSON request body to get the IDs of the reviews to delete
+    var requestData struct {
+        IDs []int `json:"ids"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Drop duplicate IDs so the requested count reflects distinct reviews
+    seen := make(map[int]bool, len(requestData.IDs))
+    ids := make([]int, 0, len(requestData.IDs))
+    for _, id := range requestData.IDs {
+        if !seen[id] {
+            seen[id] = true
+            ids = append(ids, id)
+        }
+    }
+    if len(ids) == 0 {
+        respondWithError(w, http.StatusBadRequest, "invalid_ids", "Invalid ids value. Must contain at least one id.")
+        return
+    }
+    if len(ids) > maxBatchSize {
+        respondWithError(w, http.StatusBadRequest, "invalid_ids", fmt.Sprintf("Invalid ids value. Must contain at most %d ids.", maxBatchSize))
+        return
+    }
+
+    if partial {
+        s.deleteEach(w, r, requestData.IDs)
+        return
+    }
+
+    deleted, err := s.store.DeleteMany(r.Context(), ids)
+    if err != nil {
+        logger.Error("failed to delete reviews", "request_id", requestIDFromContext(r.Context()), "error", err.Error())
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to delete reviews")
+        return
+    }
+    reviewsDeleted.Add(float64(len(deleted)))
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Report which of the requested reviews did not exist
+    wasDeleted := make(map[int]bool, len(deleted))
+    for _, id := range deleted {
+        wasDeleted[id] = true
+    }
+    notFound := []int{}
+    for _, id := range ids {
+        if !wasDeleted[id] {
+            notFound = append(notFound, id)
+        }
+    }
+
+    respondWithJSON(w, http.StatusOK, map[string]interface{}{
+        "success":   len(notFound) == 0,
+        "requested": len(ids),
+        "deleted":   len(deleted),
+        "not_found": notFound,
+    })
+}
+
+// approveReviewHandler handles approving a pending review by ID
+func (s *Server) approveReviewHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    if !s.isAdmin(r) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only admins may approve reviews")
+        return
+    }
+
+    // Parse the JSON request body to get the ID of the review to approve
+    var requestData struct {
+        ID int `json:"id"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    if err := s.store.Approve(r.Context(), requestData.ID); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", requestData.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to approve review")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Respond with the approved record
+    review, err := s.store.GetByID(r.Context(), requestData.ID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load approved review")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, review)
+}
+
+// helpfulHandler handles marking a published review as helpful, once per client
+func (s *Server) helpfulHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    // Parse the JSON request body to get the ID of the helpful review
+    var requestData struct {
+        ID int `json:"id"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    // Claim the vote before counting it so concurrent requests from one client cannot both succeed
+    ip := clientIP(r)
+    if !s.helpfulVotes.claim(ip, requestData.ID) {
+        respondWithError(w, http.StatusConflict, "already_voted", "Review already marked as helpful")
+        return
+    }
+
+    if err := s.store.MarkHelpful(r.Context(), requestData.ID); err != nil {
+        s.helpfulVotes.release(ip, requestData.ID)
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", requestData.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to mark review as helpful")
+        return
+    }
+    s.listCache.invalidate()
+
+    // Respond with the updated record
+    review, err := s.store.GetByID(r.Context(), requestData.ID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load review")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, review)
+}
+
+// flagHandler handles a reader reporting an inappropriate review, once per client, and hides the
+// review from the public once it has been flagged flagThreshold times
+func (s *Server) flagHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    // Parse the JSON request body to get the review and the reason it was flagged
+    var requestData struct {
+        ID     int    `json:"id"`
+        Reason string `json:"reason"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    flag := Flag{ReviewID: requestData.ID, Reason: requestData.Reason}
+    if err := validateFlag(&flag); err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_reason"), err.Error())
+        return
+    }
+
+    // The author always comes from the token, never from the payload
+    user, _ := userFromContext(r.Context())
+    flag.AuthorID = user.ID
+
+    // Claim the flag before counting it so one client cannot hide a review on its own
+    ip := clientIP(r)
+    if !s.flagVotes.claim(ip, flag.ReviewID) {
+        respondWithError(w, http.StatusConflict, "already_flagged", "Review already flagged")
+        return
+    }
+
+    id, hidden, err := s.store.SaveFlag(r.Context(), &flag, s.flagThreshold)
+    if err != nil {
+        s.flagVotes.release(ip, flag.ReviewID)
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", flag.ReviewID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to flag review")
+        return
+    }
+    flag.ID = id
+    if hidden {
+        logger.Info("review hidden pending moderation", "request_id", requestIDFromContext(r.Context()), "review_id", flag.ReviewID, "flags", s.flagThreshold)
+        s.statsCache.invalidate()
+        s.listCache.invalidate()
+    }
+    respondWithJSON(w, http.StatusCreated, flag)
+}
+
+// deleteEach deletes the reviews of a ?mode=partial bulk delete one at a time, reporting the outcome
+// for the first occurrence of each id; repeated ids are left out of the results
+func (s *Server) deleteEach(w http.ResponseWriter, r *http.Request, ids []int) {
+    results := []batchResult{}
+    seen := make(map[int]bool, len(ids))
+    deleted := 0
+    for i, id := range ids {
+        if seen[id] {
+            continue
+        }
+        seen[id] = true
+
+        if id <= 0 {
+            results = append(results, failedEntry(i, http.StatusBadRequest, "invalid_id", "Invalid id value. Must be a positive integer."))
+            continue
+        }
+        err := s.store.Delete(r.Context(), id)
+        if errors.Is(err, errReviewNotFound) {
+            results = append(results, failedEntry(i, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", id)))
+            continue
+        }
+        if err != nil {
+            results = append(results, failedEntry(i, http.StatusInternalServerError, "internal_error", "Failed to delete review"))
+            continue
+        }
+        results = append(results, batchResult{Index: i, ID: id, Success: true})
+        deleted++
+    }
+
+    if deleted > 0 {
+        reviewsDeleted.Add(float64(deleted))
+        s.statsCache.invalidate()
+        s.listCache.invalidate()
+    }
+    respondWithBatchResults(w, results)
+}
+
+// restoreReviewHandler handles restoring a soft-deleted review by ID
+func (s *Server) restoreReviewHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    if !s.isAdmin(r) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only admins may restore reviews")
+        return
+    }
+
+    // Parse the JSON request body to get the ID of the review to restore
+    var requestData struct {
+        ID int `json:"id"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    if err := s.store.Restore(r.Context(), requestData.ID); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No deleted review found with id %d", requestData.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to restore review")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    // Respond with the restored record
+    review, err := s.store.GetByID(r.Context(), requestData.ID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load restored review")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, review)
+}
+
+// purgeReviewHandler handles permanently removing a review by ID
+func (s *Server) purgeReviewHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        respondMethodNotAllowed(w, "DELETE")
+        return
+    }
+
+    if !s.isAdmin(r) {
+        respondWithError(w, http.StatusForbidden, "forbidden", "Only admins may purge reviews")
+        return
+    }
+
+    // Parse the JSON request body to get the ID of the review to purge
+    var requestData struct {
+        ID int `json:"id"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+
+    if err := s.store.Purge(r.Context(), requestData.ID); err != nil {
+        if errors.Is(err, errReviewNotFound) {
+            respondWithError(w, http.StatusNotFound, "review_not_found", fmt.Sprintf("No review found with id %d", requestData.ID))
+            return
+        }
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to purge review")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+
+    respondWithJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// statsHandler handles fetching aggregate rating statistics, optionally for a single product
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    productID := strings.TrimSpace(r.URL.Query().Get("productId"))
+    var weighted bool
+    if value := r.URL.Query().Get("weighted"); value != "" {
+        var err error
+        if weighted, err = strconv.ParseBool(value); err != nil {
+            respondWithError(w, http.StatusBadRequest, "invalid_weighted", "Invalid weighted value. Must be true or false.")
+            return
+        }
+    }
+
+    cached, generation, hit := s.statsCache.get(productID)
+    if hit {
+        w.Header().Set("X-Cache", "HIT")
+        s.respondWithStats(w, r, cached, productID, weighted)
+        return
+    }
+
+    stats, err := s.computeStats(r.Context(), productID)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load statistics")
+        return
+    }
+    if s.statsCache.enabled() {
+        s.statsCache.set(productID, stats, generation)
+        w.Header().Set("X-Cache", "MISS")
+    }
+    s.respondWithStats(w, r, stats, productID, weighted)
+}
+
+// computeStats computes the stats of a product, or of every product for "", from the stored reviews
+func (s *Server) computeStats(ctx context.Context, productID string) (*ReviewStats, error) {
+    stats, err := s.store.Stats(ctx, productID)
+    if err != nil {
+        return nil, err
+    }
+
+    // List every rating on the scale, including those nobody gave
+    for rating := 1; rating <= s.maxRating; rating++ {
+        if _, ok := stats.Breakdown[rating]; !ok {
+            stats.Breakdown[rating] = 0
+        }
+    }
+    return stats, nil
+}
+
+// respondWithStats responds with stats, adding the recency-weighted average when asked to; the
+// weighted average changes as time passes, so it is computed afresh rather than cached
+func (s *Server) respondWithStats(w http.ResponseWriter, r *http.Request, stats *ReviewStats, productID string, weighted bool) {
+    if !weighted {
+        respondWithJSON(w, http.StatusOK, stats)
+        return
+    }
+
+    average, err := s.store.WeightedAverage(r.Context(), productID, s.ratingHalfLife, time.Now().UTC())
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load statistics")
+        return
+    }
+    // Copy the stats since cached ones are shared between requests
+    result := *stats
+    result.WeightedAverage = &average
+    respondWithJSON(w, http.StatusOK, &result)
+}
+
+// distributionHandler handles counting the approved reviews at each star rating, optionally
+// restricted by the same filters as review listings
+func (s *Server) distributionHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    filter, err := s.parseReviewFilter(r)
+    if err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_request"), err.Error())
+        return
+    }
+    filter.Status = statusApproved
+
+    distribution, err := s.store.Distribution(r.Context(), filter)
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load statistics")
+        return
+    }
+
+    // List every rating on the scale, including those nobody gave
+    for rating := 1; rating <= s.maxRating; rating++ {
+        if _, ok := distribution[rating]; !ok {
+            distribution[rating] = 0
+        }
+    }
+    respondWithJSON(w, http.StatusOK, distribution)
+}
+
+// configHandler reports the settings frontends need to render forms, such as the rating scale
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    respondWithJSON(w, http.StatusOK, map[string]interface{}{"maxRating": s.maxRating, "ratingRequired": !s.ratingOptional, "minReviewLength": s.minReviewLength})
+}
+
+// blockHandler lists the blocked reviewer names or blocks another one, hiding their reviews from
+// public listings without deleting them
+func (s *Server) blockHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        names, err := s.store.BlockedNames(r.Context())
+        if err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load blocked names")
+            return
+        }
+        respondWithJSON(w, http.StatusOK, map[string][]string{"names": names})
+    case http.MethodPost:
+        name, ok := decodeNameRequest(w, r)
+        if !ok {
+            return
+        }
+        if err := s.store.BlockName(r.Context(), name); err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to block name")
+            return
+        }
+        s.statsCache.invalidate()
+        s.listCache.invalidate()
+        respondWithJSON(w, http.StatusOK, map[string]bool{"success": true})
+    default:
+        respondMethodNotAllowed(w, "GET, POST")
+    }
+}
+
+// unblockHandler shows the reviews of a blocked reviewer again
+func (s *Server) unblockHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    name, ok := decodeNameRequest(w, r)
+    if !ok {
+        return
+    }
+    err := s.store.UnblockName(r.Context(), name)
+    if errors.Is(err, errNameNotBlocked) {
+        respondWithError(w, http.StatusNotFound, "name_not_blocked", fmt.Sprintf("The name %q is not blocked", name))
+        return
+    }
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to unblock name")
+        return
+    }
+    s.statsCache.invalidate()
+    s.listCache.invalidate()
+    respondWithJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// decodeNameRequest parses a {"name": "..."} body, trimming the name like submitted names are; it
+// responds with an error and reports false when the body or the name is invalid
+func decodeNameRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+    var requestData struct {
+        Name string `json:"name"`
+    }
+    if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+        respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+        return "", false
+    }
+    name := strings.TrimSpace(requestData.Name)
+    if err := validateText("name", name, maxNameLength); err != nil {
+        respondWithError(w, http.StatusBadRequest, errorCode(err, "invalid_name"), err.Error())
+        return "", false
+    }
+    return name, true
+}
+
+// summaryHandler reports how many reviews are in each moderation state for the admin dashboard
+func (s *Server) summaryHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    summary, err := s.store.Summary(r.Context())
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load summary")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, summary)
+}
+
+// flaggedHandler handles listing the reviews readers have flagged since they were last approved
+func (s *Server) flaggedHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    flagged, err := s.store.Flagged(r.Context())
+    if err != nil {
+        respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to load flagged reviews")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, flagged)
+}
+
+// statsDiscrepancy names the figures of a product's cached stats that differed from the stored reviews
+type statsDiscrepancy struct {
+    ProductID string   `json:"productId"` // Empty for the stats of every product
+    Fields    []string `json:"fields"`
+}
+
+// recalculateReport describes what POST /admin/recalculate found and fixed
+type recalculateReport struct {
+    StatsChecked   int                `json:"statsChecked"`   // Cached stats compared with the stored reviews
+    StatsFixed     []statsDiscrepancy `json:"statsFixed"`     // Cached stats that were stale and have been replaced
+    ListCacheFixed bool               `json:"listCacheFixed"` // Whether the cached review listing was stale and has been replaced
+}
+
+// recalculateHandler recomputes every cached aggregate from the stored reviews, replacing and
+// logging the ones that drifted, e.g. through writes of another process sharing the database
+func (s *Server) recalculateHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        respondMethodNotAllowed(w, "POST")
+        return
+    }
+
+    ctx := r.Context()
+    requestID := requestIDFromContext(ctx)
+    report := recalculateReport{StatsFixed: []statsDiscrepancy{}}
+
+    cached, generation := s.statsCache.snapshot()
+    for productID, stale := range cached {
+        stats, err := s.computeStats(ctx, productID)
+        if err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to recalculate statistics")
+            return
+        }
+        report.StatsChecked++
+        if fields := statsDifferences(stale, stats); len(fields) > 0 {
+            logger.Warn("fixed stale cached stats", "request_id", requestID, "product_id", productID, "fields", strings.Join(fields, ","))
+            report.StatsFixed = append(report.StatsFixed, statsDiscrepancy{ProductID: productID, Fields: fields})
+            s.statsCache.set(productID, stats, generation)
+        }
+    }
+    slices.SortFunc(report.StatsFixed, func(a, b statsDiscrepancy) int { return strings.Compare(a.ProductID, b.ProductID) })
+
+    if stale, generation, loaded := s.listCache.get(); loaded {
+        reviews, err := s.loadListing(ctx)
+        if err != nil {
+            respondWithError(w, http.StatusInternalServerError, "internal_error", "Failed to recalculate the review listing")
+            return
+        }
+        if !reflect.DeepEqual(stale, reviews) {
+            logger.Warn("fixed stale cached review listing", "request_id", requestID, "cached", len(stale), "stored", len(reviews))
+            report.ListCacheFixed = true
+            s.listCache.set(reviews, generation)
+        }
+    }
+    respondWithJSON(w, http.StatusOK, report)
+}
+
+// statsDifferences returns the JSON names of the figures that differ between two stats
+func statsDifferences(a, b *ReviewStats) []string {
+    var fields []string
+    if a.Count != b.Count {
+        fields = append(fields, "count")
+    }
+    if a.Average != b.Average {
+        fields = append(fields, "average")
+    }
+    if !maps.Equal(a.Breakdown, b.Breakdown) {
+        fields = append(fields, "breakdown")
+    }
+    if a.UniqueReviewers != b.UniqueReviewers {
+        fields = append(fields, "uniqueReviewers")
+    }
+    if a.Pending != b.Pending {
+        fields = append(fields, "pending")
+    }
+    return fields
+}
+
+// readOnlyHandler reports whether the API is in read-only mode and lets admins switch it on or off
+func (s *Server) readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut:
+        if !s.isAdmin(r) {
+            respondWithError(w, http.StatusForbidden, "forbidden", "Only admins may change read-only mode")
+            return
+        }
+
+        var requestData struct {
+            ReadOnly *bool `json:"readOnly"`
+        }
+        if status, err := decodeJSONBody(w, r, &requestData); err != nil {
+            respondWithError(w, status, errorCode(err, "invalid_request"), err.Error())
+            return
+        }
+        if requestData.ReadOnly == nil {
+            respondWithError(w, http.StatusBadRequest, "invalid_read_only", "readOnly must be true or false")
+            return
+        }
+
+        s.readOnly.Store(*requestData.ReadOnly)
+        logger.Info("read-only mode changed", "request_id", requestIDFromContext(r.Context()), "read_only", *requestData.ReadOnly)
+    default:
+        respondMethodNotAllowed(w, "GET, PUT")
+        return
+    }
+
+    respondWithJSON(w, http.StatusOK, map[string]bool{"readOnly": s.readOnly.Load()})
+}
+
+// healthzHandler reports that the process is up
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+    respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the database is reachable
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+    ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+    defer cancel()
+
+    if err := s.store.Ping(ctx); err != nil {
+        logger.Error("readiness check failed", "request_id", requestIDFromContext(r.Context()), "error", err.Error())
+        respondWithError(w, http.StatusServiceUnavailable, "database_unavailable", "Database unavailable")
+        return
+    }
+    respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// decodeJSONBody decodes a size-limited JSON request body into dst, rejecting
+// unknown fields, and returns the HTTP status to respond with when decoding fails
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) (int, error) {
+    return decodeJSONBodyWithLimit(w, r, dst, maxBodyBytes)
+}
+
+// decodeJSONBodyWithLimit is decodeJSONBody with a caller-chosen size limit
+func decodeJSONBodyWithLimit(w http.ResponseWriter, r *http.Request, dst interface{}, limit int64) (int, error) {
+    r.Body = http.MaxBytesReader(w, r.Body, limit)
+    return decodeJSON(r.Body, dst, limit)
+}
+
+// decodeJSON decodes a JSON value read from body into dst, rejecting fields dst does not have;
+// limit is the size the body was capped at, quoted when it was exceeded
+func decodeJSON(body io.Reader, dst interface{}, limit int64) (int, error) {
+    dec := json.NewDecoder(body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(dst); err != nil {
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            return http.StatusRequestEntityTooLarge, &codedError{"body_too_large", fmt.Sprintf("Request body too large. Must not exceed %d bytes.", limit)}
+        }
+        // Custom unmarshalers such as flexibleRating report their own coded errors
+        var coded *codedError
+        if errors.As(err, &coded) {
+            return http.StatusBadRequest, coded
+        }
+        // The decoder reports unknown fields as `json: unknown field "name"`
+        if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+            return http.StatusBadRequest, &codedError{"unknown_field", fmt.Sprintf("Invalid request payload: unexpected field %s", field)}
+        }
+        return http.StatusBadRequest, &codedError{"invalid_json", "Invalid request payload"}
+    }
+    return http.StatusOK, nil
+}
+
+// notFoundHandler answers requests for paths that match no endpoint
+func (s *Server) notFoundHandler(w http.ResponseWriter, r *http.Request) {
+    respondWithError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No endpoint at %s", r.URL.Path))
+}
+
+// staticHandler serves the frontend files in dir to GET and HEAD requests for paths no endpoint
+// matches, answering anything else like notFoundHandler. http.Dir refuses paths leaving dir,
+// dotfiles such as .env or .git are never served and directories without an index.html are not
+// listed.
+func (s *Server) staticHandler(dir string) http.HandlerFunc {
+    root := http.Dir(dir)
+    files := http.FileServer(root)
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            s.notFoundHandler(w, r)
+            return
+        }
+        for _, segment := range strings.Split(r.URL.Path, "/") {
+            if strings.HasPrefix(segment, ".") {
+                s.notFoundHandler(w, r)
+                return
+            }
+        }
+        if !hasStaticFile(root, r.URL.Path) {
+            s.notFoundHandler(w, r)
+            return
+        }
+        files.ServeHTTP(w, r)
+    }
+}
+
+// hasStaticFile reports whether name is a file in root or a directory with an index.html
+func hasStaticFile(root http.FileSystem, name string) bool {
+    f, err := root.Open(name)
+    if err != nil {
+        return false
+    }
+    info, err := f.Stat()
+    f.Close()
+    if err != nil {
+        return false
+    }
+    if info.IsDir() {
+        return hasStaticFile(root, path.Join(name, "index.html"))
+    }
+    return true
+}
+
+// errorBody is the shape of every error response, wrapped as {"error": errorBody}
+type errorBody struct {
+    Code      string `json:"code"`                 // Machine-readable error code
+    Message   string `json:"message"`              // Human-readable description
+    Status    int    `json:"status"`               // HTTP status code of the response
+    Index     *int   `json:"index,omitempty"`      // Position of the offending entry in a batch request
+    RequestID string `json:"request_id,omitempty"` // ID to quote when reporting the error
+}
+
+// codedError is an error carrying the machine-readable code to report it with
+type codedError struct {
+    code    string
+    message string
+}
+
+// Error returns the human-readable message
+func (e *codedError) Error() string {
+    return e.message
+}
+
+// errorCode returns the code carried by err, or fallback when it carries none
+func errorCode(err error, fallback string) string {
+    var coded *codedError
+    if errors.As(err, &coded) {
+        return coded.code
+    }
+    return fallback
+}
+
+// respondWithError writes a JSON error envelope with the given status, code and message,
+// including the request ID already set on the response by withRequestID
+func respondWithError(w http.ResponseWriter, status int, code, message string) {
+    respondWithJSON(w, status, map[string]errorBody{"error": {Code: code, Message: message, Status: status, RequestID: w.Header().Get("X-Request-ID")}})
+}
+
+// respondWithErrorAt is respondWithError for the entry at index of a batch request
+func respondWithErrorAt(w http.ResponseWriter, status int, code, message string, index int) {
+    respondWithJSON(w, status, map[string]errorBody{"error": {Code: code, Message: message, Status: status, Index: &index, RequestID: w.Header().Get("X-Request-ID")}})
+}
+
+// respondMethodNotAllowed writes a JSON 405 response with the Allow header set to the supported methods
+func respondMethodNotAllowed(w http.ResponseWriter, allowed string) {
+    w.Header().Set("Allow", allowed)
+    respondWithError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// marshalResponse encodes a response payload as JSON, indented when withPretty marked w
+func marshalResponse(w http.ResponseWriter, payload interface{}) ([]byte, error) {
+    if _, pretty := w.(prettyResponseWriter); pretty {
+        return json.MarshalIndent(payload, "", "  ")
+    }
+    return json.Marshal(payload)
+}
+
+// respondWithJSON writes a JSON response to the ResponseWriter
+func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
+    response, err := marshalResponse(w, payload)
+    if err != nil {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusInternalServerError)
+        w.Write([]byte(`{"error":{"code":"internal_error","message":"Failed to marshal JSON response","status":500}}`))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(response)
+}
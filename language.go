@@ -0,0 +1,25 @@
+package main
+
+import (
+    "regexp"
+
+    "github.com/abadojack/whatlanggo"
+)
+
+// languageCodePattern matches the ISO 639-1 or 639-3 codes reviews are tagged with
+var languageCodePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// minLanguageConfidence is the detector confidence below which a review is left untagged. The
+// library's own reliability threshold rejects most sentence-length reviews, while guesses on a
+// few words are often wrong, so this sits in between.
+const minLanguageConfidence = 0.4
+
+// detectLanguage returns the ISO 639-1 code of the language text is written in, or "" when the
+// text is too short or ambiguous for a confident guess
+func detectLanguage(text string) string {
+    info := whatlanggo.Detect(text)
+    if info.Confidence < minLanguageConfidence {
+        return ""
+    }
+    return info.Lang.Iso6391()
+}
@@ -1,243 +1,543 @@
 package main
 
 import (
+    "context"
+    "crypto/tls"
     "database/sql"
-    "encoding/json"
+    "errors"
     "fmt"
     "log"
+    "log/slog"
     "net/http"
-    "sync"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "slices"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
 
     _ "github.com/mattn/go-sqlite3"
+    "golang.org/x/time/rate"
 )
 
-// Review represents a review submitted by a user
-type Review struct {
-    ID     int    `json:"id"`
-    Name   string `json:"name"`
-    Review string `json:"review"`
-    Rating int    `json:"rating"` // New field to store the rating
-}
+// Defaults used when the corresponding environment variables are unset
+const (
+    defaultDBDriver = "sqlite"
+    defaultDBPath   = "./reviews.db"
+    defaultPort     = "8080"
+)
+
+// Connection pool settings. In WAL mode readers proceed concurrently with the
+// single writer, so the pool allows several connections; keeping idle
+// connections equal to open connections avoids reopening the file on every
+// request, and recycling them periodically releases any memory held by
+// long-lived connections.
+const (
+    maxOpenConns    = 8
+    maxIdleConns    = 8
+    connMaxLifetime = 30 * time.Minute
+)
+
+// busyTimeoutMillis is how long SQLite waits on a locked database before
+// returning "database is locked"; it is what serializes concurrent writers
+const busyTimeoutMillis = 5000
+
+// Default rate limit for review submissions per client IP, overridable through
+// REVIEWX_RATE_LIMIT (requests per minute) and REVIEWX_RATE_BURST
+const (
+    defaultRateLimitPerMinute = 10
+    defaultRateBurst          = 5
+)
+
+// Idle clients are dropped from the rate limiter so its map cannot grow without bound
+const (
+    rateLimiterCleanupInterval = time.Minute
+    rateLimiterMaxIdle         = 3 * time.Minute
+)
+
+// defaultDuplicateWindow is how far back identical submissions are rejected,
+// overridable through REVIEWX_DUPLICATE_WINDOW; a zero window disables the check
+const defaultDuplicateWindow = 10 * time.Minute
+
+// defaultMaxRating is the highest star rating accepted, overridable through REVIEWX_MAX_RATING
+const defaultMaxRating = 5
+
+// defaultStatsCacheTTL is how long /stats results are cached, overridable through
+// REVIEWX_STATS_CACHE_TTL; a zero TTL disables the cache
+const defaultStatsCacheTTL = 30 * time.Second
+
+// defaultRatingHalfLife is the age at which a review counts half in the weighted average of
+// /stats?weighted=true, overridable through REVIEWX_RATING_HALF_LIFE
+const defaultRatingHalfLife = 30 * 24 * time.Hour
+
+// defaultIdempotencyWindow is how long Idempotency-Key values are remembered, overridable through
+// REVIEWX_IDEMPOTENCY_WINDOW; a zero window disables idempotency keys
+const defaultIdempotencyWindow = 24 * time.Hour
 
-// Database connection
-var db *sql.DB
-var mutex = &sync.Mutex{}
-var idCounter = 0
+// defaultHoneypotField is the hidden review field that marks a submission as spam when filled in,
+// overridable through REVIEWX_HONEYPOT_FIELD
+const defaultHoneypotField = "website"
+
+// Defaults for the periodic backups enabled by REVIEWX_BACKUP_DIR, overridable through
+// REVIEWX_BACKUP_INTERVAL and REVIEWX_BACKUP_KEEP
+const (
+    defaultBackupInterval = 24 * time.Hour
+    defaultBackupKeep     = 7
+)
+
+// helpfulVoteWindow is how long a client must wait before marking the same review as helpful again
+const helpfulVoteWindow = 24 * time.Hour
+
+// flagVoteWindow is how long a client must wait before flagging the same review again
+const flagVoteWindow = 24 * time.Hour
+
+// defaultFlagThreshold is how many flags hide a review until an admin approves it again,
+// overridable through REVIEWX_FLAG_THRESHOLD; a zero threshold never hides reviews
+const defaultFlagThreshold = 3
+
+// Default server timeouts, overridable through REVIEWX_READ_HEADER_TIMEOUT, REVIEWX_READ_TIMEOUT,
+// REVIEWX_WRITE_TIMEOUT and REVIEWX_IDLE_TIMEOUT; they stop slow clients from holding connections
+// open indefinitely, and a zero value disables the corresponding timeout
+const (
+    defaultReadHeaderTimeout = 5 * time.Second
+    defaultReadTimeout       = 15 * time.Second
+    defaultWriteTimeout      = 30 * time.Second
+    defaultIdleTimeout       = 2 * time.Minute
+)
+
+// defaultRequestTimeout is how long a request may take before it is answered with a 503,
+// overridable through REVIEWX_REQUEST_TIMEOUT; it stays below defaultWriteTimeout so the error
+// can still be written, and a zero value disables it
+const defaultRequestTimeout = 20 * time.Second
+
+// Defaults for REVIEWX_LOG_LEVEL and REVIEWX_LOG_FORMAT
+const (
+    defaultLogLevel  = "info"
+    defaultLogFormat = "json"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take to finish on shutdown
+const shutdownTimeout = 10 * time.Second
 
 func main() {
-    var err error
-    // Open SQLite database
-    db, err = sql.Open("sqlite3", "./reviews.db")
+    // Configure logging first so every later message honors it; messages of the standard log
+    // package, such as those of net/http, are routed through the same logger
+    configured, err := newLogger(os.Stdout, getEnv("REVIEWX_LOG_LEVEL", defaultLogLevel), getEnv("REVIEWX_LOG_FORMAT", defaultLogFormat))
     if err != nil {
-        log.Fatalf("Failed to connect to database: %v", err)
+        log.Fatalf("Invalid logging configuration: %v", err)
+    }
+    logger = configured
+    slog.SetDefault(logger)
+
+    // Read configuration from the environment
+    dbPath := getEnv("REVIEWX_DB_PATH", defaultDBPath)
+    port := getEnv("REVIEWX_PORT", defaultPort)
+    if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+        fatalf("Invalid REVIEWX_PORT value %q: must be a number between 1 and 65535", port)
+    }
+    infof("Using database %s and port %s", dbPath, port)
+
+    var tenants []string
+    if value := os.Getenv("REVIEWX_TENANTS"); value != "" {
+        for _, name := range strings.Split(value, ",") {
+            name = strings.TrimSpace(name)
+            if !tenantNamePattern.MatchString(name) || slices.Contains(tenants, name) {
+                fatalf("Invalid REVIEWX_TENANTS value %q: must be distinct names of lower-case letters, digits, - and _", value)
+            }
+            tenants = append(tenants, name)
+        }
+        infof("Serving tenants %s under /t/{tenant}/ or the %s header, each in its own database", strings.Join(tenants, ", "), tenantHeader)
     }
-    defer db.Close()
 
-    // Initialize the database schema
-    if err := initializeDatabase(); err != nil {
-        log.Fatalf("Failed to initialize database: %v", err)
+    ratePerMinute := getEnvInt("REVIEWX_RATE_LIMIT", defaultRateLimitPerMinute)
+    rateBurst := getEnvInt("REVIEWX_RATE_BURST", defaultRateBurst)
+    infof("Limiting review submissions to %d per minute with a burst of %d", ratePerMinute, rateBurst)
+
+    cors := parseCORSOrigins(os.Getenv("REVIEWX_CORS_ORIGINS"))
+    switch {
+    case cors.allowAll:
+        infof("Allowing cross-origin requests from any origin")
+    case len(cors.origins) > 0:
+        infof("Allowing cross-origin requests from %s", os.Getenv("REVIEWX_CORS_ORIGINS"))
+    default:
+        infof("Cross-origin requests disabled; set REVIEWX_CORS_ORIGINS to allow them")
     }
 
-    // Load the highest ID from the database
-    loadIDCounter()
+    duplicateWindow := getEnvDuration("REVIEWX_DUPLICATE_WINDOW", defaultDuplicateWindow)
+    if duplicateWindow > 0 {
+        infof("Rejecting duplicate reviews submitted within %s", duplicateWindow)
+    } else {
+        infof("Duplicate review detection disabled")
+    }
 
-    http.HandleFunc("/reviews", withCORS(reviewsHandler))
-    http.HandleFunc("/delete-review", withCORS(deleteReviewHandler)) // Handler for deleting a review
+    idempotencyWindow := getEnvDuration("REVIEWX_IDEMPOTENCY_WINDOW", defaultIdempotencyWindow)
+    if idempotencyWindow > 0 {
+        infof("Remembering Idempotency-Key values for %s", idempotencyWindow)
+    } else {
+        infof("Idempotency keys disabled")
+    }
 
-    fmt.Println("Server is listening on port 8080...")
-    log.Fatal(http.ListenAndServe(":8080", nil))
-}
+    apiKey := os.Getenv("REVIEWX_API_KEY")
+    if apiKey != "" {
+        infof("Requiring an API key for POST, PUT, PATCH and DELETE requests")
+    } else {
+        infof("API key authentication disabled; set REVIEWX_API_KEY to require one for writes")
+    }
 
-// withCORS is a middleware function that adds CORS headers
-func withCORS(next http.HandlerFunc) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-        
-        // Handle preflight OPTIONS request
-        if r.Method == http.MethodOptions {
-            return
-        }
-        
-        next(w, r)
+    jwtSecret := os.Getenv("REVIEWX_JWT_SECRET")
+    if jwtSecret != "" {
+        infof("Requiring a user token for POST, PUT, PATCH and DELETE requests; API keys must be sent in X-API-Key")
+    } else {
+        infof("User authentication disabled; set REVIEWX_JWT_SECRET to tie reviews to their authors")
     }
-}
 
-// initializeDatabase creates the reviews table if it does not exist
-func initializeDatabase() error {
-    schema := `
-    CREATE TABLE IF NOT EXISTS reviews (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        name TEXT,
-        review TEXT,
-        rating INTEGER
-    );
-    `
-    _, err := db.Exec(schema)
-    return err
-}
+    tlsCert, tlsKey := os.Getenv("REVIEWX_TLS_CERT"), os.Getenv("REVIEWX_TLS_KEY")
+    switch {
+    case tlsCert != "" && tlsKey != "":
+        infof("Serving HTTPS with certificate %s", tlsCert)
+    case tlsCert != "" || tlsKey != "":
+        fatalf("REVIEWX_TLS_CERT and REVIEWX_TLS_KEY must be set together")
+    default:
+        infof("Serving plain HTTP; set REVIEWX_TLS_CERT and REVIEWX_TLS_KEY to serve HTTPS")
+    }
 
-// loadIDCounter retrieves the highest ID from the database to set the counter
-func loadIDCounter() {
-    row := db.QueryRow("SELECT MAX(id) FROM reviews")
-    var maxID sql.NullInt64
-    if err := row.Scan(&maxID); err != nil {
-        log.Fatalf("Failed to load highest review ID: %v", err)
+    readOnly := getEnvBool("REVIEWX_READONLY", false)
+    if readOnly {
+        infof("Starting in read-only mode; writes are rejected until an admin turns it off at /admin/read-only")
     }
-    if maxID.Valid {
-        idCounter = int(maxID.Int64)
+
+    honeypotField := getEnv("REVIEWX_HONEYPOT_FIELD", defaultHoneypotField)
+    if isReviewField(honeypotField) {
+        fatalf("Invalid REVIEWX_HONEYPOT_FIELD value %q: must not be the name of a review field", honeypotField)
     }
-}
+    infof("Discarding reviews that fill in the hidden %s field", honeypotField)
 
-// saveReview inserts a new review into the database
-func saveReview(review *Review) error {
-    _, err := db.Exec("INSERT INTO reviews (name, review, rating) VALUES (?, ?, ?)", review.Name, review.Review, review.Rating)
-    return err
-}
+    listLimit := getEnvInt("REVIEWX_DEFAULT_LIMIT", defaultLimit)
+    if listLimit > maxLimit {
+        fatalf("Invalid REVIEWX_DEFAULT_LIMIT value %d: must be at most %d", listLimit, maxLimit)
+    }
+    listSort := os.Getenv("REVIEWX_DEFAULT_SORT")
+    if _, ok := sortOrders[listSort]; listSort != "" && !ok {
+        fatalf("Invalid REVIEWX_DEFAULT_SORT value %q: must be one of %s", listSort, strings.Join(sortNames(), ", "))
+    }
+    infof("Listing %d reviews per page by default, sorted by %s", listLimit, getEnv("REVIEWX_DEFAULT_SORT", "id"))
+
+    maxRating := getEnvInt("REVIEWX_MAX_RATING", defaultMaxRating)
+    ratingOptional := getEnvBool("REVIEWX_RATING_OPTIONAL", false)
+    if ratingOptional {
+        infof("Accepting ratings from 1 to %d, or none for text-only reviews", maxRating)
+    } else {
+        infof("Accepting ratings from 1 to %d", maxRating)
+    }
 
-// deleteReview removes a review by ID from the database and returns an error if no review is found
-func deleteReview(id int) error {
-    result, err := db.Exec("DELETE FROM reviews WHERE id = ?", id)
-    if err != nil {
-        return err
+    minReviewLength := getEnvNonNegativeInt("REVIEWX_MIN_REVIEW_LEN", 0)
+    if minReviewLength > maxReviewLength {
+        fatalf("Invalid REVIEWX_MIN_REVIEW_LEN value %d: must be at most %d", minReviewLength, maxReviewLength)
+    }
+    if minReviewLength > 0 {
+        infof("Rejecting reviews shorter than %d characters", minReviewLength)
     }
 
-    // Check how many rows were affected
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        return err
+    flagThreshold := getEnvNonNegativeInt("REVIEWX_FLAG_THRESHOLD", defaultFlagThreshold)
+    if flagThreshold > 0 {
+        infof("Hiding reviews flagged %d times until they are approved again", flagThreshold)
+    } else {
+        infof("Flagged reviews are never hidden automatically")
     }
 
-    if rowsAffected == 0 {
-        return fmt.Errorf("no review found with id %d", id)
+    statsTTL := getEnvDuration("REVIEWX_STATS_CACHE_TTL", defaultStatsCacheTTL)
+    if statsTTL > 0 {
+        infof("Caching statistics for %s", statsTTL)
+    } else {
+        infof("Statistics caching disabled")
     }
 
-    return nil
-}
+    ratingHalfLife := getEnvDuration("REVIEWX_RATING_HALF_LIFE", defaultRatingHalfLife)
+    if ratingHalfLife == 0 {
+        fatalf("Invalid REVIEWX_RATING_HALF_LIFE value %q: must be a positive duration", os.Getenv("REVIEWX_RATING_HALF_LIFE"))
+    }
+    infof("Halving the weight of reviews in weighted averages every %s", ratingHalfLife)
+
+    listCache := getEnvBool("REVIEWX_LIST_CACHE", false)
+    if listCache {
+        infof("Caching the public review listing in memory")
+    }
 
-// loadReviews retrieves all reviews from the database
-func loadReviews() ([]Review, error) {
-    rows, err := db.Query("SELECT id, name, review, rating FROM reviews")
+    var webhookURLs []string
+    for _, u := range strings.Split(os.Getenv("REVIEWX_WEBHOOK_URLS"), ",") {
+        if u = strings.TrimSpace(u); u != "" {
+            webhookURLs = append(webhookURLs, u)
+        }
+    }
+    webhooks, err := newWebhookNotifier(webhookURLs, os.Getenv("REVIEWX_WEBHOOK_SECRET"))
     if err != nil {
-        return nil, err
+        fatalf("Invalid REVIEWX_WEBHOOK_URLS value: %v", err)
+    }
+    if webhooks != nil {
+        infof("Notifying %d webhooks of new reviews", len(webhookURLs))
     }
-    defer rows.Close()
 
-    var reviews []Review
-    for rows.Next() {
-        var review Review
-        if err := rows.Scan(&review.ID, &review.Name, &review.Review, &review.Rating); err != nil {
-            return nil, err
+    staticDir := os.Getenv("REVIEWX_STATIC_DIR")
+    if staticDir != "" {
+        if info, err := os.Stat(staticDir); err != nil || !info.IsDir() {
+            fatalf("Invalid REVIEWX_STATIC_DIR value %q: must be an existing directory", staticDir)
         }
-        reviews = append(reviews, review)
+        infof("Serving frontend files from %s", staticDir)
     }
-    return reviews, nil
-}
 
-// reviewsHandler handles both POST and GET requests for reviews
-func reviewsHandler(w http.ResponseWriter, r *http.Request) {
-    switch r.Method {
-    case http.MethodPost:
-        handlePostReview(w, r)
-    case http.MethodGet:
-        handleGetReviews(w, r)
-    default:
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    backupDir := os.Getenv("REVIEWX_BACKUP_DIR")
+    backupInterval := getEnvDuration("REVIEWX_BACKUP_INTERVAL", defaultBackupInterval)
+    backupKeep := getEnvInt("REVIEWX_BACKUP_KEEP", defaultBackupKeep)
+    if backupDir != "" {
+        if backupInterval == 0 {
+            fatalf("Invalid REVIEWX_BACKUP_INTERVAL value %q: must be a positive duration", os.Getenv("REVIEWX_BACKUP_INTERVAL"))
+        }
+        infof("Backing up the database to %s every %s, keeping the last %d backups", backupDir, backupInterval, backupKeep)
+    } else {
+        infof("Database backups disabled; set REVIEWX_BACKUP_DIR to enable them")
     }
-}
 
-// handlePostReview handles the submission of a new review
-func handlePostReview(w http.ResponseWriter, r *http.Request) {
-    // Parse the JSON request body
-    var newReview Review
-    if err := json.NewDecoder(r.Body).Decode(&newReview); err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
-        return
+    readHeaderTimeout := getEnvDuration("REVIEWX_READ_HEADER_TIMEOUT", defaultReadHeaderTimeout)
+    readTimeout := getEnvDuration("REVIEWX_READ_TIMEOUT", defaultReadTimeout)
+    writeTimeout := getEnvDuration("REVIEWX_WRITE_TIMEOUT", defaultWriteTimeout)
+    idleTimeout := getEnvDuration("REVIEWX_IDLE_TIMEOUT", defaultIdleTimeout)
+    requestTimeout := getEnvDuration("REVIEWX_REQUEST_TIMEOUT", defaultRequestTimeout)
+    infof("Timing out reading headers after %s, reading requests after %s, writing responses after %s and idle connections after %s", readHeaderTimeout, readTimeout, writeTimeout, idleTimeout)
+    if requestTimeout > 0 {
+        infof("Aborting requests that take longer than %s", requestTimeout)
     }
 
-    // Validate the rating value
-    if newReview.Rating < 1 || newReview.Rating > 5 {
-        http.Error(w, "Invalid rating value. Must be between 1 and 5.", http.StatusBadRequest)
-        return
+    var profanity *profanityFilter
+    if path := os.Getenv("REVIEWX_BLOCKLIST_PATH"); path != "" {
+        mode := getEnv("REVIEWX_PROFANITY_MODE", profanityReject)
+        if mode != profanityReject && mode != profanityMask {
+            fatalf("Invalid REVIEWX_PROFANITY_MODE value %q: must be %s or %s", mode, profanityReject, profanityMask)
+        }
+        words, err := loadBlocklist(path)
+        if err != nil {
+            fatalf("Failed to load blocklist: %v", err)
+        }
+        profanity = newProfanityFilter(words, mode)
+        infof("Filtering %d blocked words from reviews (%s mode)", len(words), mode)
     }
 
-    // Lock the mutex before modifying the database
-    mutex.Lock()
-    defer mutex.Unlock()
+    // Open and initialize the storage backend, and one more per tenant
+    driver := getEnv("REVIEWX_DB_DRIVER", defaultDBDriver)
+    store, err := openStore(driver, dbPath, duplicateWindow)
+    if err != nil {
+        fatalf("Failed to open database: %v", err)
+    }
+    defer store.Close()
+    tenantStores := make(map[string]ReviewStore, len(tenants))
+    for _, name := range tenants {
+        tenantStore, err := openStore(driver, tenantDBPath(dbPath, name), duplicateWindow)
+        if err != nil {
+            fatalf("Failed to open database of tenant %s: %v", name, err)
+        }
+        defer tenantStore.Close()
+        tenantStores[name] = tenantStore
+    }
+
+    cfg := Config{
+        RateLimit:         rate.Limit(float64(ratePerMinute) / 60),
+        RateBurst:         rateBurst,
+        CORS:              cors,
+        APIKey:            apiKey,
+        JWTSecret:         jwtSecret,
+        Profanity:         profanity,
+        MaxRating:         maxRating,
+        StatsTTL:          statsTTL,
+        IdempotencyWindow: idempotencyWindow,
+        ReadOnly:          readOnly,
+        HoneypotField:     honeypotField,
+        DefaultLimit:      listLimit,
+        DefaultSort:       listSort,
+        RatingHalfLife:    ratingHalfLife,
+        ListCache:         listCache,
+        StaticDir:         staticDir,
+        RatingOptional:    ratingOptional,
+        Webhooks:          webhooks,
+        RequestTimeout:    requestTimeout,
+        MinReviewLength:   minReviewLength,
+        FlagThreshold:     flagThreshold,
+    }
+    server := NewServer(store, cfg)
+    servers := []*Server{server}
+    tenantHandlers := make(map[string]http.Handler, len(tenants))
+    for name, tenantStore := range tenantStores {
+        tenantServer := NewServer(tenantStore, cfg)
+        servers = append(servers, tenantServer)
+        tenantHandlers[name] = tenantServer
+    }
 
-    // Assign a unique ID to the new review
-    idCounter++
-    newReview.ID = idCounter
+    // Stop accepting requests on SIGINT or SIGTERM
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
 
-    // Save the review to the database
-    if err := saveReview(&newReview); err != nil {
-        http.Error(w, "Failed to save review", http.StatusInternalServerError)
-        return
+    for _, s := range servers {
+        go s.postLimiter.cleanupLoop(ctx, rateLimiterCleanupInterval, rateLimiterMaxIdle)
+        go s.helpfulVotes.cleanupLoop(ctx, rateLimiterCleanupInterval)
+        go s.flagVotes.cleanupLoop(ctx, rateLimiterCleanupInterval)
+    }
+    if backupDir != "" {
+        go backupLoop(ctx, store, backupDir, backupInterval, backupKeep)
+        // Each tenant's backups go to a subdirectory so pruning never mixes them up
+        for name, tenantStore := range tenantStores {
+            go backupLoop(ctx, tenantStore, filepath.Join(backupDir, name), backupInterval, backupKeep)
+        }
     }
 
-    // Respond with success and the assigned ID
-    response := map[string]interface{}{"success": true, "id": newReview.ID}
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
-}
+    srv := &http.Server{
+        Addr:              ":" + port,
+        Handler:           withRequestID(withLogging(withGzip(newTenantRouter(server, tenantHandlers)))),
+        TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+        ReadHeaderTimeout: readHeaderTimeout,
+        ReadTimeout:       readTimeout,
+        WriteTimeout:      writeTimeout,
+        IdleTimeout:       idleTimeout,
+    }
+    go func() {
+        infof("Server is listening on port %s", port)
+        var err error
+        if tlsCert != "" {
+            err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+        } else {
+            err = srv.ListenAndServe()
+        }
+        if err != nil && !errors.Is(err, http.ErrServerClosed) {
+            fatalf("Server failed: %v", err)
+        }
+    }()
 
-// handleGetReviews handles fetching all submitted reviews
-func handleGetReviews(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
+    <-ctx.Done()
+    infof("Shutting down server")
 
-    // Lock the mutex before reading the database
-    mutex.Lock()
-    defer mutex.Unlock()
+    // Give in-flight requests a chance to complete before the database is closed
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+    if err := srv.Shutdown(shutdownCtx); err != nil {
+        logger.Error("graceful shutdown failed", "error", err.Error())
+    }
+    webhooks.wait()
+}
 
-    reviews, err := loadReviews()
+// openStore opens the ReviewStore of the given driver on the database at path
+func openStore(driver, path string, duplicateWindow time.Duration) (ReviewStore, error) {
+    switch driver {
+    case "sqlite":
+        db, err := openDatabase(sqliteDSN(path))
+        if err != nil {
+            return nil, err
+        }
+        return newSQLiteStore(db, duplicateWindow), nil
+    default:
+        return nil, fmt.Errorf("unsupported REVIEWX_DB_DRIVER value %q: must be sqlite", driver)
+    }
+}
+
+// openDatabase opens the SQLite database, configures its connection pool and initializes the schema
+func openDatabase(dataSourceName string) (*sql.DB, error) {
+    conn, err := sql.Open("sqlite3", dataSourceName)
     if err != nil {
-        http.Error(w, "Failed to load reviews", http.StatusInternalServerError)
-        return
+        return nil, err
     }
 
-    json.NewEncoder(w).Encode(reviews)
+    // Configure the connection pool
+    conn.SetMaxOpenConns(maxOpenConns)
+    conn.SetMaxIdleConns(maxIdleConns)
+    conn.SetConnMaxLifetime(connMaxLifetime)
+
+    // Initialize the database schema
+    if err := initializeDatabase(conn); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return conn, nil
+}
+
+// infof logs a startup or shutdown message at info level
+func infof(format string, args ...interface{}) {
+    logger.Info(fmt.Sprintf(format, args...))
+}
+
+// fatalf logs a configuration or startup failure at error level and exits
+func fatalf(format string, args ...interface{}) {
+    logger.Error(fmt.Sprintf(format, args...))
+    os.Exit(1)
 }
 
-// deleteReviewHandler handles the deletion of a review by ID
-func deleteReviewHandler(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodDelete {
-        respondWithJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"})
-        return
+// getEnv returns the value of an environment variable or def when it is unset or empty
+func getEnv(key, def string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
     }
+    return def
+}
 
-    // Parse the JSON request body to get the ID of the review to delete
-    var requestData struct {
-        ID int `json:"id"`
+// getEnvInt returns the positive integer value of an environment variable or def when it is unset
+func getEnvInt(key string, def int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
     }
-    if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-        respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
-        return
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 1 {
+        fatalf("Invalid %s value %q: must be a positive integer", key, value)
     }
+    return n
+}
 
-    // Lock the mutex before modifying the database
-    mutex.Lock()
-    defer mutex.Unlock()
-
-    // Remove the review from the database
-    if err := deleteReview(requestData.ID); err != nil {
-        respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Failed to delete review: %v", err)})
-        return
+// getEnvNonNegativeInt returns the integer value of an environment variable or def when it is
+// unset; unlike getEnvInt it accepts zero, which such settings use to turn a feature off
+func getEnvNonNegativeInt(key string, def int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
     }
-
-    // Respond with success
-    respondWithJSON(w, http.StatusOK, map[string]bool{"success": true})
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+        fatalf("Invalid %s value %q: must be a non-negative integer", key, value)
+    }
+    return n
 }
 
-// respondWithJSON writes a JSON response to the ResponseWriter
-func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
-    response, err := json.Marshal(payload)
+// getEnvBool returns the boolean value of an environment variable or def when it is unset
+func getEnvBool(key string, def bool) bool {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    b, err := strconv.ParseBool(value)
     if err != nil {
-        http.Error(w, "Failed to marshal JSON response", http.StatusInternalServerError)
-        return
+        fatalf("Invalid %s value %q: must be true or false", key, value)
     }
+    return b
+}
+
+// getEnvDuration returns the non-negative duration value of an environment variable or def when it is unset
+func getEnvDuration(key string, def time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d < 0 {
+        fatalf("Invalid %s value %q: must be a non-negative duration such as 10m", key, value)
+    }
+    return d
+}
 
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(status)
-    w.Write(response)
+// sqliteDSN appends the connection options to the database path: WAL journaling
+// so reads do not block on writes, a busy timeout so writers wait for each other,
+// immediate transactions so a transaction that reads before writing takes the
+// write lock up front instead of failing when it tries to upgrade, and foreign key
+// enforcement so purging a review also removes its replies
+func sqliteDSN(path string) string {
+    separator := "?"
+    if strings.Contains(path, "?") {
+        separator = "&"
+    }
+    return fmt.Sprintf("%s%s_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate&_foreign_keys=on", path, separator, busyTimeoutMillis)
 }
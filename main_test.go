@@ -0,0 +1,3611 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/mattn/go-sqlite3"
+    "golang.org/x/time/rate"
+)
+
+// newTestServer starts the API against a fresh in-memory database
+func newTestServer(t *testing.T) *httptest.Server {
+    t.Helper()
+
+    return newTestServerWithConfig(t, Config{
+        RateLimit: rate.Inf,
+        RateBurst: 1,
+        CORS:      parseCORSOrigins("http://allowed.example"),
+    })
+}
+
+// newTestServerWithConfig starts the API with cfg against a fresh in-memory database
+func newTestServerWithConfig(t *testing.T, cfg Config) *httptest.Server {
+    t.Helper()
+
+    // Each test gets its own named in-memory database shared by the pool's connections
+    name := strings.ReplaceAll(t.Name(), "/", "_")
+    conn, err := openDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared&_foreign_keys=on", name))
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    server := NewServer(newSQLiteStore(conn, 0), cfg)
+
+    srv := httptest.NewServer(server)
+    t.Cleanup(func() {
+        srv.Close()
+        conn.Close()
+    })
+    return srv
+}
+
+// intPtr returns a pointer to n, for setting optional fields such as Review.Rating
+func intPtr(n int) *int {
+    return &n
+}
+
+// doRequest sends a request with an optional JSON body and returns the response
+func doRequest(t *testing.T, method, url string, body interface{}) *http.Response {
+    t.Helper()
+
+    var buf bytes.Buffer
+    if body != nil {
+        if err := json.NewEncoder(&buf).Encode(body); err != nil {
+            t.Fatalf("Failed to encode request body: %v", err)
+        }
+    }
+    req, err := http.NewRequest(method, url, &buf)
+    if err != nil {
+        t.Fatalf("Failed to build request: %v", err)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Request failed: %v", err)
+    }
+    t.Cleanup(func() { resp.Body.Close() })
+    return resp
+}
+
+// decodeBody decodes a JSON response body into dst
+func decodeBody(t *testing.T, resp *http.Response, dst interface{}) {
+    t.Helper()
+
+    if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+        t.Fatalf("Failed to decode response body: %v", err)
+    }
+}
+
+// createReview posts a valid review and returns the stored record
+func createReview(t *testing.T, srv *httptest.Server, name string, rating int) Review {
+    t.Helper()
+
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": name, "review": "Review by " + name, "rating": rating})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var review Review
+    decodeBody(t, resp, &review)
+    return review
+}
+
+func TestPostReviewValidatesRating(t *testing.T) {
+    srv := newTestServer(t)
+
+    tests := []struct {
+        rating int
+        want   int
+    }{
+        {0, http.StatusBadRequest},
+        {1, http.StatusCreated},
+        {5, http.StatusCreated},
+        {6, http.StatusBadRequest},
+        {-3, http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        body := map[string]interface{}{"product_id": "widget", "name": fmt.Sprintf("user%d", tt.rating), "review": "text", "rating": tt.rating}
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body)
+        if resp.StatusCode != tt.want {
+            t.Errorf("POST rating %d returned %d, want %d", tt.rating, resp.StatusCode, tt.want)
+        }
+    }
+}
+
+func TestRatingAsString(t *testing.T) {
+    srv := newTestServer(t)
+
+    tests := []struct {
+        rating     interface{}
+        wantStatus int
+        wantRating int
+    }{
+        {"5", http.StatusCreated, 5},
+        {" 4 ", http.StatusCreated, 4},
+        {3, http.StatusCreated, 3},
+        {"6", http.StatusBadRequest, 0},
+        {"five", http.StatusBadRequest, 0},
+        {4.5, http.StatusBadRequest, 0},
+        {true, http.StatusBadRequest, 0},
+    }
+    for i, tt := range tests {
+        body := map[string]interface{}{"product_id": "widget", "name": fmt.Sprintf("user%d", i), "review": "text", "rating": tt.rating}
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body)
+        if resp.StatusCode != tt.wantStatus {
+            t.Errorf("POST rating %#v returned %d, want %d", tt.rating, resp.StatusCode, tt.wantStatus)
+            continue
+        }
+        if tt.wantStatus != http.StatusCreated {
+            var envelope struct {
+                Error errorBody `json:"error"`
+            }
+            decodeBody(t, resp, &envelope)
+            if envelope.Error.Code != "invalid_rating" {
+                t.Errorf("POST rating %#v returned code %q, want %q", tt.rating, envelope.Error.Code, "invalid_rating")
+            }
+            continue
+        }
+        var review Review
+        decodeBody(t, resp, &review)
+        if review.Rating == nil || *review.Rating != tt.wantRating {
+            t.Errorf("POST rating %#v stored %s, want %d", tt.rating, formatRating(review.Rating), tt.wantRating)
+        }
+    }
+
+    review := createReview(t, srv, "patcher", 1)
+    resp := doRequest(t, http.MethodPatch, srv.URL+"/reviews", map[string]interface{}{"id": review.ID, "rating": "2"})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("PATCH rating \"2\" returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    decodeBody(t, resp, &review)
+    if review.Rating == nil || *review.Rating != 2 {
+        t.Errorf("PATCH rating \"2\" stored %s, want 2", formatRating(review.Rating))
+    }
+}
+
+func TestConfigurableMaxRating(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, MaxRating: 10})
+
+    var config struct {
+        MaxRating int `json:"maxRating"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/config", nil), &config)
+    if config.MaxRating != 10 {
+        t.Errorf("GET /config returned maxRating %d, want 10", config.MaxRating)
+    }
+
+    createReview(t, srv, "alice", 8)
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "bob", "review": "Too good", "rating": 11})
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST with rating 11 returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if len(stats.Breakdown) != 10 {
+        t.Errorf("GET /stats returned breakdown %v, want ratings 1 to 10", stats.Breakdown)
+    }
+}
+
+func TestOptionalRating(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, RatingOptional: true})
+
+    var config struct {
+        RatingRequired bool `json:"ratingRequired"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/config", nil), &config)
+    if config.RatingRequired {
+        t.Errorf("GET /config returned ratingRequired true, want false")
+    }
+
+    // Text-only reviews are stored with a null rating, but a rating that is given is still checked
+    for _, body := range []map[string]interface{}{
+        {"product_id": "widget", "name": "alice", "review": "No stars from me"},
+        {"product_id": "widget", "name": "bob", "review": "Explicitly unrated", "rating": nil},
+    } {
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body)
+        if resp.StatusCode != http.StatusCreated {
+            t.Fatalf("POST /reviews without a rating returned %d, want %d", resp.StatusCode, http.StatusCreated)
+        }
+        var review Review
+        decodeBody(t, resp, &review)
+        if review.Rating != nil {
+            t.Errorf("POST /reviews without a rating stored rating %d, want null", *review.Rating)
+        }
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "carol", "review": "Too good", "rating": 9}); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST with rating 9 returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+    rated := createReview(t, srv, "dave", 4)
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": rated.ID})
+
+    // Unrated reviews count as reviews but not towards the average or breakdown
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats?weighted=true", nil), &stats)
+    if stats.Count != 3 || stats.Average != 4 || stats.Breakdown[4] != 1 || stats.WeightedAverage == nil || *stats.WeightedAverage != 4 {
+        t.Errorf("GET /stats returned %+v, want 3 reviews averaging 4", stats)
+    }
+}
+
+func TestRatingRequiredByDefault(t *testing.T) {
+    srv := newTestServer(t)
+
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "alice", "review": "No stars from me"})
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST /reviews without a rating returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestWebhookNotifiesNewReviews(t *testing.T) {
+    var (
+        mu        sync.Mutex
+        attempts  int
+        delivered Review
+    )
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        // Fail the first attempt to exercise the retry
+        if attempts++; attempts == 1 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        body, _ := io.ReadAll(r.Body)
+        json.Unmarshal(body, &delivered)
+        mac := hmac.New(sha256.New, []byte("s3cret"))
+        mac.Write(body)
+        signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+        if r.Header.Get(webhookSignatureHeader) != signature {
+            t.Errorf("Webhook signature %q, want %q", r.Header.Get(webhookSignatureHeader), signature)
+        }
+    }))
+    defer receiver.Close()
+
+    webhooks, err := newWebhookNotifier([]string{receiver.URL}, "s3cret")
+    if err != nil {
+        t.Fatalf("Failed to create notifier: %v", err)
+    }
+    webhooks.backoff = time.Millisecond
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, Webhooks: webhooks})
+
+    review := createReview(t, srv, "alice", 4)
+    webhooks.wait()
+
+    mu.Lock()
+    defer mu.Unlock()
+    if attempts != 2 || delivered.ID != review.ID || delivered.Name != "alice" {
+        t.Errorf("Webhook received %+v after %d attempts, want review %d after 2", delivered, attempts, review.ID)
+    }
+
+    if _, err := newWebhookNotifier([]string{"ftp://example.com"}, ""); err == nil {
+        t.Errorf("newWebhookNotifier accepted an ftp URL")
+    }
+}
+
+func TestPostReviewIdempotencyKey(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, IdempotencyWindow: time.Hour})
+
+    post := func(key string) *http.Response {
+        body, _ := json.Marshal(map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Solid", "rating": 4})
+        req, err := http.NewRequest(http.MethodPost, srv.URL+"/reviews", bytes.NewReader(body))
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        req.Header.Set("Idempotency-Key", key)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        t.Cleanup(func() { resp.Body.Close() })
+        return resp
+    }
+
+    var first, retried, other Review
+    decodeBody(t, post("key-1"), &first)
+    resp := post("key-1")
+    if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "true" {
+        t.Errorf("Retry returned %d with Idempotent-Replayed %q, want %d and true", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), http.StatusCreated)
+    }
+    decodeBody(t, resp, &retried)
+    decodeBody(t, post("key-2"), &other)
+    if retried.ID != first.ID || other.ID == first.ID {
+        t.Errorf("Reviews saved with keys key-1, key-1, key-2 got ids %d, %d, %d; want the retry to reuse the first", first.ID, retried.ID, other.ID)
+    }
+
+    if resp := post("has space"); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST with an invalid Idempotency-Key returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestPostReviewRejectsInvalidPayload(t *testing.T) {
+    srv := newTestServer(t)
+
+    tests := []struct {
+        name string
+        body interface{}
+    }{
+        {"missing product", map[string]interface{}{"name": "alice", "review": "text", "rating": 3}},
+        {"empty name", map[string]interface{}{"product_id": "widget", "name": "  ", "review": "text", "rating": 3}},
+        {"empty review", map[string]interface{}{"product_id": "widget", "name": "alice", "review": "", "rating": 3}},
+        {"unknown field", map[string]interface{}{"product_id": "widget", "name": "alice", "review": "text", "rating": 3, "admin": true}},
+        {"invalid email", map[string]interface{}{"product_id": "widget", "name": "alice", "review": "text", "rating": 3, "email": "nope"}},
+    }
+    for _, tt := range tests {
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", tt.body)
+        if resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("%s: POST returned %d, want %d", tt.name, resp.StatusCode, http.StatusBadRequest)
+        }
+    }
+}
+
+func TestErrorResponsesUseEnvelope(t *testing.T) {
+    srv := newTestServer(t)
+
+    tests := []struct {
+        method string
+        path   string
+        body   interface{}
+        status int
+        code   string
+    }{
+        {http.MethodPost, "/reviews", map[string]interface{}{"product_id": "widget", "name": "alice", "review": "text", "rating": 9}, http.StatusBadRequest, "invalid_rating"},
+        {http.MethodPost, "/reviews", map[string]interface{}{"product_id": "widget", "admin": true}, http.StatusBadRequest, "unknown_field"},
+        {http.MethodGet, "/reviews?limit=0", nil, http.StatusBadRequest, "invalid_limit"},
+        {http.MethodGet, "/review?id=42", nil, http.StatusNotFound, "review_not_found"},
+        {http.MethodPatch, "/stats", nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+        {http.MethodGet, "/no-such-endpoint", nil, http.StatusNotFound, "not_found"},
+    }
+    for _, tt := range tests {
+        resp := doRequest(t, tt.method, srv.URL+tt.path, tt.body)
+        if resp.StatusCode != tt.status {
+            t.Errorf("%s %s returned %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+            continue
+        }
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &body)
+        if body.Error.Code != tt.code || body.Error.Status != tt.status || body.Error.Message == "" {
+            t.Errorf("%s %s returned error %+v, want code %q and status %d", tt.method, tt.path, body.Error, tt.code, tt.status)
+        }
+    }
+}
+
+func TestRequestID(t *testing.T) {
+    handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if requestIDFromContext(r.Context()) != w.Header().Get("X-Request-ID") {
+            t.Errorf("Context request ID %q differs from header %q", requestIDFromContext(r.Context()), w.Header().Get("X-Request-ID"))
+        }
+        respondWithError(w, http.StatusBadRequest, "invalid_request", "bad")
+    }))
+
+    tests := []struct {
+        incoming string
+        keep     bool
+    }{
+        {"", false},
+        {"client-id-123", true},
+        {"has space", false},
+        {strings.Repeat("x", maxRequestIDLength+1), false},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(http.MethodGet, "/", nil)
+        if tt.incoming != "" {
+            req.Header.Set("X-Request-ID", tt.incoming)
+        }
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, req)
+
+        id := rec.Header().Get("X-Request-ID")
+        if id == "" || (id == tt.incoming) != tt.keep {
+            t.Errorf("Incoming ID %q produced %q, want it kept: %v", tt.incoming, id, tt.keep)
+        }
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        json.NewDecoder(rec.Body).Decode(&body)
+        if body.Error.RequestID != id {
+            t.Errorf("Error body carries request ID %q, want %q", body.Error.RequestID, id)
+        }
+    }
+}
+
+func TestStaticFrontend(t *testing.T) {
+    dir := t.TempDir()
+    for name, content := range map[string]string{"index.html": "<h1>Reviews</h1>", "app.js": "render()", ".env": "SECRET=1", "empty/.keep": ""} {
+        if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, StaticDir: dir})
+
+    for path, want := range map[string]string{"/": "<h1>Reviews</h1>", "/app.js": "render()"} {
+        resp := doRequest(t, http.MethodGet, srv.URL+path, nil)
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK || string(body) != want {
+            t.Errorf("GET %s returned %d %q, want 200 %q", path, resp.StatusCode, body, want)
+        }
+    }
+
+    // API routes take precedence over files
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews", nil); resp.Header.Get("Content-Type") != "application/json" {
+        t.Errorf("GET /reviews returned Content-Type %q, want JSON", resp.Header.Get("Content-Type"))
+    }
+
+    // Missing files, dotfiles, bare directories and other methods get the JSON 404
+    for _, req := range []struct{ method, path string }{
+        {http.MethodGet, "/missing.html"},
+        {http.MethodGet, "/.env"},
+        {http.MethodGet, "/empty/"},
+        {http.MethodGet, "/%2e%2e/main.go"},
+        {http.MethodPost, "/app.js"},
+    } {
+        resp := doRequest(t, req.method, srv.URL+req.path, nil)
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &body)
+        if resp.StatusCode != http.StatusNotFound || body.Error.Code != "not_found" {
+            t.Errorf("%s %s returned %d %+v, want a JSON 404", req.method, req.path, resp.StatusCode, body.Error)
+        }
+    }
+}
+
+func TestGetReviewsListsApprovedReviews(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    admin := signToken(t, secret, "root", true)
+
+    var first Review
+    for i, name := range []string{"alice", "bob"} {
+        resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", signToken(t, secret, name, false), map[string]interface{}{"product_id": "widget", "name": name, "review": "Review by " + name, "rating": 5 - 3*i})
+        if resp.StatusCode != http.StatusCreated {
+            t.Fatalf("POST /reviews returned %d, want %d", resp.StatusCode, http.StatusCreated)
+        }
+        if i == 0 {
+            decodeBody(t, resp, &first)
+        }
+    }
+
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/approve-review", admin, map[string]int{"id": first.ID}); resp.StatusCode != http.StatusOK {
+        t.Fatalf("POST /approve-review returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    var page struct {
+        Reviews []Review `json:"reviews"`
+        Total   int      `json:"total"`
+    }
+    resp := doRequest(t, http.MethodGet, srv.URL+"/reviews", nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET /reviews returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    decodeBody(t, resp, &page)
+    if page.Total != 1 || len(page.Reviews) != 1 || page.Reviews[0].ID != first.ID {
+        t.Errorf("GET /reviews returned %+v, want only review %d", page, first.ID)
+    }
+
+    resp = doAuthRequest(t, http.MethodGet, srv.URL+"/reviews?status=all&limit=1", admin, nil)
+    decodeBody(t, resp, &page)
+    if page.Total != 2 || len(page.Reviews) != 1 {
+        t.Errorf("GET /reviews?status=all&limit=1 returned total %d with %d reviews, want total 2 with 1 review", page.Total, len(page.Reviews))
+    }
+
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?limit=-1", nil); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("GET /reviews?limit=-1 returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestUnapprovedReviewsHiddenFromPublic(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    admin := signToken(t, secret, "root", true)
+    author := signToken(t, secret, "alice", false)
+
+    resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", author, map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Awaiting moderation", "rating": 4})
+    var pending Review
+    decodeBody(t, resp, &pending)
+
+    // Moderation listings are for admins only, whether listed or counted
+    for _, path := range []string{"/reviews?status=pending", "/reviews?status=all", "/reviews/count?status=pending", "/reviews/count?status=all"} {
+        for _, tt := range []struct {
+            token string
+            want  int
+        }{{"", http.StatusForbidden}, {signToken(t, secret, "bob", false), http.StatusForbidden}, {admin, http.StatusOK}} {
+            resp := doAuthRequest(t, http.MethodGet, srv.URL+path, tt.token, nil)
+            if resp.StatusCode != tt.want {
+                t.Errorf("GET %s as admin %t returned %d, want %d", path, tt.token == admin, resp.StatusCode, tt.want)
+            }
+        }
+    }
+
+    // A pending review is only readable by its author and admins
+    path := fmt.Sprintf("/review?id=%d", pending.ID)
+    for _, tt := range []struct {
+        name  string
+        token string
+        want  int
+    }{{"anonymous", "", http.StatusNotFound}, {"another user", signToken(t, secret, "bob", false), http.StatusNotFound}, {"the author", author, http.StatusOK}, {"an admin", admin, http.StatusOK}} {
+        if resp := doAuthRequest(t, http.MethodGet, srv.URL+path, tt.token, nil); resp.StatusCode != tt.want {
+            t.Errorf("GET %s by %s returned %d, want %d", path, tt.name, resp.StatusCode, tt.want)
+        }
+    }
+}
+
+func TestAuthorEditReturnsReviewToModeration(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    admin := signToken(t, secret, "root", true)
+    author := signToken(t, secret, "alice", false)
+
+    resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", author, map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Solid widget", "rating": 4})
+    var review Review
+    decodeBody(t, resp, &review)
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/approve-review", admin, map[string]int{"id": review.ID}); resp.StatusCode != http.StatusOK {
+        t.Fatalf("POST /approve-review returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    // Warm the caches so a stale listing would still show the approved text
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews", nil), &page)
+    if len(page.Reviews) != 1 {
+        t.Fatalf("GET /reviews returned %d reviews before the edit, want 1", len(page.Reviews))
+    }
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+
+    // An admin's edit keeps the approval
+    resp = doAuthRequest(t, http.MethodPut, srv.URL+"/reviews", admin, map[string]interface{}{"id": review.ID, "product_id": "widget", "name": "alice", "review": "Solid widget, typo fixed", "rating": 4})
+    var edited Review
+    decodeBody(t, resp, &edited)
+    if resp.StatusCode != http.StatusOK || !edited.Approved {
+        t.Errorf("PUT /review by an admin returned %d with approved %t, want 200 with approved true", resp.StatusCode, edited.Approved)
+    }
+
+    // The author's edit sends it back to moderation and out of public view
+    resp = doAuthRequest(t, http.MethodPut, srv.URL+"/reviews", author, map[string]interface{}{"id": review.ID, "product_id": "widget", "name": "alice", "review": "Buy from my shop instead", "rating": 5})
+    decodeBody(t, resp, &edited)
+    if resp.StatusCode != http.StatusOK || edited.Approved {
+        t.Errorf("PUT /review by the author returned %d with approved %t, want 200 with approved false", resp.StatusCode, edited.Approved)
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews", nil), &page)
+    if len(page.Reviews) != 0 {
+        t.Errorf("GET /reviews after the author's edit returned %+v, want no reviews", page.Reviews)
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Count != 0 {
+        t.Errorf("GET /stats after the author's edit counted %d reviews, want 0", stats.Count)
+    }
+    if resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, review.ID), nil); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET /review after the author's edit returned %d to the public, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+}
+
+func TestVerifiedOnlySetByAdmins(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    admin := signToken(t, secret, "root", true)
+    author := signToken(t, secret, "alice", false)
+
+    for _, tt := range []struct {
+        name  string
+        token string
+        want  bool
+    }{{"a user", author, false}, {"an admin", admin, true}} {
+        resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", tt.token, map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Posted by " + tt.name, "rating": 5, "verified": true})
+        var review Review
+        decodeBody(t, resp, &review)
+        if resp.StatusCode != http.StatusCreated || review.Verified != tt.want {
+            t.Errorf("POST /reviews with verified true by %s returned %d with verified %t, want 201 with verified %t", tt.name, resp.StatusCode, review.Verified, tt.want)
+        }
+
+        resp = doAuthRequest(t, http.MethodPost, srv.URL+"/reviews/bulk", tt.token, []map[string]interface{}{{"product_id": "widget", "name": "alice", "review": "Imported by " + tt.name, "rating": 5, "verified": true}})
+        var result struct {
+            IDs []int `json:"ids"`
+        }
+        decodeBody(t, resp, &result)
+        if len(result.IDs) != 1 {
+            t.Fatalf("POST /reviews/bulk by %s returned %d with ids %v, want one id", tt.name, resp.StatusCode, result.IDs)
+        }
+        decodeBody(t, doAuthRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, result.IDs[0]), admin, nil), &review)
+        if review.Verified != tt.want {
+            t.Errorf("POST /reviews/bulk with verified true by %s stored verified %t, want %t", tt.name, review.Verified, tt.want)
+        }
+    }
+}
+
+// newDuplicateTestServer starts the API against a fresh in-memory database whose store rejects
+// identical reviews saved within window
+func newDuplicateTestServer(t *testing.T, window time.Duration) *httptest.Server {
+    t.Helper()
+
+    conn, err := openDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared&_foreign_keys=on", t.Name()))
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    srv := httptest.NewServer(NewServer(newSQLiteStore(conn, window), Config{RateLimit: rate.Inf, RateBurst: 1}))
+    t.Cleanup(func() {
+        srv.Close()
+        conn.Close()
+    })
+    return srv
+}
+
+func TestDuplicateReviewsRejectedWithinWindow(t *testing.T) {
+    srv := newDuplicateTestServer(t, 10*time.Minute)
+    review := map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Great", "rating": 5}
+
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", review); resp.StatusCode != http.StatusCreated {
+        t.Fatalf("First POST /reviews returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", review)
+    var body struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &body)
+    if resp.StatusCode != http.StatusConflict || body.Error.Code != "duplicate_review" {
+        t.Errorf("Repeated POST /reviews returned %d %q, want %d duplicate_review", resp.StatusCode, body.Error.Code, http.StatusConflict)
+    }
+
+    // Changing any of product, name or text makes it a different review
+    review["review"] = "Great, really"
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", review); resp.StatusCode != http.StatusCreated {
+        t.Errorf("POST /reviews with different text returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+}
+
+func TestDuplicateReviewsAllowedWithoutWindow(t *testing.T) {
+    srv := newDuplicateTestServer(t, 0)
+    review := map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Great", "rating": 5}
+
+    for i := 0; i < 2; i++ {
+        if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", review); resp.StatusCode != http.StatusCreated {
+            t.Errorf("POST /reviews %d with the check disabled returned %d, want %d", i+1, resp.StatusCode, http.StatusCreated)
+        }
+    }
+}
+
+func TestStatsCountsUniqueReviewers(t *testing.T) {
+    srv := newTestServer(t)
+
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Count != 0 || stats.UniqueReviewers != 0 {
+        t.Errorf("GET /stats on an empty table returned %+v, want zero counts", stats)
+    }
+
+    for _, name := range []string{"alice", "Alice", "bob"} {
+        review := createReview(t, srv, name, 4)
+        if resp := doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID}); resp.StatusCode != http.StatusOK {
+            t.Fatalf("POST /approve-review returned %d, want %d", resp.StatusCode, http.StatusOK)
+        }
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Count != 3 || stats.UniqueReviewers != 2 {
+        t.Errorf("GET /stats returned count %d with %d unique reviewers, want 3 with 2", stats.Count, stats.UniqueReviewers)
+    }
+}
+
+func TestStatsWeightedAverage(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, RatingHalfLife: 30 * 24 * time.Hour})
+    recent := createReview(t, srv, "Alice", 5)
+    old := createReview(t, srv, "Bob", 1)
+    for _, id := range []int{recent.ID, old.ID} {
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": id})
+    }
+
+    // Backdate one review by two half-lives through a second connection to the same database
+    conn, err := openDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    if _, err := conn.Exec("UPDATE reviews SET created_at = ? WHERE id = ?", time.Now().UTC().Add(-60*24*time.Hour), old.ID); err != nil {
+        t.Fatalf("Failed to backdate review: %v", err)
+    }
+
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Average != 3 || stats.WeightedAverage != nil {
+        t.Errorf("GET /stats returned average %v and weighted average %v, want 3 and none", stats.Average, stats.WeightedAverage)
+    }
+
+    // The old review counts a quarter as much: (5 + 0.25) / 1.25
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats?weighted=true", nil), &stats)
+    if stats.Average != 3 || stats.WeightedAverage == nil || *stats.WeightedAverage < 4.19 || *stats.WeightedAverage > 4.21 {
+        t.Errorf("GET /stats?weighted=true returned average %v and weighted average %v, want 3 and 4.2", stats.Average, stats.WeightedAverage)
+    }
+
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/stats?weighted=maybe", nil); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("GET /stats?weighted=maybe returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestStatsDistribution(t *testing.T) {
+    srv := newTestServer(t)
+    for _, r := range []struct {
+        name   string
+        rating int
+    }{{"alice", 5}, {"bob", 5}, {"carol", 3}, {"dave", 1}} {
+        review := createReview(t, srv, r.name, r.rating)
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+    createReview(t, srv, "pending", 2)
+
+    var distribution map[string]int
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats/distribution", nil), &distribution)
+    if want := map[string]int{"1": 1, "2": 0, "3": 1, "4": 0, "5": 2}; fmt.Sprint(distribution) != fmt.Sprint(want) {
+        t.Errorf("GET /stats/distribution returned %v, want %v", distribution, want)
+    }
+
+    distribution = nil
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats/distribution?minRating=3", nil), &distribution)
+    if want := map[string]int{"1": 0, "2": 0, "3": 1, "4": 0, "5": 2}; fmt.Sprint(distribution) != fmt.Sprint(want) {
+        t.Errorf("GET /stats/distribution?minRating=3 returned %v, want %v", distribution, want)
+    }
+
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/stats/distribution?lang=english", nil); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("GET /stats/distribution?lang=english returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestStatsCache(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, StatsTTL: time.Minute})
+
+    getStats := func(wantCache string) ReviewStats {
+        t.Helper()
+        resp := doRequest(t, http.MethodGet, srv.URL+"/stats", nil)
+        if got := resp.Header.Get("X-Cache"); got != wantCache {
+            t.Errorf("GET /stats returned X-Cache %q, want %q", got, wantCache)
+        }
+        var stats ReviewStats
+        decodeBody(t, resp, &stats)
+        return stats
+    }
+
+    getStats("MISS")
+    getStats("HIT")
+
+    // Approving a review changes the figures, so the next request recomputes them
+    review := createReview(t, srv, "alice", 5)
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    if stats := getStats("MISS"); stats.Count != 1 {
+        t.Errorf("GET /stats after approving a review returned count %d, want 1", stats.Count)
+    }
+    getStats("HIT")
+}
+
+func TestListCache(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, ListCache: true})
+    for _, name := range []string{"alice", "bob", "carol"} {
+        review := createReview(t, srv, name, 4)
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+
+    type page struct {
+        Reviews    []Review `json:"reviews"`
+        Total      int      `json:"total"`
+        NextCursor *int     `json:"next_cursor"`
+    }
+    getReviews := func(path, wantCache string) page {
+        t.Helper()
+        resp := doRequest(t, http.MethodGet, srv.URL+path, nil)
+        if got := resp.Header.Get("X-Cache"); got != wantCache {
+            t.Errorf("GET %s returned X-Cache %q, want %q", path, got, wantCache)
+        }
+        var p page
+        decodeBody(t, resp, &p)
+        return p
+    }
+
+    if p := getReviews("/reviews", "MISS"); len(p.Reviews) != 3 || p.Total != 3 {
+        t.Errorf("GET /reviews returned %d of %d reviews, want 3 of 3", len(p.Reviews), p.Total)
+    }
+    getReviews("/reviews", "HIT")
+
+    // Pages and cursors are cut from the cached list
+    first := getReviews("/reviews?limit=2", "HIT")
+    if len(first.Reviews) != 2 || first.NextCursor == nil {
+        t.Fatalf("GET /reviews?limit=2 returned %d reviews and cursor %v, want 2 and a cursor", len(first.Reviews), first.NextCursor)
+    }
+    rest := getReviews(fmt.Sprintf("/reviews?after=%d", *first.NextCursor), "HIT")
+    if len(rest.Reviews) != 1 || rest.Reviews[0].Name != "carol" || rest.Total != 3 {
+        t.Errorf("GET /reviews?after=%d returned %+v, want only carol's review", *first.NextCursor, rest)
+    }
+    if p := getReviews("/reviews?offset=2", "HIT"); len(p.Reviews) != 1 || p.Reviews[0].Name != "carol" {
+        t.Errorf("GET /reviews?offset=2 returned %+v, want only carol's review", p.Reviews)
+    }
+
+    // Filtered and sorted listings bypass the cache
+    if p := getReviews("/reviews?name=bob", ""); len(p.Reviews) != 1 {
+        t.Errorf("GET /reviews?name=bob returned %d reviews, want 1", len(p.Reviews))
+    }
+    getReviews("/reviews?sort=newest", "")
+
+    // Writes refresh the cached list
+    doRequest(t, http.MethodPost, srv.URL+"/admin/block", map[string]string{"name": "bob"})
+    if p := getReviews("/reviews", "MISS"); len(p.Reviews) != 2 {
+        t.Errorf("GET /reviews after blocking bob returned %d reviews, want 2", len(p.Reviews))
+    }
+    doRequest(t, http.MethodPost, srv.URL+"/reviews/helpful", map[string]int{"id": first.Reviews[0].ID})
+    if p := getReviews("/reviews", "MISS"); p.Reviews[0].Helpful != 1 {
+        t.Errorf("GET /reviews after a helpful vote returned count %d, want 1", p.Reviews[0].Helpful)
+    }
+}
+
+func TestRecalculateFixesStaleCaches(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, StatsTTL: time.Minute, ListCache: true})
+    first := createReview(t, srv, "alice", 4)
+    second := createReview(t, srv, "bob", 4)
+    for _, review := range []Review{first, second} {
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+    doRequest(t, http.MethodGet, srv.URL+"/stats", nil).Body.Close()
+    doRequest(t, http.MethodGet, srv.URL+"/reviews", nil).Body.Close()
+
+    // Another process sharing the database changes a rating behind the caches' back
+    conn, err := openDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name()))
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    if _, err := conn.Exec("UPDATE reviews SET rating = 2 WHERE id = ?", first.ID); err != nil {
+        t.Fatalf("Failed to change rating: %v", err)
+    }
+
+    recalculate := func() recalculateReport {
+        t.Helper()
+        resp := doRequest(t, http.MethodPost, srv.URL+"/admin/recalculate", nil)
+        if resp.StatusCode != http.StatusOK {
+            t.Fatalf("POST /admin/recalculate returned status %d, want 200", resp.StatusCode)
+        }
+        var report recalculateReport
+        decodeBody(t, resp, &report)
+        return report
+    }
+
+    report := recalculate()
+    want := []statsDiscrepancy{{ProductID: "", Fields: []string{"average", "breakdown"}}}
+    if report.StatsChecked != 1 || !reflect.DeepEqual(report.StatsFixed, want) || !report.ListCacheFixed {
+        t.Errorf("POST /admin/recalculate returned %+v, want 1 checked, %+v fixed and the list cache fixed", report, want)
+    }
+
+    // The caches now serve the stored figures
+    resp := doRequest(t, http.MethodGet, srv.URL+"/stats", nil)
+    if got := resp.Header.Get("X-Cache"); got != "HIT" {
+        t.Errorf("GET /stats after recalculating returned X-Cache %q, want HIT", got)
+    }
+    var stats ReviewStats
+    decodeBody(t, resp, &stats)
+    if stats.Average != 3 {
+        t.Errorf("GET /stats after recalculating returned average %v, want 3", stats.Average)
+    }
+    resp = doRequest(t, http.MethodGet, srv.URL+"/reviews", nil)
+    if got := resp.Header.Get("X-Cache"); got != "HIT" {
+        t.Errorf("GET /reviews after recalculating returned X-Cache %q, want HIT", got)
+    }
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, resp, &page)
+    if len(page.Reviews) != 2 || page.Reviews[0].Rating == nil || *page.Reviews[0].Rating != 2 {
+        t.Errorf("GET /reviews after recalculating returned %+v, want alice's rating of 2", page.Reviews)
+    }
+
+    // Nothing is left to fix
+    if report := recalculate(); report.StatsChecked != 1 || len(report.StatsFixed) != 0 || report.ListCacheFixed {
+        t.Errorf("POST /admin/recalculate again returned %+v, want nothing fixed", report)
+    }
+}
+
+func TestReviewsRSSFeed(t *testing.T) {
+    srv := newTestServer(t)
+    for i, name := range []string{"alice", "bob", "carol"} {
+        review := createReview(t, srv, name, i+3)
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+    createReview(t, srv, "dave", 1) // Pending, so left out of the feed
+
+    resp := doRequest(t, http.MethodGet, srv.URL+"/reviews.rss?n=2", nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET /reviews.rss returned status %d, want 200", resp.StatusCode)
+    }
+    if got := resp.Header.Get("Content-Type"); got != "application/rss+xml; charset=utf-8" {
+        t.Errorf("GET /reviews.rss returned Content-Type %q, want application/rss+xml", got)
+    }
+    defer resp.Body.Close()
+    var feed rssFeed
+    if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+        t.Fatalf("Failed to decode feed: %v", err)
+    }
+    if feed.Version != "2.0" || len(feed.Channel.Items) != 2 {
+        t.Fatalf("GET /reviews.rss?n=2 returned version %q with %d items, want 2.0 with 2", feed.Version, len(feed.Channel.Items))
+    }
+    item := feed.Channel.Items[0]
+    if item.Title != "Review by carol, rated 5" || item.Description != "Review by carol" {
+        t.Errorf("GET /reviews.rss returned newest item %+v, want carol's review", item)
+    }
+    if _, err := time.Parse(time.RFC1123Z, item.PubDate); err != nil {
+        t.Errorf("GET /reviews.rss returned pubDate %q, want an RFC 1123 date: %v", item.PubDate, err)
+    }
+    if !strings.HasPrefix(item.Link, srv.URL+"/review?id=") || item.GUID.Value != item.Link {
+        t.Errorf("GET /reviews.rss returned link %q and guid %q, want the review's URL for both", item.Link, item.GUID.Value)
+    }
+
+    resp = doRequest(t, http.MethodGet, srv.URL+"/reviews.rss?n=0", nil)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("GET /reviews.rss?n=0 returned status %d, want 400", resp.StatusCode)
+    }
+}
+
+func TestCountReviews(t *testing.T) {
+    srv := newTestServer(t)
+    for i, name := range []string{"alice", "bob", "carol"} {
+        review := createReview(t, srv, name, i+3)
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+    createReview(t, srv, "dave", 2) // Pending
+    doRequest(t, http.MethodPost, srv.URL+"/admin/block", map[string]string{"name": "bob"})
+
+    for _, tc := range []struct {
+        query string
+        want  int
+    }{
+        {"", 2}, // bob is blocked and dave is pending
+        {"?minRating=5", 1},
+        {"?status=pending", 1},
+        {"?status=all", 3}, // Blocked reviewers are only counted for admin tokens
+        {"?name=carol", 1},
+        {"?productId=gadget", 0},
+    } {
+        resp := doRequest(t, http.MethodGet, srv.URL+"/reviews/count"+tc.query, nil)
+        if resp.StatusCode != http.StatusOK {
+            t.Fatalf("GET /reviews/count%s returned status %d, want 200", tc.query, resp.StatusCode)
+        }
+        var body map[string]int
+        decodeBody(t, resp, &body)
+        if body["count"] != tc.want {
+            t.Errorf("GET /reviews/count%s returned %v, want count %d", tc.query, body, tc.want)
+        }
+    }
+
+    for query, want := range map[string]int{"?minRating=0": http.StatusBadRequest, "?status=bogus": http.StatusBadRequest} {
+        resp := doRequest(t, http.MethodGet, srv.URL+"/reviews/count"+query, nil)
+        resp.Body.Close()
+        if resp.StatusCode != want {
+            t.Errorf("GET /reviews/count%s returned status %d, want %d", query, resp.StatusCode, want)
+        }
+    }
+}
+
+func TestSQLInjectionPayloadsAreTreatedAsData(t *testing.T) {
+    srv := newTestServer(t)
+    const payload = "'; DROP TABLE reviews;--"
+    injected := url.QueryEscape(payload)
+
+    // A review made of the payload is stored verbatim
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": payload, "name": payload, "review": payload, "rating": 4})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews with an injection payload returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var stored Review
+    decodeBody(t, resp, &stored)
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": stored.ID})
+    other := createReview(t, srv, "alice", 5)
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": other.ID})
+
+    // Every parameter reaching a query either matches the payload literally or is rejected
+    for _, path := range []string{
+        "/reviews?productId=" + injected,
+        "/reviews?name=" + injected,
+        "/reviews?search=" + injected,
+        "/reviews?sort=" + injected,
+        "/reviews?lang=" + injected,
+        "/reviews?status=" + injected,
+        "/reviews?minRating=" + injected,
+        "/reviews?from=" + injected,
+        "/reviews?to=" + injected,
+        "/reviews?after=" + injected,
+        "/reviews?limit=" + injected,
+        "/reviews?offset=" + injected,
+        "/reviews?fields=" + injected,
+        "/reviews?verifiedOnly=" + injected,
+        "/reviews/count?productId=" + injected,
+        "/reviews/top?n=" + injected,
+        "/reviews.rss?productId=" + injected,
+        "/review?id=" + injected,
+        "/reviews/" + url.PathEscape(payload) + "/history",
+        "/stats?productId=" + injected,
+        "/stats/distribution?productId=" + injected + "&name=" + injected,
+    } {
+        resp := doRequest(t, http.MethodGet, srv.URL+path, nil)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("GET %s returned %d, want 200 or 400", path, resp.StatusCode)
+        }
+    }
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/admin/block", map[string]string{"name": payload}); resp.StatusCode != http.StatusOK {
+        t.Errorf("POST /admin/block with an injection payload returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    doRequest(t, http.MethodPost, srv.URL+"/admin/unblock", map[string]string{"name": payload})
+
+    // The table survived and the filters matched the payload as plain text
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    for _, param := range []string{"productId", "name", "search"} {
+        resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?"+param+"="+injected, nil)
+        decodeBody(t, resp, &page)
+        if len(page.Reviews) != 1 || page.Reviews[0].ID != stored.ID || page.Reviews[0].Name != payload || page.Reviews[0].Review != payload {
+            t.Errorf("GET /reviews?%s=<payload> returned %+v, want only the payload review, stored verbatim", param, page.Reviews)
+        }
+    }
+    resp = doRequest(t, http.MethodGet, srv.URL+"/reviews/count", nil)
+    var count map[string]int
+    decodeBody(t, resp, &count)
+    if count["count"] != 2 {
+        t.Errorf("GET /reviews/count returned %d, want both reviews still stored", count["count"])
+    }
+}
+
+func TestAddColumnIfMissingRejectsUnsafeIdentifiers(t *testing.T) {
+    conn, err := openDatabase("file:TestAddColumnIfMissingRejectsUnsafeIdentifiers?mode=memory&cache=shared")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    tx, err := conn.Begin()
+    if err != nil {
+        t.Fatalf("Failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback()
+
+    if added, err := addColumnIfMissing(tx, "reviews", "name", "TEXT"); added || err != nil {
+        t.Errorf("Adding an existing column returned %v, %v, want false, nil", added, err)
+    }
+    if _, err := addColumnIfMissing(tx, "reviews; DROP TABLE reviews;--", "extra", "TEXT"); err == nil {
+        t.Error("Adding a column to an injected table name succeeded, want an error")
+    }
+    if _, err := addColumnIfMissing(tx, "reviews", "extra TEXT; DROP TABLE reviews;--", "TEXT"); err == nil {
+        t.Error("Adding an injected column name succeeded, want an error")
+    }
+}
+
+func TestMinReviewLength(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, MinReviewLength: 5})
+
+    for _, tc := range []struct {
+        text string
+        want int
+    }{
+        {"ok", http.StatusBadRequest},
+        {"  ok     ", http.StatusBadRequest}, // Measured after trimming
+        {"très", http.StatusBadRequest},      // 4 characters in 5 bytes
+        {"très bien", http.StatusCreated},
+        {"日本語です", http.StatusCreated}, // 5 characters in 15 bytes
+    } {
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "alice", "review": tc.text, "rating": 4})
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &body)
+        if resp.StatusCode != tc.want {
+            t.Errorf("POST review %q returned %d, want %d", tc.text, resp.StatusCode, tc.want)
+        }
+        if tc.want == http.StatusBadRequest && (body.Error.Code != "invalid_review" || !strings.Contains(body.Error.Message, "at least 5 characters")) {
+            t.Errorf("POST review %q returned error %+v, want invalid_review naming the minimum", tc.text, body.Error)
+        }
+    }
+
+    // Drafts may be shorter until they are published
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "bob", "review": "ok", "status": "draft"})
+    if resp.StatusCode != http.StatusCreated {
+        t.Errorf("POST short draft returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+
+    var config map[string]interface{}
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/config", nil), &config)
+    if config["minReviewLength"] != float64(5) {
+        t.Errorf("GET /config returned minReviewLength %v, want 5", config["minReviewLength"])
+    }
+}
+
+func TestTopReviews(t *testing.T) {
+    srv := newTestServer(t)
+    for _, r := range []struct {
+        name   string
+        rating int
+    }{{"alice", 3}, {"bob", 5}, {"carol", 4}, {"dave", 5}, {"erin", 1}} {
+        review := createReview(t, srv, r.name, r.rating)
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+    }
+    createReview(t, srv, "pending", 5)
+
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews/top?n=3", nil), &page)
+    var names []string
+    for _, review := range page.Reviews {
+        names = append(names, review.Name)
+    }
+    if got, want := strings.Join(names, ","), "dave,bob,carol"; got != want {
+        t.Errorf("GET /reviews/top?n=3 returned %s, want %s", got, want)
+    }
+
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews/top", nil), &page)
+    if len(page.Reviews) != 5 {
+        t.Errorf("GET /reviews/top returned %d reviews, want the default of 5", len(page.Reviews))
+    }
+
+    for _, n := range []string{"0", "51", "many"} {
+        if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews/top?n="+n, nil); resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("GET /reviews/top?n=%s returned %d, want %d", n, resp.StatusCode, http.StatusBadRequest)
+        }
+    }
+}
+
+func TestGetReviewsCursorPagination(t *testing.T) {
+    srv := newTestServer(t)
+
+    for i := 0; i < 5; i++ {
+        createReview(t, srv, fmt.Sprintf("user%d", i), 3)
+    }
+
+    var page struct {
+        Reviews    []Review `json:"reviews"`
+        Total      int      `json:"total"`
+        NextCursor *int     `json:"next_cursor"`
+    }
+    var ids []int
+    url := srv.URL + "/reviews?status=all&limit=2"
+    for pages := 0; ; pages++ {
+        if pages > 5 {
+            t.Fatalf("Cursor pagination did not terminate")
+        }
+        resp := doRequest(t, http.MethodGet, url, nil)
+        if resp.StatusCode != http.StatusOK {
+            t.Fatalf("GET %s returned %d, want %d", url, resp.StatusCode, http.StatusOK)
+        }
+        page.NextCursor = nil
+        decodeBody(t, resp, &page)
+        if page.Total != 5 {
+            t.Errorf("GET %s returned total %d, want 5", url, page.Total)
+        }
+        for _, review := range page.Reviews {
+            ids = append(ids, review.ID)
+        }
+        if page.NextCursor == nil {
+            break
+        }
+        url = fmt.Sprintf("%s/reviews?status=all&limit=2&after=%d", srv.URL, *page.NextCursor)
+    }
+    if len(ids) != 5 {
+        t.Errorf("Cursor pagination returned ids %v, want 5 distinct reviews", ids)
+    }
+
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?after=1&offset=2", nil); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("GET with after and offset returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestGetReviewsByName(t *testing.T) {
+    srv := newTestServer(t)
+
+    alice := createReview(t, srv, "Alice", 5)
+    createReview(t, srv, "Alice Smith", 4)
+    createReview(t, srv, "bob", 3)
+
+    var page struct {
+        Reviews []Review `json:"reviews"`
+        Total   int      `json:"total"`
+    }
+    resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all&name=%20alice%20", nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET /reviews?name= returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    decodeBody(t, resp, &page)
+    if page.Total != 1 || len(page.Reviews) != 1 || page.Reviews[0].ID != alice.ID {
+        t.Errorf("GET /reviews?name=alice returned %+v, want only review %d", page, alice.ID)
+    }
+}
+
+func TestReviewLanguage(t *testing.T) {
+    srv := newTestServer(t)
+
+    post := func(text, language string) *http.Response {
+        body := map[string]interface{}{"product_id": "widget", "name": "alice", "review": text, "rating": 4}
+        if language != "" {
+            body["language"] = language
+        }
+        return doRequest(t, http.MethodPost, srv.URL+"/reviews", body)
+    }
+
+    var english, german Review
+    decodeBody(t, post("This blender is really great and I use it every single morning for my smoothies.", ""), &english)
+    decodeBody(t, post("Der Mixer ist wirklich großartig und ich benutze ihn jeden Morgen für meine Smoothies.", ""), &german)
+    if english.Language != "en" || german.Language != "de" {
+        t.Errorf("Detected languages %q and %q, want en and de", english.Language, german.Language)
+    }
+
+    var overridden Review
+    decodeBody(t, post("This blender is really great and I use it every single morning for my smoothies.", " FR "), &overridden)
+    if overridden.Language != "fr" {
+        t.Errorf("Explicit language FR was stored as %q, want fr", overridden.Language)
+    }
+    if resp := post("Fine", "english"); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST with language english returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all&lang=de", nil), &page)
+    if len(page.Reviews) != 1 || page.Reviews[0].ID != german.ID {
+        t.Errorf("GET /reviews?lang=de returned %+v, want only review %d", page.Reviews, german.ID)
+    }
+}
+
+func TestGetReviewsByTimeRange(t *testing.T) {
+    srv := newTestServer(t)
+
+    createReview(t, srv, "alice", 4)
+
+    now := time.Now().UTC()
+    today := now.Format(time.DateOnly)
+    tomorrow := now.AddDate(0, 0, 1).Format(time.DateOnly)
+    tests := []struct {
+        query  string
+        status int
+        total  int
+    }{
+        {"from=" + today, http.StatusOK, 1},
+        {"to=" + tomorrow, http.StatusOK, 1},
+        {"from=" + today + "&to=" + tomorrow, http.StatusOK, 1},
+        {"from=" + tomorrow, http.StatusOK, 0},
+        {"to=" + today, http.StatusOK, 0},
+        {"from=" + now.Add(-time.Minute).Format(time.RFC3339), http.StatusOK, 1},
+        {"from=yesterday", http.StatusBadRequest, 0},
+        {"to=2024-13-01", http.StatusBadRequest, 0},
+        {"from=" + tomorrow + "&to=" + today, http.StatusBadRequest, 0},
+    }
+    for _, tt := range tests {
+        resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all&"+tt.query, nil)
+        if resp.StatusCode != tt.status {
+            t.Errorf("GET /reviews?%s returned %d, want %d", tt.query, resp.StatusCode, tt.status)
+            continue
+        }
+        if tt.status != http.StatusOK {
+            continue
+        }
+        var page struct {
+            Total int `json:"total"`
+        }
+        decodeBody(t, resp, &page)
+        if page.Total != tt.total {
+            t.Errorf("GET /reviews?%s returned total %d, want %d", tt.query, page.Total, tt.total)
+        }
+    }
+}
+
+func TestExportJSONLines(t *testing.T) {
+    srv := newTestServer(t)
+
+    for _, name := range []string{"alice", "bob", "carol"} {
+        createReview(t, srv, name, 3)
+    }
+
+    resp := doRequest(t, http.MethodGet, srv.URL+"/reviews.jsonl", nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET /reviews.jsonl returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var names []string
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        var review Review
+        if err := json.Unmarshal(scanner.Bytes(), &review); err != nil {
+            t.Fatalf("Line %q is not a review: %v", scanner.Text(), err)
+        }
+        names = append(names, review.Name)
+    }
+    if got := strings.Join(names, ","); got != "alice,bob,carol" {
+        t.Errorf("GET /reviews.jsonl returned reviews by %s, want alice,bob,carol", got)
+    }
+}
+
+func TestExportsHideUnapprovedReviews(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    admin := signToken(t, secret, "root", true)
+    for _, name := range []string{"alice", "bob"} {
+        resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", signToken(t, secret, name, false), map[string]interface{}{"product_id": "widget", "name": name, "review": "Review by " + name, "rating": 4})
+        var review Review
+        decodeBody(t, resp, &review)
+        if name == "alice" {
+            doAuthRequest(t, http.MethodPost, srv.URL+"/approve-review", admin, map[string]int{"id": review.ID})
+        }
+    }
+
+    for _, tt := range []struct {
+        token string
+        want  string
+    }{{"", "alice"}, {admin, "alice,bob"}} {
+        if got := exportedNames(t, srv.URL+"/reviews.csv", tt.token); got != tt.want {
+            t.Errorf("GET /reviews.csv as admin %t exported %s, want %s", tt.token != "", got, tt.want)
+        }
+        if got := exportedNames(t, srv.URL+"/reviews.jsonl", tt.token); got != tt.want {
+            t.Errorf("GET /reviews.jsonl as admin %t exported %s, want %s", tt.token != "", got, tt.want)
+        }
+    }
+}
+
+// exportedNames fetches a CSV or JSON Lines export with an optional user token and returns the
+// reviewer names it holds, comma-separated in export order
+func exportedNames(t *testing.T, url, token string) string {
+    t.Helper()
+
+    resp := doAuthRequest(t, http.MethodGet, url, token, nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET %s returned %d, want %d", url, resp.StatusCode, http.StatusOK)
+    }
+    var names []string
+    if strings.HasSuffix(url, ".csv") {
+        records, err := csv.NewReader(resp.Body).ReadAll()
+        if err != nil {
+            t.Fatalf("GET %s returned invalid CSV: %v", url, err)
+        }
+        for _, record := range records[1:] {
+            names = append(names, record[2])
+        }
+        return strings.Join(names, ",")
+    }
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        var review Review
+        if err := json.Unmarshal(scanner.Bytes(), &review); err != nil {
+            t.Fatalf("Line %q is not a review: %v", scanner.Text(), err)
+        }
+        names = append(names, review.Name)
+    }
+    return strings.Join(names, ",")
+}
+
+func TestGetReviewsConditionalGet(t *testing.T) {
+    srv := newTestServer(t)
+
+    createReview(t, srv, "alice", 4)
+
+    getWithETag := func(etag string) *http.Response {
+        req, err := http.NewRequest(http.MethodGet, srv.URL+"/reviews?status=all", nil)
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        if etag != "" {
+            req.Header.Set("If-None-Match", etag)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        t.Cleanup(func() { resp.Body.Close() })
+        return resp
+    }
+
+    etag := getWithETag("").Header.Get("ETag")
+    if etag == "" {
+        t.Fatalf("GET /reviews sent no ETag")
+    }
+    if resp := getWithETag(etag); resp.StatusCode != http.StatusNotModified {
+        t.Errorf("GET /reviews with a current ETag returned %d, want %d", resp.StatusCode, http.StatusNotModified)
+    }
+
+    createReview(t, srv, "bob", 2)
+    resp := getWithETag(etag)
+    if resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /reviews with a stale ETag returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp.Header.Get("ETag") == etag {
+        t.Errorf("ETag %s did not change after a review was added", etag)
+    }
+}
+
+func TestPatchReviewRating(t *testing.T) {
+    srv := newTestServer(t)
+
+    review := createReview(t, srv, "alice", 2)
+
+    resp := doRequest(t, http.MethodPatch, srv.URL+"/reviews", map[string]int{"id": review.ID, "rating": 5})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("PATCH /reviews returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var updated Review
+    decodeBody(t, resp, &updated)
+    if updated.Rating == nil || *updated.Rating != 5 || updated.Name != review.Name || updated.Review != review.Review {
+        t.Errorf("PATCH /reviews returned %+v, want %+v with rating 5", updated, review)
+    }
+
+    if resp := doRequest(t, http.MethodPatch, srv.URL+"/reviews", map[string]int{"id": review.ID, "rating": 6}); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("PATCH with rating 6 returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+    if resp := doRequest(t, http.MethodPatch, srv.URL+"/reviews", map[string]int{"id": review.ID + 100, "rating": 3}); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("PATCH of a missing review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+}
+
+func TestDeleteReview(t *testing.T) {
+    srv := newTestServer(t)
+
+    review := createReview(t, srv, "alice", 4)
+
+    resp := doRequest(t, http.MethodDelete, srv.URL+"/delete-review", map[string]int{"id": review.ID})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("DELETE existing review returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    resp = doRequest(t, http.MethodGet, srv.URL+fmt.Sprintf("/review?id=%d", review.ID), nil)
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET deleted review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+
+    resp = doRequest(t, http.MethodDelete, srv.URL+"/delete-review", map[string]int{"id": review.ID})
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("DELETE missing review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    var body struct {
+        Error struct {
+            Code string `json:"code"`
+        } `json:"error"`
+    }
+    decodeBody(t, resp, &body)
+    if body.Error.Code != "review_not_found" {
+        t.Errorf("DELETE missing review returned code %q, want review_not_found", body.Error.Code)
+    }
+
+    for _, id := range []int{0, -1} {
+        resp = doRequest(t, http.MethodDelete, srv.URL+"/delete-review", map[string]int{"id": id})
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("DELETE review with id %d returned %d, want %d", id, resp.StatusCode, http.StatusBadRequest)
+        }
+    }
+}
+
+func TestPartialBatches(t *testing.T) {
+    srv := newTestServer(t)
+    type results struct {
+        Success   bool          `json:"success"`
+        Succeeded int           `json:"succeeded"`
+        Failed    int           `json:"failed"`
+        Results   []batchResult `json:"results"`
+    }
+    entries := []map[string]interface{}{
+        {"product_id": "widget", "name": "alice", "review": "Works well", "rating": 5},
+        {"product_id": "widget", "name": "bob", "review": "Broken", "rating": 9},
+        {"product_id": "widget", "name": "carol", "review": "Fine", "rating": 3},
+    }
+
+    // By default one invalid entry rejects the whole import
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/bulk", entries)
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Fatalf("POST /reviews/bulk with an invalid entry returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+
+    // In partial mode the valid entries are saved and each outcome is reported
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/bulk?mode=partial", entries)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("POST /reviews/bulk?mode=partial returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var imported results
+    decodeBody(t, resp, &imported)
+    if imported.Success || imported.Succeeded != 2 || imported.Failed != 1 || len(imported.Results) != 3 {
+        t.Fatalf("POST /reviews/bulk?mode=partial returned %+v, want 2 of 3 entries saved", imported)
+    }
+    if r := imported.Results[1]; r.Success || r.Index != 1 || r.Error == nil || r.Error.Code != "invalid_rating" || r.Error.Status != http.StatusBadRequest {
+        t.Errorf("Invalid entry reported as %+v, want an invalid_rating error", r)
+    }
+    for _, i := range []int{0, 2} {
+        if r := imported.Results[i]; !r.Success || r.ID == 0 || r.Error != nil {
+            t.Errorf("Valid entry %d reported as %+v, want it saved", i, r)
+        }
+    }
+
+    // Partial deletes report missing reviews without undoing the others, and repeats only once
+    ids := []int{imported.Results[0].ID, 9999, imported.Results[0].ID, imported.Results[2].ID, 0}
+    resp = doRequest(t, http.MethodDelete, srv.URL+"/delete-reviews?mode=partial", map[string][]int{"ids": ids})
+    var deleted results
+    decodeBody(t, resp, &deleted)
+    if deleted.Succeeded != 2 || deleted.Failed != 2 || len(deleted.Results) != 4 {
+        t.Fatalf("DELETE /delete-reviews?mode=partial returned %+v, want 2 deleted and 2 failed", deleted)
+    }
+    wantCodes := []string{"", "review_not_found", "", "invalid_id"}
+    wantIndexes := []int{0, 1, 3, 4}
+    for i, r := range deleted.Results {
+        var code string
+        if r.Error != nil {
+            code = r.Error.Code
+        }
+        if code != wantCodes[i] || r.Index != wantIndexes[i] {
+            t.Errorf("Delete result %d is %+v, want index %d and error code %q", i, r, wantIndexes[i], wantCodes[i])
+        }
+    }
+    resp = doRequest(t, http.MethodGet, srv.URL+"/reviews/count?status=all", nil)
+    var count map[string]int
+    decodeBody(t, resp, &count)
+    if count["count"] != 0 {
+        t.Errorf("%d reviews remain after the partial delete, want 0", count["count"])
+    }
+
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/bulk?mode=lenient", entries)
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST /reviews/bulk?mode=lenient returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestDeleteReviewByPath(t *testing.T) {
+    srv := newTestServer(t)
+    review := createReview(t, srv, "alice", 4)
+
+    for _, tc := range []struct {
+        path string
+        want int
+    }{
+        {fmt.Sprintf("/reviews/%d", review.ID), http.StatusOK},
+        {fmt.Sprintf("/reviews/%d", review.ID), http.StatusNotFound},
+        {"/reviews/0", http.StatusBadRequest},
+        {"/reviews/abc", http.StatusBadRequest},
+    } {
+        resp := doRequest(t, http.MethodDelete, srv.URL+tc.path, nil)
+        resp.Body.Close()
+        if resp.StatusCode != tc.want {
+            t.Errorf("DELETE %s returned %d, want %d", tc.path, resp.StatusCode, tc.want)
+        }
+    }
+
+    resp := doRequest(t, http.MethodGet, srv.URL+fmt.Sprintf("/review?id=%d", review.ID), nil)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET review deleted by path returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+
+    // The named routes under /reviews still take precedence over the id wildcard
+    resp = doRequest(t, http.MethodGet, srv.URL+"/reviews/top", nil)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /reviews/top returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+}
+
+func TestReadyzHidesDatabaseErrors(t *testing.T) {
+    conn, err := openDatabase("file:TestReadyzHidesDatabaseErrors?mode=memory&cache=shared")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    srv := httptest.NewServer(NewServer(newSQLiteStore(conn, 0), Config{RateLimit: rate.Inf, RateBurst: 1}))
+    defer srv.Close()
+
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/readyz", nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /readyz returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    // The driver's error is logged, not shown to unauthenticated callers
+    conn.Close()
+    resp := doRequest(t, http.MethodGet, srv.URL+"/readyz", nil)
+    var body struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &body)
+    if resp.StatusCode != http.StatusServiceUnavailable || body.Error.Code != "database_unavailable" || body.Error.Message != "Database unavailable" {
+        t.Errorf("GET /readyz with the database closed returned %d %+v, want %d with a fixed message", resp.StatusCode, body.Error, http.StatusServiceUnavailable)
+    }
+}
+
+func TestMetricsFoldUnknownMethods(t *testing.T) {
+    srv := newTestServer(t)
+
+    req, err := http.NewRequest("BOGUS-METHOD", srv.URL+"/healthz", nil)
+    if err != nil {
+        t.Fatalf("Failed to build request: %v", err)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Request failed: %v", err)
+    }
+    resp.Body.Close()
+
+    resp = doRequest(t, http.MethodGet, srv.URL+"/metrics", nil)
+    defer resp.Body.Close()
+    metrics, _ := io.ReadAll(resp.Body)
+    if strings.Contains(string(metrics), "BOGUS-METHOD") || !strings.Contains(string(metrics), `handler="/healthz",method="other"`) {
+        t.Errorf("GET /metrics did not record the unknown method as other")
+    }
+    for method, want := range map[string]string{http.MethodGet: "GET", http.MethodDelete: "DELETE", "PROPFIND": "other", "": "other"} {
+        if got := methodLabel(method); got != want {
+            t.Errorf("methodLabel(%q) = %q, want %q", method, got, want)
+        }
+    }
+}
+
+func TestStoreDeleteReportsMissingReview(t *testing.T) {
+    conn, err := openDatabase("file:TestStoreDeleteReportsMissingReview?mode=memory&cache=shared")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := newSQLiteStore(conn, 0)
+    ctx := context.Background()
+
+    // Missing and already deleted reviews are told apart from database failures by errReviewNotFound
+    if err := store.Delete(ctx, 42); !errors.Is(err, errReviewNotFound) {
+        t.Errorf("Delete of a missing review returned %v, want errReviewNotFound", err)
+    }
+    id, err := store.Save(ctx, &Review{ProductID: "widget", Name: "alice", Review: "Fine", Rating: intPtr(3)})
+    if err != nil {
+        t.Fatalf("Failed to save review: %v", err)
+    }
+    if err := store.Delete(ctx, id); err != nil {
+        t.Fatalf("Failed to delete review: %v", err)
+    }
+    if err := store.Delete(ctx, id); !errors.Is(err, errReviewNotFound) {
+        t.Errorf("Delete of a deleted review returned %v, want errReviewNotFound", err)
+    }
+}
+
+func TestFlagReviews(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, FlagThreshold: 1})
+    review := createReview(t, srv, "alice", 4)
+
+    // Pending reviews are not public, so they cannot be flagged yet
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/flag", map[string]interface{}{"id": review.ID, "reason": "Spam"})
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("POST /reviews/flag of a pending review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID}).Body.Close()
+
+    for _, tc := range []struct {
+        body map[string]interface{}
+        want int
+        code string
+    }{
+        {map[string]interface{}{"id": review.ID}, http.StatusBadRequest, "invalid_reason"},
+        {map[string]interface{}{"id": review.ID, "reason": "<b>spam</b>"}, http.StatusBadRequest, "invalid_reason"},
+        {map[string]interface{}{"id": review.ID, "reason": strings.Repeat("x", maxFlagReasonLength+1)}, http.StatusBadRequest, "invalid_reason"},
+        {map[string]interface{}{"id": 9999, "reason": "Spam"}, http.StatusNotFound, "review_not_found"},
+    } {
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/flag", tc.body)
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &body)
+        if resp.StatusCode != tc.want || body.Error.Code != tc.code {
+            t.Errorf("POST /reviews/flag %v returned %d %q, want %d %q", tc.body, resp.StatusCode, body.Error.Code, tc.want, tc.code)
+        }
+    }
+
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/flag", map[string]interface{}{"id": review.ID, "reason": "  Spam  "})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews/flag returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var flag Flag
+    decodeBody(t, resp, &flag)
+    if flag.ID == 0 || flag.ReviewID != review.ID || flag.Reason != "Spam" {
+        t.Errorf("POST /reviews/flag returned %+v, want a stored flag of review %d with the trimmed reason", flag, review.ID)
+    }
+
+    // The threshold of one flag returned the review to moderation
+    resp = doRequest(t, http.MethodGet, srv.URL+fmt.Sprintf("/review?id=%d", review.ID), nil)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET /review of a hidden review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Count != 0 || stats.Pending != 1 {
+        t.Errorf("GET /stats after hiding returned count %d and pending %d, want 0 and 1", stats.Count, stats.Pending)
+    }
+
+    var flagged []FlaggedReview
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/admin/flagged", nil), &flagged)
+    if len(flagged) != 1 || flagged[0].Review.ID != review.ID || flagged[0].FlagCount != 1 || len(flagged[0].Flags) != 1 || flagged[0].Flags[0].Reason != "Spam" {
+        t.Fatalf("GET /admin/flagged returned %+v, want review %d with one flag", flagged, review.ID)
+    }
+
+    var history []AuditEntry
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+fmt.Sprintf("/reviews/%d/history", review.ID), nil), &history)
+    if len(history) == 0 || history[len(history)-1].Action != auditHide {
+        t.Errorf("GET /reviews/%d/history returned %+v, want a hide entry last", review.ID, history)
+    }
+
+    // Approving the review again dismisses its flags
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID}).Body.Close()
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/admin/flagged", nil), &flagged)
+    if len(flagged) != 0 {
+        t.Errorf("GET /admin/flagged after approval returned %+v, want none", flagged)
+    }
+
+    // Each client may flag a review once
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/flag", map[string]interface{}{"id": review.ID, "reason": "Spam again"})
+    var body struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &body)
+    if resp.StatusCode != http.StatusConflict || body.Error.Code != "already_flagged" {
+        t.Errorf("repeated POST /reviews/flag returned %d %q, want %d already_flagged", resp.StatusCode, body.Error.Code, http.StatusConflict)
+    }
+}
+
+func TestFlaggedReviewsHiddenFromEveryPublicRead(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret, FlagThreshold: 1})
+    admin := signToken(t, secret, "root", true)
+    reader := signToken(t, secret, "bob", false)
+
+    resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", signToken(t, secret, "alice", false), map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Flag me", "rating": 5})
+    var review Review
+    decodeBody(t, resp, &review)
+    doAuthRequest(t, http.MethodPost, srv.URL+"/approve-review", admin, map[string]int{"id": review.ID})
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews/flag", reader, map[string]interface{}{"id": review.ID, "reason": "Spam"}); resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews/flag returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+
+    // Every read an anonymous reader can make leaves the hidden review out
+    for _, tc := range []struct {
+        path string
+        want int
+    }{
+        {"/reviews?status=pending", http.StatusForbidden},
+        {"/reviews?status=all", http.StatusForbidden},
+        {"/reviews/count?status=all", http.StatusForbidden},
+        {fmt.Sprintf("/review?id=%d", review.ID), http.StatusNotFound},
+    } {
+        if resp := doAuthRequest(t, http.MethodGet, srv.URL+tc.path, "", nil); resp.StatusCode != tc.want {
+            t.Errorf("GET %s after hiding returned %d, want %d", tc.path, resp.StatusCode, tc.want)
+        }
+    }
+    for _, path := range []string{"/reviews", "/reviews/top", "/reviews.rss", "/reviews/count"} {
+        resp := doAuthRequest(t, http.MethodGet, srv.URL+path, "", nil)
+        body, _ := io.ReadAll(resp.Body)
+        if resp.StatusCode != http.StatusOK || strings.Contains(string(body), "Flag me") || strings.Contains(string(body), `"count":1`) {
+            t.Errorf("GET %s after hiding returned %d %s, want the review left out", path, resp.StatusCode, body)
+        }
+    }
+    for _, path := range []string{"/reviews.csv", "/reviews.jsonl"} {
+        if got := exportedNames(t, srv.URL+path, ""); got != "" {
+            t.Errorf("GET %s after hiding exported %q, want nothing", path, got)
+        }
+    }
+
+    // Admins still find it in the moderation queue
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doAuthRequest(t, http.MethodGet, srv.URL+"/reviews?status=pending", admin, nil), &page)
+    if len(page.Reviews) != 1 || page.Reviews[0].ID != review.ID {
+        t.Errorf("GET /reviews?status=pending as admin returned %+v, want review %d", page.Reviews, review.ID)
+    }
+}
+
+func TestStoreSaveFlagHidesAtThreshold(t *testing.T) {
+    conn, err := openDatabase("file:TestStoreSaveFlagHidesAtThreshold?mode=memory&cache=shared")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := newSQLiteStore(conn, 0)
+    ctx := context.Background()
+
+    id, err := store.Save(ctx, &Review{ProductID: "widget", Name: "alice", Review: "Fine", Rating: intPtr(3)})
+    if err != nil {
+        t.Fatalf("Failed to save review: %v", err)
+    }
+    if err := store.Approve(ctx, id); err != nil {
+        t.Fatalf("Failed to approve review: %v", err)
+    }
+
+    for i, want := range []bool{false, false, true} {
+        if _, hidden, err := store.SaveFlag(ctx, &Flag{ReviewID: id, Reason: "Spam"}, 3); err != nil || hidden != want {
+            t.Fatalf("SaveFlag %d returned hidden %t and %v, want %t and no error", i+1, hidden, err, want)
+        }
+    }
+    review, err := store.GetByID(ctx, id)
+    if err != nil {
+        t.Fatalf("Failed to load review: %v", err)
+    }
+    if review.Approved {
+        t.Error("Review flagged up to the threshold is still approved")
+    }
+    if _, _, err := store.SaveFlag(ctx, &Flag{ReviewID: id, Reason: "Spam"}, 3); !errors.Is(err, errReviewNotFound) {
+        t.Errorf("SaveFlag of a hidden review returned %v, want errReviewNotFound", err)
+    }
+
+    // A zero threshold records flags without ever hiding the review
+    if err := store.Approve(ctx, id); err != nil {
+        t.Fatalf("Failed to approve review: %v", err)
+    }
+    for i := 0; i < 5; i++ {
+        if _, hidden, err := store.SaveFlag(ctx, &Flag{ReviewID: id, Reason: "Spam"}, 0); err != nil || hidden {
+            t.Fatalf("SaveFlag with no threshold returned hidden %t and %v, want false and no error", hidden, err)
+        }
+    }
+    flagged, err := store.Flagged(ctx)
+    if err != nil {
+        t.Fatalf("Flagged returned %v", err)
+    }
+    if len(flagged) != 1 || flagged[0].FlagCount != 5 || len(flagged[0].Flags) != 8 {
+        t.Errorf("Flagged returned %+v, want one review with a count of 5 and all 8 flags", flagged)
+    }
+}
+
+func TestNewLogger(t *testing.T) {
+    var buf bytes.Buffer
+    l, err := newLogger(&buf, "warn", "text")
+    if err != nil {
+        t.Fatalf("newLogger returned %v", err)
+    }
+    l.Info("hidden")
+    l.Warn("shown", "key", "value")
+    if got := buf.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "level=WARN msg=shown key=value") {
+        t.Errorf("Text logger at warn level wrote %q, want only the warning", got)
+    }
+
+    buf.Reset()
+    if l, err = newLogger(&buf, "debug", "json"); err != nil {
+        t.Fatalf("newLogger returned %v", err)
+    }
+    l.Debug("details")
+    var record map[string]interface{}
+    if err := json.Unmarshal(buf.Bytes(), &record); err != nil || record["level"] != "DEBUG" || record["msg"] != "details" {
+        t.Errorf("JSON logger at debug level wrote %q (%v), want the debug record", buf.String(), err)
+    }
+
+    for _, tc := range [][2]string{{"loud", "json"}, {"info", "xml"}} {
+        if _, err := newLogger(&buf, tc[0], tc[1]); err == nil {
+            t.Errorf("newLogger(%q, %q) succeeded, want an error", tc[0], tc[1])
+        }
+    }
+}
+
+func TestValidateReview(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, Profanity: newProfanityFilter([]string{"darn"}, profanityReject)})
+
+    var result struct {
+        Valid  bool         `json:"valid"`
+        Errors []fieldError `json:"errors"`
+    }
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/validate", map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Works well", "rating": 5})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("POST /reviews/validate returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    decodeBody(t, resp, &result)
+    if !result.Valid || len(result.Errors) != 0 {
+        t.Errorf("Valid review reported as %+v", result)
+    }
+
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/validate", map[string]interface{}{"product_id": "widget", "name": "", "review": "A darn mess", "rating": 9})
+    decodeBody(t, resp, &result)
+    var codes []string
+    for _, fe := range result.Errors {
+        codes = append(codes, fe.Field+":"+fe.Code)
+    }
+    if want := "name:invalid_name rating:invalid_rating review:blocked_language"; result.Valid || strings.Join(codes, " ") != want {
+        t.Errorf("Invalid review reported errors %v, want %s", codes, want)
+    }
+
+    // Nothing is stored by a dry run
+    var page struct {
+        Total int `json:"total"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all", nil), &page)
+    if page.Total != 0 {
+        t.Errorf("Validation stored %d reviews, want 0", page.Total)
+    }
+}
+
+func TestPostReviewRejectsMarkupAndStripsControlCharacters(t *testing.T) {
+    srv := newTestServer(t)
+
+    for _, body := range []map[string]interface{}{
+        {"product_id": "widget", "name": "<script>alert(1)</script>", "review": "Fine", "rating": 4},
+        {"product_id": "widget", "name": "alice", "review": "Nice <img src=x onerror=alert(1)>", "rating": 4},
+        {"product_id": "widget", "name": "\x00\x1b", "review": "Fine", "rating": 4},
+    } {
+        if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body); resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("POST /reviews with %v returned %d, want %d", body, resp.StatusCode, http.StatusBadRequest)
+        }
+    }
+
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "ali\x00ce\n", "review": "3 < 5\r\nand\tmore\x07", "rating": 4})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var review Review
+    decodeBody(t, resp, &review)
+    if review.Name != "alice" || review.Review != "3 < 5\nand\tmore" {
+        t.Errorf("POST /reviews stored name %q and review %q, want control characters stripped", review.Name, review.Review)
+    }
+}
+
+func TestReviewReplies(t *testing.T) {
+    srv := newTestServer(t)
+
+    review := createReview(t, srv, "alice", 2)
+
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/reply", map[string]interface{}{"reviewId": review.ID, "text": "  Sorry to hear that!  "})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews/reply returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var reply Reply
+    decodeBody(t, resp, &reply)
+    if reply.ID == 0 || reply.ReviewID != review.ID || reply.Text != "Sorry to hear that!" {
+        t.Errorf("POST /reviews/reply returned %+v, want a trimmed reply to review %d", reply, review.ID)
+    }
+
+    resp = doRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, review.ID), nil)
+    var fetched Review
+    decodeBody(t, resp, &fetched)
+    if len(fetched.Replies) != 1 || fetched.Replies[0].ID != reply.ID {
+        t.Errorf("GET /review returned replies %+v, want reply %d", fetched.Replies, reply.ID)
+    }
+
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all", nil), &page)
+    if len(page.Reviews) != 1 || len(page.Reviews[0].Replies) != 1 {
+        t.Errorf("GET /reviews returned %+v, want the review with its reply", page.Reviews)
+    }
+
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/reply", map[string]interface{}{"reviewId": review.ID + 100, "text": "Hello"}); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("Reply to a missing review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/reply", map[string]interface{}{"reviewId": review.ID, "text": " "}); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("Reply without text returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+
+    // Purging the review removes its replies along with it
+    conn, err := openDatabase("file:TestReviewRepliesPurge?mode=memory&cache=shared&_foreign_keys=on")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := newSQLiteStore(conn, 0)
+    ctx := context.Background()
+    id, err := store.Save(ctx, &Review{ProductID: "widget", Name: "bob", Review: "Fine", Rating: intPtr(3)})
+    if err != nil {
+        t.Fatalf("Failed to save review: %v", err)
+    }
+    if _, err := store.SaveReply(ctx, &Reply{ReviewID: id, Text: "Thanks"}); err != nil {
+        t.Fatalf("Failed to save reply: %v", err)
+    }
+    if err := store.Purge(ctx, id); err != nil {
+        t.Fatalf("Failed to purge review: %v", err)
+    }
+    var remaining int
+    if err := conn.QueryRow("SELECT COUNT(*) FROM review_replies").Scan(&remaining); err != nil || remaining != 0 {
+        t.Errorf("review_replies holds %d rows (%v) after purging, want 0", remaining, err)
+    }
+}
+
+func TestCORSPreflight(t *testing.T) {
+    srv := newTestServer(t)
+
+    tests := []struct {
+        path        string
+        origin      string
+        wantStatus  int
+        wantHeader  string
+        wantMethods string
+    }{
+        {"/reviews", "http://allowed.example", http.StatusOK, "http://allowed.example", "GET, POST, PUT, PATCH, OPTIONS"},
+        {"/reviews", "http://other.example", http.StatusForbidden, "", ""},
+        {"/delete-review", "http://allowed.example", http.StatusOK, "http://allowed.example", "DELETE, OPTIONS"},
+        {"/stats", "http://allowed.example", http.StatusOK, "http://allowed.example", "GET, OPTIONS"},
+    }
+    for _, tt := range tests {
+        req, err := http.NewRequest(http.MethodOptions, srv.URL+tt.path, nil)
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        req.Header.Set("Origin", tt.origin)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        resp.Body.Close()
+
+        if resp.StatusCode != tt.wantStatus {
+            t.Errorf("OPTIONS %s from %s returned %d, want %d", tt.path, tt.origin, resp.StatusCode, tt.wantStatus)
+        }
+        if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.wantHeader {
+            t.Errorf("OPTIONS %s from %s set Access-Control-Allow-Origin %q, want %q", tt.path, tt.origin, got, tt.wantHeader)
+        }
+        if got := resp.Header.Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+            t.Errorf("OPTIONS %s from %s set Access-Control-Allow-Methods %q, want %q", tt.path, tt.origin, got, tt.wantMethods)
+        }
+    }
+
+    // A plain OPTIONS request without an Origin still learns the route's methods
+    req, err := http.NewRequest(http.MethodOptions, srv.URL+"/delete-review", nil)
+    if err != nil {
+        t.Fatalf("Failed to build request: %v", err)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Request failed: %v", err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Errorf("OPTIONS without Origin returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if got := resp.Header.Get("Allow"); got != "DELETE, OPTIONS" {
+        t.Errorf("OPTIONS without Origin set Allow %q, want %q", got, "DELETE, OPTIONS")
+    }
+}
+
+func TestPrettyPrintedResponses(t *testing.T) {
+    srv := newTestServer(t)
+    createReview(t, srv, "alice", 4)
+
+    for _, path := range []string{"/stats?pretty=true", "/review?id=abc&pretty=1", "/reviews?status=all&pretty=true"} {
+        resp := doRequest(t, http.MethodGet, srv.URL+path, nil)
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if !json.Valid(body) || !bytes.HasPrefix(body, []byte("{\n  \"")) {
+            t.Errorf("GET %s returned %q, want indented JSON", path, body)
+        }
+    }
+
+    resp := doRequest(t, http.MethodGet, srv.URL+"/stats", nil)
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if bytes.ContainsRune(body, '\n') {
+        t.Errorf("GET /stats returned %q, want compact JSON", body)
+    }
+}
+
+func TestUnknownRouteReturnsJSON404WithCORS(t *testing.T) {
+    srv := newTestServer(t)
+
+    for _, path := range []string{"/no-such-endpoint", "/reviews/top/extra", "/admin/nothing"} {
+        req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        req.Header.Set("Origin", "http://allowed.example")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &body)
+
+        if resp.StatusCode != http.StatusNotFound || body.Error.Code != "not_found" || body.Error.Status != http.StatusNotFound {
+            t.Errorf("GET %s returned %d %+v, want a JSON not_found error", path, resp.StatusCode, body.Error)
+        }
+        if got := resp.Header.Get("Content-Type"); got != "application/json" {
+            t.Errorf("GET %s returned Content-Type %q, want application/json", path, got)
+        }
+        if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "http://allowed.example" {
+            t.Errorf("GET %s set Access-Control-Allow-Origin %q, want the allowed origin", path, got)
+        }
+    }
+}
+
+// slowStore delays Stats until the request is canceled and ForEach by a fixed delay
+type slowStore struct {
+    ReviewStore
+    delay time.Duration
+}
+
+func (s slowStore) Stats(ctx context.Context, productID string) (*ReviewStats, error) {
+    <-ctx.Done()
+    return nil, ctx.Err()
+}
+
+func (s slowStore) ForEach(ctx context.Context, filter reviewFilter, fn func(Review) error) error {
+    time.Sleep(s.delay)
+    return s.ReviewStore.ForEach(ctx, filter, fn)
+}
+
+func TestRequestTimeout(t *testing.T) {
+    conn, err := openDatabase("file:TestRequestTimeout?mode=memory&cache=shared")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := slowStore{ReviewStore: newSQLiteStore(conn, 0), delay: 100 * time.Millisecond}
+    srv := httptest.NewServer(NewServer(store, Config{RateLimit: rate.Inf, RateBurst: 1, RequestTimeout: 20 * time.Millisecond}))
+    defer srv.Close()
+
+    resp := doRequest(t, http.MethodGet, srv.URL+"/stats", nil)
+    var body struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &body)
+    if resp.StatusCode != http.StatusServiceUnavailable || body.Error.Code != "request_timeout" {
+        t.Errorf("GET /stats on a stalled store returned %d %+v, want a JSON 503", resp.StatusCode, body.Error)
+    }
+    if got := resp.Header.Get("Content-Type"); got != "application/json" {
+        t.Errorf("GET /stats timeout returned Content-Type %q, want application/json", got)
+    }
+
+    // Fast requests are unaffected and exports may stream past the timeout
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/healthz", nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /healthz returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews.csv", nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /reviews.csv returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    // Errors of requests handled in time still carry the request ID
+    identified := httptest.NewServer(withRequestID(NewServer(store, Config{RateLimit: rate.Inf, RateBurst: 1, RequestTimeout: time.Second})))
+    defer identified.Close()
+    resp = doRequest(t, http.MethodGet, identified.URL+"/review?id=abc", nil)
+    decodeBody(t, resp, &body)
+    if id := resp.Header.Get("X-Request-ID"); id == "" || body.Error.RequestID != id {
+        t.Errorf("GET /review?id=abc returned request_id %q with X-Request-ID %q, want them equal", body.Error.RequestID, id)
+    }
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, APIKey: "secret"})
+
+    body := map[string]interface{}{"product_id": "widget", "name": "alice", "review": "text", "rating": 4}
+    tests := []struct {
+        name   string
+        header string
+        value  string
+        want   int
+    }{
+        {"missing key", "", "", http.StatusUnauthorized},
+        {"wrong bearer token", "Authorization", "Bearer nope", http.StatusForbidden},
+        {"wrong header key", "X-API-Key", "nope", http.StatusForbidden},
+        {"bearer token", "Authorization", "Bearer secret", http.StatusCreated},
+    }
+    for _, tt := range tests {
+        var buf bytes.Buffer
+        json.NewEncoder(&buf).Encode(body)
+        req, err := http.NewRequest(http.MethodPost, srv.URL+"/reviews", &buf)
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        if tt.header != "" {
+            req.Header.Set(tt.header, tt.value)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        resp.Body.Close()
+
+        if resp.StatusCode != tt.want {
+            t.Errorf("%s: POST returned %d, want %d", tt.name, resp.StatusCode, tt.want)
+        }
+    }
+
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews", nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET without a key returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+}
+
+// signToken returns an HS256 user token for the given subject
+func signToken(t *testing.T, secret, subject string, admin bool) string {
+    t.Helper()
+
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims{
+        Admin:            admin,
+        RegisteredClaims: jwt.RegisteredClaims{Subject: subject},
+    }).SignedString([]byte(secret))
+    if err != nil {
+        t.Fatalf("Failed to sign token: %v", err)
+    }
+    return token
+}
+
+// doAuthRequest is doRequest with a bearer token
+func doAuthRequest(t *testing.T, method, url, token string, body interface{}) *http.Response {
+    t.Helper()
+
+    var buf bytes.Buffer
+    if err := json.NewEncoder(&buf).Encode(body); err != nil {
+        t.Fatalf("Failed to encode request body: %v", err)
+    }
+    req, err := http.NewRequest(method, url, &buf)
+    if err != nil {
+        t.Fatalf("Failed to build request: %v", err)
+    }
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("Request failed: %v", err)
+    }
+    t.Cleanup(func() { resp.Body.Close() })
+    return resp
+}
+
+func TestReviewOwnership(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    alice := signToken(t, secret, "alice", false)
+    bob := signToken(t, secret, "bob", false)
+    admin := signToken(t, secret, "root", true)
+
+    body := map[string]interface{}{"product_id": "widget", "name": "Alice", "review": "text", "rating": 4, "author_id": "bob"}
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", "", body); resp.StatusCode != http.StatusUnauthorized {
+        t.Errorf("POST without a token returned %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+    }
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", signToken(t, "other", "alice", false), body); resp.StatusCode != http.StatusUnauthorized {
+        t.Errorf("POST with a forged token returned %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+    }
+
+    resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", alice, body)
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST with a token returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var review Review
+    decodeBody(t, resp, &review)
+    if review.AuthorID != "alice" {
+        t.Errorf("POST stored author %q, want %q", review.AuthorID, "alice")
+    }
+
+    if resp := doAuthRequest(t, http.MethodDelete, srv.URL+"/delete-review", bob, map[string]int{"id": review.ID}); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("DELETE by another user returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+    }
+    if resp := doAuthRequest(t, http.MethodDelete, srv.URL+"/delete-review", alice, map[string]int{"id": review.ID}); resp.StatusCode != http.StatusOK {
+        t.Errorf("DELETE by the author returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/restore-review", alice, map[string]int{"id": review.ID}); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("POST /restore-review by a user returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+    }
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/restore-review", admin, map[string]int{"id": review.ID}); resp.StatusCode != http.StatusOK {
+        t.Errorf("POST /restore-review by an admin returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp := doAuthRequest(t, http.MethodDelete, srv.URL+"/delete-review", admin, map[string]int{"id": review.ID}); resp.StatusCode != http.StatusOK {
+        t.Errorf("DELETE by an admin returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+}
+
+func TestLoadTotalMatchesCount(t *testing.T) {
+    conn, err := openDatabase("file:TestLoadTotalMatchesCount?mode=memory&cache=shared&_foreign_keys=on")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := newSQLiteStore(conn, 0)
+    if !store.windowFunctions {
+        t.Fatalf("Linked SQLite lacks window functions")
+    }
+    ctx := context.Background()
+    for i := 1; i <= 7; i++ {
+        if _, err := store.Save(ctx, &Review{ProductID: "widget", Name: fmt.Sprintf("user%d", i), Review: "text", Rating: intPtr(i%5 + 1)}); err != nil {
+            t.Fatalf("Failed to save review: %v", err)
+        }
+    }
+
+    // The single-query total must agree with the fallback that counts separately
+    fallback := &sqliteStore{db: conn}
+    tests := []struct {
+        name          string
+        filter        reviewFilter
+        limit, offset int
+        wantRows      int
+        wantTotal     int
+    }{
+        {"first page", reviewFilter{Status: statusAll}, 3, 0, 3, 7},
+        {"last page", reviewFilter{Status: statusAll}, 3, 6, 1, 7},
+        {"past the end", reviewFilter{Status: statusAll}, 3, 10, 0, 7},
+        {"cursor", reviewFilter{Status: statusAll, AfterID: 5}, 3, 0, 2, 7},
+        {"filtered", reviewFilter{Status: statusAll, MinRating: 4}, 10, 0, 2, 2},
+        {"no matches", reviewFilter{Status: statusAll, ProductID: "gadget"}, 10, 0, 0, 0},
+    }
+    for _, tt := range tests {
+        for _, s := range []*sqliteStore{store, fallback} {
+            reviews, total, err := s.Load(ctx, tt.filter, "", tt.limit, tt.offset)
+            if err != nil {
+                t.Fatalf("%s: Load failed (window functions %t): %v", tt.name, s.windowFunctions, err)
+            }
+            if len(reviews) != tt.wantRows || total != tt.wantTotal {
+                t.Errorf("%s: Load returned %d reviews of %d (window functions %t), want %d of %d", tt.name, len(reviews), total, s.windowFunctions, tt.wantRows, tt.wantTotal)
+            }
+        }
+    }
+}
+
+func TestHoneypotField(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, HoneypotField: "website"})
+    body := func(website interface{}, text string) map[string]interface{} {
+        return map[string]interface{}{"product_id": "widget", "name": "Alice", "review": text, "rating": 4, "website": website}
+    }
+
+    var genuine []map[string]interface{}
+    for i, website := range []interface{}{"", nil} {
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body(website, fmt.Sprintf("Genuine %d", i)))
+        if resp.StatusCode != http.StatusCreated {
+            t.Fatalf("POST with the honeypot set to %v returned %d, want %d", website, resp.StatusCode, http.StatusCreated)
+        }
+        var review map[string]interface{}
+        decodeBody(t, resp, &review)
+        genuine = append(genuine, review)
+    }
+
+    // A caught bot gets the same status and fields as a genuine submission, with the next id
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body("http://spam.example", "Buy now"))
+    var decoy map[string]interface{}
+    decodeBody(t, resp, &decoy)
+    if resp.StatusCode != http.StatusCreated {
+        t.Errorf("POST with the honeypot filled in returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    if want := genuine[1]["id"].(float64) + 1; decoy["id"] != want {
+        t.Errorf("POST with the honeypot filled in returned id %v, want %v", decoy["id"], want)
+    }
+    for key := range genuine[1] {
+        if _, ok := decoy[key]; !ok {
+            t.Errorf("POST with the honeypot filled in returned no %q field, unlike a genuine submission", key)
+        }
+    }
+    if len(decoy) != len(genuine[1]) {
+        t.Errorf("POST with the honeypot filled in returned %v, want the fields of %v", decoy, genuine[1])
+    }
+    extra := body("", "Extra")
+    extra["homepage"] = "x"
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", extra); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST with an unknown field returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+
+    var page struct {
+        Total int `json:"total"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all", nil), &page)
+    if page.Total != 2 {
+        t.Errorf("GET /reviews reports %d reviews, want only the 2 genuine ones", page.Total)
+    }
+
+    if !isReviewField("Rating") || isReviewField("website") {
+        t.Errorf("isReviewField does not tell review fields from the honeypot")
+    }
+}
+
+func TestReviewImages(t *testing.T) {
+    srv := newTestServer(t)
+    body := map[string]interface{}{"product_id": "widget", "name": "Alice", "review": "Looks great", "rating": 5, "images": []string{" https://img.example/1.jpg ", "http://img.example/2.png"}}
+
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body)
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST with images returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var review Review
+    decodeBody(t, resp, &review)
+    want := []string{"https://img.example/1.jpg", "http://img.example/2.png"}
+    if fmt.Sprint(review.Images) != fmt.Sprint(want) {
+        t.Errorf("POST returned images %v, want %v", review.Images, want)
+    }
+
+    var fetched Review
+    decodeBody(t, doRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, review.ID), nil), &fetched)
+    if fmt.Sprint(fetched.Images) != fmt.Sprint(want) {
+        t.Errorf("GET /review returned images %v, want %v", fetched.Images, want)
+    }
+
+    // An update replaces the images
+    update := map[string]interface{}{"id": review.ID, "product_id": "widget", "name": "Alice", "review": "Looks great", "rating": 5, "images": []string{"https://img.example/3.jpg"}}
+    if resp := doRequest(t, http.MethodPut, srv.URL+"/reviews", update); resp.StatusCode != http.StatusOK {
+        t.Fatalf("PUT with images returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all", nil), &page)
+    if len(page.Reviews) != 1 || fmt.Sprint(page.Reviews[0].Images) != "[https://img.example/3.jpg]" {
+        t.Errorf("GET /reviews returned %+v after the update, want the replaced image", page.Reviews)
+    }
+
+    tooMany := make([]string, maxImages+1)
+    for i := range tooMany {
+        tooMany[i] = fmt.Sprintf("https://img.example/%d.jpg", i)
+    }
+    for _, images := range [][]string{tooMany, {"ftp://img.example/1.jpg"}, {"img.example/1.jpg"}, {""}} {
+        body := map[string]interface{}{"product_id": "widget", "name": "Bob", "review": "text", "rating": 3, "images": images}
+        resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", body)
+        var envelope struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &envelope)
+        if resp.StatusCode != http.StatusBadRequest || envelope.Error.Code != "invalid_images" {
+            t.Errorf("POST with images %q returned %d %q, want %d %q", images, resp.StatusCode, envelope.Error.Code, http.StatusBadRequest, "invalid_images")
+        }
+    }
+
+    // Purging the review removes its images along with it
+    conn, err := openDatabase("file:TestReviewImagesPurge?mode=memory&cache=shared&_foreign_keys=on")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := newSQLiteStore(conn, 0)
+    ctx := context.Background()
+    id, err := store.Save(ctx, &Review{ProductID: "widget", Name: "bob", Review: "Fine", Rating: intPtr(3), Images: []string{"https://img.example/1.jpg"}})
+    if err != nil {
+        t.Fatalf("Failed to save review: %v", err)
+    }
+    if err := store.Purge(ctx, id); err != nil {
+        t.Fatalf("Failed to purge review: %v", err)
+    }
+    var remaining int
+    if err := conn.QueryRow("SELECT COUNT(*) FROM review_images").Scan(&remaining); err != nil || remaining != 0 {
+        t.Errorf("review_images holds %d rows (%v) after purging, want 0", remaining, err)
+    }
+}
+
+func TestConfigurableListDefaults(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, DefaultLimit: 2, DefaultSort: "rating_desc"})
+    for _, rating := range []int{1, 5, 3} {
+        createReview(t, srv, fmt.Sprintf("user%d", rating), rating)
+    }
+
+    var page struct {
+        Reviews    []Review `json:"reviews"`
+        Limit      int      `json:"limit"`
+        NextCursor *int     `json:"next_cursor"`
+    }
+    ratings := func() []int {
+        var got []int
+        for _, review := range page.Reviews {
+            got = append(got, *review.Rating)
+        }
+        return got
+    }
+
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all", nil), &page)
+    if page.Limit != 2 || fmt.Sprint(ratings()) != "[5 3]" || page.NextCursor != nil {
+        t.Errorf("GET /reviews returned limit %d and ratings %v, want the configured limit 2 and ratings [5 3] without a cursor", page.Limit, ratings())
+    }
+
+    // Parameters given by the client still win
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all&limit=3&sort=rating_asc", nil), &page)
+    if page.Limit != 3 || fmt.Sprint(ratings()) != "[1 3 5]" {
+        t.Errorf("GET /reviews with limit and sort returned limit %d and ratings %v, want 3 and [1 3 5]", page.Limit, ratings())
+    }
+
+    // The cursor pages by id whatever the default sort
+    page.NextCursor = nil
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?status=all&after=0", nil), &page)
+    if fmt.Sprint(ratings()) != "[1 5]" || page.NextCursor == nil {
+        t.Errorf("GET /reviews with a cursor returned ratings %v and cursor %v, want [1 5] and a cursor", ratings(), page.NextCursor)
+    }
+}
+
+func TestDatabaseBackups(t *testing.T) {
+    conn, err := openDatabase("file:TestDatabaseBackups?mode=memory&cache=shared&_foreign_keys=on")
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+    store := newSQLiteStore(conn, 0)
+    ctx := context.Background()
+    if _, err := store.Save(ctx, &Review{ProductID: "widget", Name: "bob", Review: "Fine", Rating: intPtr(3)}); err != nil {
+        t.Fatalf("Failed to save review: %v", err)
+    }
+
+    dir := filepath.Join(t.TempDir(), "backups")
+    start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    var paths []string
+    for i := 0; i < 4; i++ {
+        path, err := backupDatabase(ctx, store, dir, start.Add(time.Duration(i)*time.Hour))
+        if err != nil {
+            t.Fatalf("Backup %d failed: %v", i, err)
+        }
+        paths = append(paths, path)
+    }
+    unrelated := filepath.Join(dir, "notes.txt")
+    if err := os.WriteFile(unrelated, []byte("keep me"), 0o644); err != nil {
+        t.Fatalf("Failed to write file: %v", err)
+    }
+
+    // Only the oldest backups are pruned
+    removed, err := pruneBackups(dir, 2)
+    if err != nil {
+        t.Fatalf("Pruning failed: %v", err)
+    }
+    if fmt.Sprint(removed) != fmt.Sprint(paths[:2]) {
+        t.Errorf("Pruning removed %v, want %v", removed, paths[:2])
+    }
+    for _, path := range append(paths[2:], unrelated) {
+        if _, err := os.Stat(path); err != nil {
+            t.Errorf("%s is gone after pruning: %v", path, err)
+        }
+    }
+
+    // The newest backup is a usable copy of the database
+    backup, err := sql.Open("sqlite3", paths[3])
+    if err != nil {
+        t.Fatalf("Failed to open backup: %v", err)
+    }
+    defer backup.Close()
+    var count int
+    if err := backup.QueryRow("SELECT COUNT(*) FROM reviews").Scan(&count); err != nil || count != 1 {
+        t.Errorf("Backup holds %d reviews (%v), want 1", count, err)
+    }
+}
+
+func TestAdminSummary(t *testing.T) {
+    srv := newTestServer(t)
+    var ids []int
+    for i, rating := range []int{4, 2, 5, 1} {
+        ids = append(ids, createReview(t, srv, fmt.Sprintf("user%d", i), rating).ID)
+    }
+    for _, id := range ids[:2] {
+        if resp := doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": id}); resp.StatusCode != http.StatusOK {
+            t.Fatalf("POST /approve-review returned %d, want %d", resp.StatusCode, http.StatusOK)
+        }
+    }
+    if resp := doRequest(t, http.MethodDelete, srv.URL+"/delete-review", map[string]int{"id": ids[3]}); resp.StatusCode != http.StatusOK {
+        t.Fatalf("DELETE returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    resp := doRequest(t, http.MethodGet, srv.URL+"/admin/summary", nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET /admin/summary returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var summary ReviewSummary
+    decodeBody(t, resp, &summary)
+    want := ReviewSummary{Total: 4, Approved: 2, Pending: 1, Deleted: 1, Average: 3}
+    if summary != want {
+        t.Errorf("GET /admin/summary returned %+v, want %+v", summary, want)
+    }
+
+    // Unlike other reads, the summary requires the API key and an admin token
+    const secret = "jwt-secret"
+    guarded := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, APIKey: "secret-key", JWTSecret: secret})
+    tests := []struct {
+        apiKey, token string
+        wantStatus    int
+    }{
+        {"", signToken(t, secret, "root", true), http.StatusUnauthorized},
+        {"secret-key", "", http.StatusUnauthorized},
+        {"secret-key", signToken(t, secret, "alice", false), http.StatusForbidden},
+        {"secret-key", signToken(t, secret, "root", true), http.StatusOK},
+    }
+    for _, tt := range tests {
+        req, err := http.NewRequest(http.MethodGet, guarded.URL+"/admin/summary", nil)
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        if tt.apiKey != "" {
+            req.Header.Set("X-API-Key", tt.apiKey)
+        }
+        if tt.token != "" {
+            req.Header.Set("Authorization", "Bearer "+tt.token)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != tt.wantStatus {
+            t.Errorf("GET /admin/summary with key %q and token %t returned %d, want %d", tt.apiKey, tt.token != "", resp.StatusCode, tt.wantStatus)
+        }
+    }
+}
+
+func TestEmptyListsEncodeAsArrays(t *testing.T) {
+    srv := newTestServer(t)
+
+    for _, path := range []string{"/reviews", "/reviews?productId=none", "/reviews?after=100", "/reviews?offset=20"} {
+        resp := doRequest(t, http.MethodGet, srv.URL+path, nil)
+        body, err := io.ReadAll(resp.Body)
+        if err != nil {
+            t.Fatalf("Failed to read response: %v", err)
+        }
+        if !bytes.Contains(body, []byte(`"reviews":[]`)) {
+            t.Errorf("GET %s returned %s, want an empty reviews array", path, body)
+        }
+    }
+}
+
+func TestGetReviewsFieldSelection(t *testing.T) {
+    srv := newTestServer(t)
+    review := createReview(t, srv, "Alice", 4)
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": review.ID})
+
+    var page struct {
+        Reviews []map[string]interface{} `json:"reviews"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/reviews?fields=id,%20rating,id", nil), &page)
+    if len(page.Reviews) != 1 {
+        t.Fatalf("Expected 1 review, got %d", len(page.Reviews))
+    }
+    if got := page.Reviews[0]; len(got) != 2 || got["id"] != float64(review.ID) || got["rating"] != float64(4) {
+        t.Errorf("Expected only id and rating, got %v", got)
+    }
+
+    for _, fields := range []string{"id,bogus", "email", ","} {
+        resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?fields="+fields, nil)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("fields=%s: expected status 400, got %d", fields, resp.StatusCode)
+        }
+    }
+}
+
+func TestBlockedNames(t *testing.T) {
+    srv := newTestServer(t)
+    alice := createReview(t, srv, "Alice", 4)
+    bob := createReview(t, srv, "Bob", 3)
+    for _, id := range []int{alice.ID, bob.ID} {
+        doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": id})
+    }
+
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    names := func(path string) string {
+        decodeBody(t, doRequest(t, http.MethodGet, srv.URL+path, nil), &page)
+        var got []string
+        for _, review := range page.Reviews {
+            got = append(got, review.Name)
+        }
+        return fmt.Sprint(got)
+    }
+
+    // Warm the stats cache so a stale figure would still count Alice
+    var stats ReviewStats
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Count != 2 {
+        t.Fatalf("GET /stats before blocking counted %d reviews, want 2", stats.Count)
+    }
+
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/admin/block", map[string]string{"name": " ALICE "}); resp.StatusCode != http.StatusOK {
+        t.Fatalf("POST /admin/block returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/admin/block", map[string]string{"name": " "}); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("POST /admin/block without a name returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+    var blocked struct {
+        Names []string `json:"names"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/admin/block", nil), &blocked)
+    if fmt.Sprint(blocked.Names) != "[ALICE]" {
+        t.Errorf("GET /admin/block returned %v, want [ALICE]", blocked.Names)
+    }
+
+    // Blocked reviews are hidden from every listing without an admin token, but kept in the database
+    if got := names("/reviews"); got != "[Bob]" {
+        t.Errorf("GET /reviews returned %s, want [Bob]", got)
+    }
+    if got := names("/reviews?status=all"); got != "[Bob]" {
+        t.Errorf("GET /reviews?status=all returned %s, want [Bob]", got)
+    }
+    if resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, alice.ID), nil); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET /review of a blocked reviewer returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats", nil), &stats)
+    if stats.Count != 1 || stats.Average != 3 || stats.Breakdown[3] != 1 || stats.Breakdown[4] != 0 {
+        t.Errorf("GET /stats after blocking returned %+v, want only Bob's 3-star review", stats)
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/stats?weighted=true", nil), &stats)
+    if stats.WeightedAverage == nil || *stats.WeightedAverage != 3 {
+        t.Errorf("GET /stats?weighted=true after blocking returned a weighted average of %v, want 3", stats.WeightedAverage)
+    }
+
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/admin/unblock", map[string]string{"name": "alice"}); resp.StatusCode != http.StatusOK {
+        t.Errorf("POST /admin/unblock returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/admin/unblock", map[string]string{"name": "alice"}); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("POST /admin/unblock of a name that is not blocked returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    if got := names("/reviews"); got != "[Alice Bob]" {
+        t.Errorf("GET /reviews after unblocking returned %s, want [Alice Bob]", got)
+    }
+}
+
+func TestBlockedNamesVisibleToAdmins(t *testing.T) {
+    const secret = "jwt-secret"
+    authSrv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    admin := signToken(t, secret, "root", true)
+    resp := doAuthRequest(t, http.MethodPost, authSrv.URL+"/reviews", signToken(t, secret, "mallory", false), map[string]interface{}{"product_id": "widget", "name": "Mallory", "review": "text", "rating": 1})
+    var review Review
+    decodeBody(t, resp, &review)
+    doAuthRequest(t, http.MethodPost, authSrv.URL+"/approve-review", admin, map[string]int{"id": review.ID})
+    if resp := doAuthRequest(t, http.MethodPost, authSrv.URL+"/admin/block", signToken(t, secret, "alice", false), map[string]string{"name": "Mallory"}); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("POST /admin/block by a user returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+    }
+    doAuthRequest(t, http.MethodPost, authSrv.URL+"/admin/block", admin, map[string]string{"name": "Mallory"})
+    for _, tt := range []struct {
+        token string
+        want  int
+    }{{"", 0}, {admin, 1}} {
+        req, err := http.NewRequest(http.MethodGet, authSrv.URL+"/reviews", nil)
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        if tt.token != "" {
+            req.Header.Set("Authorization", "Bearer "+tt.token)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("Request failed: %v", err)
+        }
+        var page struct {
+            Reviews []Review `json:"reviews"`
+        }
+        decodeBody(t, resp, &page)
+        if len(page.Reviews) != tt.want {
+            t.Errorf("GET /reviews as admin %t returned %d reviews, want %d", tt.token != "", len(page.Reviews), tt.want)
+        }
+    }
+
+    // Moderation listings and exports only show blocked reviewers to admins too
+    var page struct {
+        Reviews []Review `json:"reviews"`
+    }
+    decodeBody(t, doAuthRequest(t, http.MethodGet, authSrv.URL+"/reviews?status=all", admin, nil), &page)
+    if len(page.Reviews) != 1 {
+        t.Errorf("GET /reviews?status=all as admin returned %d reviews, want 1", len(page.Reviews))
+    }
+    if resp := doAuthRequest(t, http.MethodGet, authSrv.URL+"/reviews?status=all", signToken(t, secret, "alice", false), nil); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("GET /reviews?status=all as a user returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+    }
+    for _, path := range []string{"/reviews.csv", "/reviews.jsonl"} {
+        for _, tt := range []struct {
+            token string
+            want  string
+        }{{"", ""}, {signToken(t, secret, "alice", false), ""}, {admin, "Mallory"}} {
+            if got := exportedNames(t, authSrv.URL+path, tt.token); got != tt.want {
+                t.Errorf("GET %s as admin %t exported %q, want %q", path, tt.token == admin, got, tt.want)
+            }
+        }
+    }
+
+    // Without user tokens nobody holds an admin token, so blocked reviewers are never listed or exported
+    srv := newTestServer(t)
+    createReview(t, srv, "Mallory", 1)
+    doRequest(t, http.MethodPost, srv.URL+"/admin/block", map[string]string{"name": "Mallory"})
+    for _, path := range []string{"/reviews.csv", "/reviews.jsonl"} {
+        if got := exportedNames(t, srv.URL+path, ""); got != "" {
+            t.Errorf("GET %s exported %q, want the blocked reviewer left out", path, got)
+        }
+    }
+}
+
+func TestDraftReviews(t *testing.T) {
+    srv := newTestServer(t)
+
+    // A draft may leave out the text and rating until it is published
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", map[string]interface{}{"product_id": "widget", "name": "alice", "status": "draft"})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews with a draft returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var draft Review
+    decodeBody(t, resp, &draft)
+    if draft.Status != reviewDraft {
+        t.Errorf("POST /reviews with a draft stored status %q, want %q", draft.Status, reviewDraft)
+    }
+    doRequest(t, http.MethodPost, srv.URL+"/approve-review", map[string]int{"id": draft.ID})
+
+    total := func(path string) int {
+        var page struct {
+            Total int `json:"total"`
+        }
+        decodeBody(t, doRequest(t, http.MethodGet, srv.URL+path, nil), &page)
+        return page.Total
+    }
+    if got := total("/reviews"); got != 0 {
+        t.Errorf("GET /reviews listed %d reviews, want drafts left out", got)
+    }
+    if got := total("/reviews?status=draft"); got != 1 {
+        t.Errorf("GET /reviews?status=draft listed %d reviews, want 1", got)
+    }
+
+    // Publishing runs the full validation
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/publish", map[string]int{"id": draft.ID})
+    var envelope struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &envelope)
+    if resp.StatusCode != http.StatusBadRequest || envelope.Error.Code != "invalid_review" {
+        t.Errorf("POST /reviews/publish of an incomplete draft returned %d %q, want 400 invalid_review", resp.StatusCode, envelope.Error.Code)
+    }
+
+    resp = doRequest(t, http.MethodPut, srv.URL+"/reviews", map[string]interface{}{"id": draft.ID, "product_id": "widget", "name": "alice", "review": "Finished at last", "rating": 4})
+    decodeBody(t, resp, &draft)
+    if resp.StatusCode != http.StatusOK || draft.Status != reviewDraft {
+        t.Errorf("PUT /reviews of a draft returned %d with status %q, want 200 and still a draft", resp.StatusCode, draft.Status)
+    }
+
+    resp = doRequest(t, http.MethodPost, srv.URL+"/reviews/publish", map[string]int{"id": draft.ID})
+    var published Review
+    decodeBody(t, resp, &published)
+    if resp.StatusCode != http.StatusOK || published.Status != reviewPublished || published.Review != "Finished at last" {
+        t.Errorf("POST /reviews/publish returned %d %+v, want the published review", resp.StatusCode, published)
+    }
+    if got := total("/reviews"); got != 1 {
+        t.Errorf("GET /reviews listed %d reviews after publishing, want 1", got)
+    }
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews/publish", map[string]int{"id": draft.ID}); resp.StatusCode != http.StatusConflict {
+        t.Errorf("POST /reviews/publish of a published review returned %d, want %d", resp.StatusCode, http.StatusConflict)
+    }
+}
+
+func TestDraftsArePrivate(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    alice := signToken(t, secret, "alice", false)
+    bob := signToken(t, secret, "bob", false)
+
+    var draft Review
+    decodeBody(t, doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", alice, map[string]interface{}{"product_id": "widget", "name": "alice", "review": "Not done", "status": "draft"}), &draft)
+
+    if resp := doAuthRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, draft.ID), bob, nil); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET /review of another user's draft returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    if resp := doAuthRequest(t, http.MethodGet, fmt.Sprintf("%s/review?id=%d", srv.URL, draft.ID), alice, nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /review of one's own draft returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    for token, want := range map[string]int{alice: 1, bob: 0} {
+        var page struct {
+            Total int `json:"total"`
+        }
+        decodeBody(t, doAuthRequest(t, http.MethodGet, srv.URL+"/reviews?status=draft", token, nil), &page)
+        if page.Total != want {
+            t.Errorf("GET /reviews?status=draft listed %d drafts, want %d", page.Total, want)
+        }
+    }
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews?status=draft", nil); resp.StatusCode != http.StatusUnauthorized {
+        t.Errorf("GET /reviews?status=draft without a token returned %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+    }
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews/publish", bob, map[string]int{"id": draft.ID}); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("POST /reviews/publish of another user's draft returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+    }
+}
+
+func TestReviewHistory(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret})
+    alice := signToken(t, secret, "alice", false)
+    admin := signToken(t, secret, "root", true)
+
+    resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", alice, map[string]interface{}{"product_id": "widget", "name": "Alice", "review": "text", "rating": 4})
+    if resp.StatusCode != http.StatusCreated {
+        t.Fatalf("POST /reviews returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    var review Review
+    decodeBody(t, resp, &review)
+
+    // The history of a review awaiting moderation is as private as the review itself
+    path := fmt.Sprintf("%s/reviews/%d/history", srv.URL, review.ID)
+    for _, tt := range []struct {
+        name  string
+        token string
+        want  int
+    }{{"anonymous", "", http.StatusNotFound}, {"another user", signToken(t, secret, "bob", false), http.StatusNotFound}, {"the author", alice, http.StatusOK}, {"an admin", admin, http.StatusOK}} {
+        if resp := doAuthRequest(t, http.MethodGet, path, tt.token, nil); resp.StatusCode != tt.want {
+            t.Errorf("GET history of a pending review by %s returned %d, want %d", tt.name, resp.StatusCode, tt.want)
+        }
+    }
+
+    steps := []struct {
+        method, path, token string
+        body                interface{}
+    }{
+        {http.MethodPatch, "/reviews", alice, map[string]int{"id": review.ID, "rating": 5}},
+        {http.MethodPost, "/approve-review", admin, map[string]int{"id": review.ID}},
+        {http.MethodDelete, "/delete-review", alice, map[string]int{"id": review.ID}},
+        {http.MethodDelete, "/purge-review", admin, map[string]int{"id": review.ID}},
+    }
+    for _, step := range steps {
+        if resp := doAuthRequest(t, step.method, srv.URL+step.path, step.token, step.body); resp.StatusCode != http.StatusOK {
+            t.Fatalf("%s %s returned %d, want %d", step.method, step.path, resp.StatusCode, http.StatusOK)
+        }
+    }
+
+    // The history outlives the purged review, for admins only
+    if resp := doAuthRequest(t, http.MethodGet, path, alice, nil); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET history of a purged review by its author returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    resp = doAuthRequest(t, http.MethodGet, path, admin, nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET history returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var entries []AuditEntry
+    decodeBody(t, resp, &entries)
+    want := []struct{ action, actor string }{
+        {auditCreate, "alice"},
+        {auditUpdate, "alice"},
+        {auditApprove, "root"},
+        {auditDelete, "alice"},
+        {auditPurge, "root"},
+    }
+    if len(entries) != len(want) {
+        t.Fatalf("GET history returned %d entries, want %d: %+v", len(entries), len(want), entries)
+    }
+    for i, entry := range entries {
+        if entry.ReviewID != review.ID || entry.Action != want[i].action || entry.Actor != want[i].actor || entry.CreatedAt.IsZero() {
+            t.Errorf("History entry %d is %+v, want %s by %s", i, entry, want[i].action, want[i].actor)
+        }
+    }
+
+    if resp := doAuthRequest(t, http.MethodGet, srv.URL+"/reviews/999/history", admin, nil); resp.StatusCode != http.StatusNotFound {
+        t.Errorf("GET history of a missing review returned %d, want %d", resp.StatusCode, http.StatusNotFound)
+    }
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews/abc/history", nil); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("GET history with an invalid id returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+}
+
+func TestReadOnlyMode(t *testing.T) {
+    const secret = "jwt-secret"
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Inf, RateBurst: 1, JWTSecret: secret, ReadOnly: true})
+    alice := signToken(t, secret, "alice", false)
+    admin := signToken(t, secret, "root", true)
+    body := map[string]interface{}{"product_id": "widget", "name": "Alice", "review": "text", "rating": 4}
+
+    resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", alice, body)
+    if resp.StatusCode != http.StatusServiceUnavailable {
+        t.Fatalf("POST in read-only mode returned %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+    }
+    var envelope struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &envelope)
+    if envelope.Error.Code != "read_only" {
+        t.Errorf("POST in read-only mode returned code %q, want %q", envelope.Error.Code, "read_only")
+    }
+    if resp := doAuthRequest(t, http.MethodDelete, srv.URL+"/delete-review", admin, map[string]int{"id": 1}); resp.StatusCode != http.StatusServiceUnavailable {
+        t.Errorf("DELETE in read-only mode returned %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+    }
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews", nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET in read-only mode returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews/validate", alice, body); resp.StatusCode != http.StatusOK {
+        t.Errorf("POST /reviews/validate in read-only mode returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+
+    // Only admins may switch the mode off
+    if resp := doAuthRequest(t, http.MethodPut, srv.URL+"/admin/read-only", alice, map[string]bool{"readOnly": false}); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("PUT /admin/read-only by a user returned %d, want %d", resp.StatusCode, http.StatusForbidden)
+    }
+    if resp := doAuthRequest(t, http.MethodPut, srv.URL+"/admin/read-only", admin, map[string]string{}); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("PUT /admin/read-only without readOnly returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+    }
+    resp = doAuthRequest(t, http.MethodPut, srv.URL+"/admin/read-only", admin, map[string]bool{"readOnly": false})
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("PUT /admin/read-only by an admin returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var state struct {
+        ReadOnly bool `json:"readOnly"`
+    }
+    decodeBody(t, doRequest(t, http.MethodGet, srv.URL+"/admin/read-only", nil), &state)
+    if state.ReadOnly {
+        t.Errorf("GET /admin/read-only reports read-only mode after turning it off")
+    }
+
+    if resp := doAuthRequest(t, http.MethodPost, srv.URL+"/reviews", alice, body); resp.StatusCode != http.StatusCreated {
+        t.Errorf("POST after leaving read-only mode returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+}
+
+func TestOpenAPISpecDescribesRoutes(t *testing.T) {
+    srv := newTestServer(t)
+
+    resp := doRequest(t, http.MethodGet, srv.URL+"/openapi.json", nil)
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET /openapi.json returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+    var spec struct {
+        Paths map[string]json.RawMessage `json:"paths"`
+    }
+    decodeBody(t, resp, &spec)
+
+    for _, path := range []string{"/reviews", "/reviews/bulk", "/reviews/helpful", "/reviews/flag", "/reviews/validate", "/reviews/reply", "/reviews/publish", "/reviews/count", "/reviews/top", "/reviews/{id}", "/reviews/{id}/history", "/reviews.csv", "/reviews.jsonl", "/reviews.rss", "/review", "/delete-review", "/delete-reviews", "/restore-review", "/purge-review", "/approve-review", "/admin/read-only", "/admin/summary", "/admin/flagged", "/admin/recalculate", "/admin/block", "/admin/unblock", "/stats", "/stats/distribution", "/config", "/metrics", "/healthz", "/readyz"} {
+        if _, ok := spec.Paths[path]; !ok {
+            t.Errorf("OpenAPI spec does not describe %s", path)
+        }
+    }
+}
+
+func TestProfanityFilter(t *testing.T) {
+    words := []string{"darn", "heck"}
+
+    tests := []struct {
+        mode    string
+        text    string
+        want    string
+        wantErr bool
+    }{
+        {profanityReject, "Works fine", "Works fine", false},
+        {profanityReject, "DARN thing broke", "", true},
+        {profanityReject, "Darnell liked it", "Darnell liked it", false},
+        {profanityMask, "What the Heck, darn it", "What the ****, **** it", false},
+        {profanityMask, "Checked twice", "Checked twice", false},
+    }
+    for _, tt := range tests {
+        filter := newProfanityFilter(words, tt.mode)
+        name, text := "alice", tt.text
+        err := filter.applyText(&name, &text)
+        if tt.wantErr {
+            if !errors.Is(err, errProfanity) {
+                t.Errorf("%s %q: applyText returned %v, want errProfanity", tt.mode, tt.text, err)
+            }
+            continue
+        }
+        if err != nil || text != tt.want || name != "alice" {
+            t.Errorf("%s %q: applyText returned %q, %v, want %q", tt.mode, tt.text, text, err, tt.want)
+        }
+    }
+
+    // Every field passed is checked, not only the first
+    name, text := "darn", "Works fine"
+    if err := newProfanityFilter(words, profanityReject).applyText(&text, &name); !errors.Is(err, errProfanity) {
+        t.Errorf("applyText with a blocked word in the second field returned %v, want errProfanity", err)
+    }
+    var nilFilter *profanityFilter
+    if err := nilFilter.applyText(&name); err != nil {
+        t.Errorf("applyText on a nil filter returned %v, want nil", err)
+    }
+
+    if filter := newProfanityFilter(nil, profanityReject); filter != nil {
+        t.Errorf("newProfanityFilter with no words returned %v, want nil", filter)
+    }
+}
+
+func TestMigrationsUpgradeLegacyTable(t *testing.T) {
+    conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "legacy.db"))
+    if err != nil {
+        t.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+
+    // The original schema, before any column was added
+    if _, err := conn.Exec("CREATE TABLE reviews (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, review TEXT, rating INTEGER)"); err != nil {
+        t.Fatalf("Failed to create legacy table: %v", err)
+    }
+    if _, err := conn.Exec("INSERT INTO reviews (name, review, rating) VALUES ('alice', 'old review', 4)"); err != nil {
+        t.Fatalf("Failed to insert legacy review: %v", err)
+    }
+
+    // Running the migrations twice must be a no-op the second time
+    for i := 0; i < 2; i++ {
+        if err := initializeDatabase(conn); err != nil {
+            t.Fatalf("initializeDatabase run %d failed: %v", i+1, err)
+        }
+    }
+
+    var applied int
+    if err := conn.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil || applied != len(migrations) {
+        t.Errorf("schema_migrations records %d versions (%v), want %d", applied, err, len(migrations))
+    }
+
+    review, err := newSQLiteStore(conn, 0).GetByID(context.Background(), 1)
+    if err != nil {
+        t.Fatalf("Failed to load migrated review: %v", err)
+    }
+    if !review.Approved || review.CreatedAt.IsZero() {
+        t.Errorf("Migrated review %+v should be approved with a creation time", review)
+    }
+}
+
+func TestRetryOnBusy(t *testing.T) {
+    busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+
+    calls := 0
+    err := retryOnBusy(context.Background(), "test", func() error {
+        calls++
+        if calls < 3 {
+            return busy
+        }
+        return nil
+    })
+    if err != nil || calls != 3 {
+        t.Errorf("retryOnBusy returned %v after %d calls, want success after 3 calls", err, calls)
+    }
+
+    calls = 0
+    err = retryOnBusy(context.Background(), "test", func() error {
+        calls++
+        return busy
+    })
+    if !isBusyError(err) || calls != maxWriteRetries+1 {
+        t.Errorf("retryOnBusy returned %v after %d calls, want a busy error after %d calls", err, calls, maxWriteRetries+1)
+    }
+
+    calls = 0
+    err = retryOnBusy(context.Background(), "test", func() error {
+        calls++
+        return errDuplicateReview
+    })
+    if !errors.Is(err, errDuplicateReview) || calls != 1 {
+        t.Errorf("retryOnBusy returned %v after %d calls, want errDuplicateReview after 1 call", err, calls)
+    }
+}
+func TestRateLimitRejectsBurst(t *testing.T) {
+    srv := newTestServerWithConfig(t, Config{RateLimit: rate.Every(time.Hour), RateBurst: 1})
+    review := map[string]interface{}{"product_id": "widget", "name": "alice", "review": "First of many", "rating": 5}
+
+    // Every request of the test server comes from the same RemoteAddr, so the second POST is over the burst
+    if resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", review); resp.StatusCode != http.StatusCreated {
+        t.Fatalf("First POST /reviews returned %d, want %d", resp.StatusCode, http.StatusCreated)
+    }
+    review["review"] = "Second of many"
+    resp := doRequest(t, http.MethodPost, srv.URL+"/reviews", review)
+    var body struct {
+        Error errorBody `json:"error"`
+    }
+    decodeBody(t, resp, &body)
+    if resp.StatusCode != http.StatusTooManyRequests || body.Error.Code != "rate_limited" {
+        t.Errorf("Second POST /reviews returned %d %+v, want %d rate_limited", resp.StatusCode, body.Error, http.StatusTooManyRequests)
+    }
+    if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry <= 0 {
+        t.Errorf("Second POST /reviews returned Retry-After %q, want a positive number of seconds", resp.Header.Get("Retry-After"))
+    }
+
+    // Reads are never limited
+    if resp := doRequest(t, http.MethodGet, srv.URL+"/reviews", nil); resp.StatusCode != http.StatusOK {
+        t.Errorf("GET /reviews after the burst returned %d, want %d", resp.StatusCode, http.StatusOK)
+    }
+}
+
+func TestGzipCompression(t *testing.T) {
+    large := strings.Repeat(`{"review":"Great product"}`, 100)
+    handler := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/large":
+            w.Header().Set("Content-Type", "application/json")
+            w.Write([]byte(large))
+        case "/small":
+            w.Header().Set("Content-Type", "application/json")
+            w.Write([]byte(`{}`))
+        case "/image":
+            w.Header().Set("Content-Type", "image/png")
+            w.Write([]byte(large))
+        }
+    }))
+
+    tests := []struct {
+        path           string
+        acceptEncoding string
+        compressed     bool
+    }{
+        {"/large", "gzip, deflate", true},
+        {"/large", "", false},
+        {"/large", "gzip;q=0", false},
+        {"/small", "gzip", false},
+        {"/image", "gzip", false},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+        req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, req)
+
+        if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.compressed {
+            t.Errorf("%s with Accept-Encoding %q compressed: %v, want %v", tt.path, tt.acceptEncoding, got, tt.compressed)
+            continue
+        }
+        body := rec.Body.Bytes()
+        if tt.compressed {
+            reader, err := gzip.NewReader(rec.Body)
+            if err != nil {
+                t.Fatalf("Failed to open gzip body: %v", err)
+            }
+            if body, err = io.ReadAll(reader); err != nil {
+                t.Fatalf("Failed to decompress body: %v", err)
+            }
+        }
+        if tt.path != "/small" && string(body) != large {
+            t.Errorf("%s with Accept-Encoding %q returned a body of %d bytes, want %d", tt.path, tt.acceptEncoding, len(body), len(large))
+        }
+    }
+}
+
+
+func TestGzipFlushStreams(t *testing.T) {
+    proceed := make(chan struct{})
+    srv := httptest.NewServer(withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        w.Write([]byte("{\"line\":1}\n"))
+        if err := http.NewResponseController(w).Flush(); err != nil {
+            t.Errorf("Flush returned %v", err)
+        }
+        <-proceed
+        w.Write([]byte("{\"line\":2}\n"))
+    })))
+    defer srv.Close()
+
+    // The transport would otherwise ask for gzip itself and hide the encoding
+    client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+    req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+    if err != nil {
+        t.Fatalf("Failed to build request: %v", err)
+    }
+    req.Header.Set("Accept-Encoding", "gzip")
+    resp, err := client.Do(req)
+    if err != nil {
+        close(proceed)
+        t.Fatalf("Request failed: %v", err)
+    }
+    defer resp.Body.Close()
+
+    // A flush before minGzipSize bytes still commits to gzip, so the headers match the body
+    if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+        close(proceed)
+        t.Fatalf("Flushed response has Content-Encoding %q, want gzip", got)
+    }
+    reader, err := gzip.NewReader(resp.Body)
+    if err != nil {
+        close(proceed)
+        t.Fatalf("Failed to open gzip body: %v", err)
+    }
+    lines := bufio.NewReader(reader)
+
+    // The first line arrives while the handler is still waiting to write the second
+    first, err := lines.ReadString('\n')
+    close(proceed)
+    if err != nil || first != "{\"line\":1}\n" {
+        t.Fatalf("First streamed line was %q, %v, want line 1", first, err)
+    }
+    rest, err := io.ReadAll(lines)
+    if err != nil || string(rest) != "{\"line\":2}\n" {
+        t.Errorf("Rest of the stream was %q, %v, want line 2", rest, err)
+    }
+}
+
+
+// BenchmarkGetReviewsParallel measures listing throughput under concurrent
+// readers against an on-disk database in WAL mode
+func BenchmarkGetReviewsParallel(b *testing.B) {
+    conn, err := openDatabase(sqliteDSN(filepath.Join(b.TempDir(), "bench.db")))
+    if err != nil {
+        b.Fatalf("Failed to open database: %v", err)
+    }
+    defer conn.Close()
+
+    server := NewServer(newSQLiteStore(conn, 0), Config{RateLimit: rate.Inf, RateBurst: 1})
+    reviews := make([]Review, 200)
+    for i := range reviews {
+        reviews[i] = Review{ProductID: "widget", Name: fmt.Sprintf("user%d", i), Review: "Benchmark review", Rating: intPtr(i%5 + 1)}
+    }
+    if _, err := server.store.SaveAll(context.Background(), reviews); err != nil {
+        b.Fatalf("Failed to seed reviews: %v", err)
+    }
+    if _, err := conn.Exec("UPDATE reviews SET approved = 1"); err != nil {
+        b.Fatalf("Failed to approve reviews: %v", err)
+    }
+
+    srv := httptest.NewServer(server)
+    defer srv.Close()
+    client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            resp, err := client.Get(srv.URL + "/reviews?limit=20")
+            if err != nil {
+                b.Errorf("Request failed: %v", err)
+                return
+            }
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }
+    })
+}
+
+// newWALTestServer starts the API with cfg against an on-disk database in WAL mode, configured as
+// in production; the in-memory databases of the other tests use table locks that fail concurrent
+// readers outright instead of letting them wait, so they cannot be hammered in parallel
+func newWALTestServer(tb testing.TB, cfg Config) *httptest.Server {
+    tb.Helper()
+
+    conn, err := openDatabase(sqliteDSN(filepath.Join(tb.TempDir(), "reviews.db")))
+    if err != nil {
+        tb.Fatalf("Failed to open database: %v", err)
+    }
+    srv := httptest.NewServer(NewServer(newSQLiteStore(conn, 0), cfg))
+    tb.Cleanup(func() {
+        srv.Close()
+        conn.Close()
+    })
+    return srv
+}
+
+// parallelClient reuses enough connections that parallel requests do not exhaust local ports
+var parallelClient = &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+
+// submitReview posts a valid review by name and returns the stored record; unlike createReview it
+// reports failures as errors, so it can be called from other goroutines than the test's
+func submitReview(baseURL, name string) (Review, error) {
+    body, err := json.Marshal(map[string]interface{}{"product_id": "widget", "name": name, "review": "Review by " + name, "rating": 4})
+    if err != nil {
+        return Review{}, err
+    }
+    resp, err := parallelClient.Post(baseURL+"/reviews", "application/json", bytes.NewReader(body))
+    if err != nil {
+        return Review{}, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusCreated {
+        message, _ := io.ReadAll(resp.Body)
+        return Review{}, fmt.Errorf("POST /reviews by %s returned %d: %s", name, resp.StatusCode, message)
+    }
+    var review Review
+    err = json.NewDecoder(resp.Body).Decode(&review)
+    return review, err
+}
+
+// fetchOK gets url and drains the body, returning an error unless the response is a 200
+func fetchOK(url string) error {
+    resp, err := parallelClient.Get(url)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+    }
+    return nil
+}
+func TestConcurrentSubmissionsLoseNoWrites(t *testing.T) {
+    srv := newWALTestServer(t, Config{RateLimit: rate.Inf, RateBurst: 1, StatsTTL: time.Minute, ListCache: true})
+    const workers, perWorker = 8, 25
+
+    // Every worker submits its own reviews while reading the listing and stats, which also
+    // exercises the caches being invalidated and reloaded concurrently
+    var mu sync.Mutex
+    ids := make(map[int]string)
+    var wg sync.WaitGroup
+    errs := make(chan error, workers*perWorker*3)
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < perWorker; i++ {
+                name := fmt.Sprintf("worker%d-%d", w, i)
+                review, err := submitReview(srv.URL, name)
+                if err != nil {
+                    errs <- err
+                    continue
+                }
+                mu.Lock()
+                if other, ok := ids[review.ID]; ok {
+                    errs <- fmt.Errorf("reviews by %s and %s were both given id %d", other, name, review.ID)
+                }
+                ids[review.ID] = name
+                mu.Unlock()
+
+                for _, path := range []string{"/reviews?status=all&limit=10", "/stats"} {
+                    if err := fetchOK(srv.URL + path); err != nil {
+                        errs <- err
+                    }
+                }
+            }
+        }(w)
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Error(err)
+    }
+
+    // Every submission is stored exactly once
+    resp := doRequest(t, http.MethodGet, srv.URL+"/reviews/count?status=all", nil)
+    var body map[string]int
+    decodeBody(t, resp, &body)
+    if want := workers * perWorker; len(ids) != want || body["count"] != want {
+        t.Errorf("%d submissions were given %d distinct ids and %d were stored, want %d of each", want, len(ids), body["count"], want)
+    }
+}
+
+// BenchmarkPostReviewsParallel measures submission throughput under concurrent writers, which
+// SQLite serializes
+func BenchmarkPostReviewsParallel(b *testing.B) {
+    srv := newWALTestServer(b, Config{RateLimit: rate.Inf, RateBurst: 1})
+    var n atomic.Int64
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            if _, err := submitReview(srv.URL, fmt.Sprintf("user%d", n.Add(1))); err != nil {
+                b.Error(err)
+            }
+        }
+    })
+}
+
+// BenchmarkMixedReadWriteParallel measures throughput when one request in four submits a review,
+// invalidating the stats cache that the others read from, while the rest list reviews
+func BenchmarkMixedReadWriteParallel(b *testing.B) {
+    srv := newWALTestServer(b, Config{RateLimit: rate.Inf, RateBurst: 1, StatsTTL: time.Minute})
+    var n atomic.Int64
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            i := n.Add(1)
+            var err error
+            switch i % 4 {
+            case 0:
+                _, err = submitReview(srv.URL, fmt.Sprintf("user%d", i))
+            case 1:
+                err = fetchOK(srv.URL + "/stats")
+            default:
+                err = fetchOK(srv.URL + "/reviews?status=all&limit=20")
+            }
+            if err != nil {
+                b.Error(err)
+            }
+        }
+    })
+}
+
+func TestTenantRouting(t *testing.T) {
+    // Every tenant is served by its own Server on its own database
+    servers := make(map[string]*Server)
+    for _, name := range []string{"default", "acme", "globex"} {
+        conn, err := openDatabase(fmt.Sprintf("file:%s_%s?mode=memory&cache=shared&_foreign_keys=on", t.Name(), name))
+        if err != nil {
+            t.Fatalf("Failed to open database: %v", err)
+        }
+        t.Cleanup(func() { conn.Close() })
+        servers[name] = NewServer(newSQLiteStore(conn, 0), Config{RateLimit: rate.Inf, RateBurst: 1, CORS: parseCORSOrigins("http://allowed.example")})
+    }
+    srv := httptest.NewServer(newTenantRouter(servers["default"], map[string]http.Handler{"acme": servers["acme"], "globex": servers["globex"]}))
+    defer srv.Close()
+
+    post := func(url, name string, header http.Header) {
+        t.Helper()
+        body, _ := json.Marshal(map[string]interface{}{"product_id": "widget", "name": name, "review": "Review by " + name, "rating": 4})
+        req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+        if err != nil {
+            t.Fatalf("Failed to build request: %v", err)
+        }
+        req.Header = header
+        req.Header.Set("Content-Type", "application/json")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("POST %s failed: %v", url, err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusCreated {
+            t.Fatalf("POST %s returned %d, want %d", url, resp.StatusCode, http.StatusCreated)
+        }
+    }
+    post(srv.URL+"/reviews", "dora", http.Header{})
+    post(srv.URL+"/t/acme/reviews", "alice", http.Header{})
+    post(srv.URL+"/reviews", "gus", http.Header{tenantHeader: {"globex"}})
+    post(srv.URL+"/t/globex/reviews", "gina", http.Header{tenantHeader: {"globex"}})
+
+    // Each tenant only sees its own reviews, however it was addressed
+    for _, tc := range []struct {
+        path   string
+        tenant string
+        want   []string
+    }{
+        {"/reviews?status=pending", "", []string{"dora"}},
+        {"/t/acme/reviews?status=pending", "", []string{"alice"}},
+        {"/reviews?status=pending", "acme", []string{"alice"}},
+        {"/t/globex/reviews?status=pending", "", []string{"gus", "gina"}},
+    } {
+        req, _ := http.NewRequest(http.MethodGet, srv.URL+tc.path, nil)
+        if tc.tenant != "" {
+            req.Header.Set(tenantHeader, tc.tenant)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("GET %s failed: %v", tc.path, err)
+        }
+        var page struct {
+            Reviews []Review `json:"reviews"`
+        }
+        decodeBody(t, resp, &page)
+        var names []string
+        for _, review := range page.Reviews {
+            names = append(names, review.Name)
+        }
+        if !reflect.DeepEqual(names, tc.want) {
+            t.Errorf("GET %s with tenant %q returned %v, want %v", tc.path, tc.tenant, names, tc.want)
+        }
+    }
+
+    // Errors about the tenant itself carry CORS headers so browsers on other origins can read them
+    for _, tc := range []struct {
+        path   string
+        tenant string
+        want   int
+        code   string
+    }{
+        {"/t/initech/reviews", "", http.StatusNotFound, "tenant_not_found"},
+        {"/reviews", "initech", http.StatusNotFound, "tenant_not_found"},
+        {"/t/acme/reviews", "globex", http.StatusBadRequest, "tenant_mismatch"},
+    } {
+        req, _ := http.NewRequest(http.MethodGet, srv.URL+tc.path, nil)
+        req.Header.Set("Origin", "http://allowed.example")
+        if tc.tenant != "" {
+            req.Header.Set(tenantHeader, tc.tenant)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("GET %s failed: %v", tc.path, err)
+        }
+        var body struct {
+            Error errorBody `json:"error"`
+        }
+        decodeBody(t, resp, &body)
+        if resp.StatusCode != tc.want || body.Error.Code != tc.code {
+            t.Errorf("GET %s with tenant %q returned %d %q, want %d %q", tc.path, tc.tenant, resp.StatusCode, body.Error.Code, tc.want, tc.code)
+        }
+        if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "http://allowed.example" {
+            t.Errorf("GET %s with tenant %q returned Access-Control-Allow-Origin %q, want the allowed origin", tc.path, tc.tenant, got)
+        }
+    }
+
+    // Browsers may send the tenant header cross-origin
+    req, _ := http.NewRequest(http.MethodOptions, srv.URL+"/reviews", nil)
+    req.Header.Set("Origin", "http://allowed.example")
+    req.Header.Set("Access-Control-Request-Headers", tenantHeader)
+    preflight, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatalf("OPTIONS /reviews failed: %v", err)
+    }
+    preflight.Body.Close()
+    if got := preflight.Header.Get("Access-Control-Allow-Headers"); !strings.Contains(got, tenantHeader) {
+        t.Errorf("OPTIONS /reviews returned Access-Control-Allow-Headers %q, want %s included", got, tenantHeader)
+    }
+
+    // Links in responses keep the tenant prefix the request came through
+    resp := doRequest(t, http.MethodGet, srv.URL+"/t/globex/reviews?status=pending&limit=1", nil)
+    resp.Body.Close()
+    if link := resp.Header.Get("Link"); !strings.Contains(link, `</t/globex/reviews?limit=1&offset=1&status=pending>; rel="next"`) {
+        t.Errorf("GET /t/globex/reviews?limit=1 returned Link %q, want a next link under /t/globex", link)
+    }
+    resp = doRequest(t, http.MethodGet, srv.URL+"/t/globex/reviews?status=pending&limit=1&after=0", nil)
+    resp.Body.Close()
+    if link := resp.Header.Get("Link"); !strings.HasPrefix(link, "</t/globex/reviews?after=") {
+        t.Errorf("GET /t/globex/reviews?after=0 returned Link %q, want a cursor link under /t/globex", link)
+    }
+    resp = doRequest(t, http.MethodGet, srv.URL+"/t/acme/reviews.rss?status=pending", nil)
+    defer resp.Body.Close()
+    feed, _ := io.ReadAll(resp.Body)
+    if !strings.Contains(string(feed), srv.URL+"/t/acme/reviews</link>") {
+        t.Errorf("GET /t/acme/reviews.rss returned %s, want channel link under /t/acme", feed)
+    }
+
+    if got := tenantDBPath("./reviews.db", "acme"); got != "./reviews.acme.db" {
+        t.Errorf("tenantDBPath returned %q, want ./reviews.acme.db", got)
+    }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus collectors exposed at /metrics
+var (
+    reviewsSubmitted = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "reviewx_reviews_submitted_total",
+        Help: "Number of reviews stored, including bulk imports.",
+    })
+    reviewsDeleted = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "reviewx_reviews_deleted_total",
+        Help: "Number of reviews deleted.",
+    })
+    honeypotSubmissions = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "reviewx_honeypot_submissions_total",
+        Help: "Number of review submissions discarded because the honeypot field was filled in.",
+    })
+    webhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "reviewx_webhook_failures_total",
+        Help: "Number of webhook notifications given up on after every retry failed.",
+    })
+    httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "reviewx_http_requests_total",
+        Help: "Number of HTTP requests by handler, method and status code.",
+    }, []string{"handler", "method", "status"})
+    httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "reviewx_http_request_duration_seconds",
+        Help:    "Latency of HTTP requests by handler.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"handler"})
+)
+
+// metricMethods are the HTTP methods recorded as method labels; any other method a client sends
+// is recorded as "other"
+var metricMethods = map[string]bool{
+    http.MethodGet:     true,
+    http.MethodHead:    true,
+    http.MethodPost:    true,
+    http.MethodPut:     true,
+    http.MethodPatch:   true,
+    http.MethodDelete:  true,
+    http.MethodOptions: true,
+}
+
+// methodLabel returns the method label of a request, folding unknown methods into "other"
+func methodLabel(method string) string {
+    if metricMethods[method] {
+        return method
+    }
+    return "other"
+}
+
+// observeRequest serves the request with next and records its status and latency under
+// handler, which must be a registered route pattern, and the request method as methodLabel
+// reports it, so the label values stay bounded whatever clients send
+func observeRequest(handler string, next http.Handler, w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+    rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+    next.ServeHTTP(rec, r)
+
+    httpRequests.WithLabelValues(handler, methodLabel(r.Method), strconv.Itoa(rec.status)).Inc()
+    httpRequestDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+}
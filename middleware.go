@@ -0,0 +1,645 @@
+package main
+
+import (
+    "compress/gzip"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "log/slog"
+    "math"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/time/rate"
+)
+
+// logger writes structured request and application logs; main replaces it with one configured
+// through REVIEWX_LOG_LEVEL and REVIEWX_LOG_FORMAT
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// newLogger creates a logger writing records at level ("debug", "info", "warn" or "error") and
+// above to w, formatted as "json" or "text"
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+    var minLevel slog.Level
+    if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+        return nil, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", level)
+    }
+    opts := &slog.HandlerOptions{Level: minLevel}
+    switch format {
+    case "json":
+        return slog.New(slog.NewJSONHandler(w, opts)), nil
+    case "text":
+        return slog.New(slog.NewTextHandler(w, opts)), nil
+    }
+    return nil, fmt.Errorf("invalid log format %q: must be json or text", format)
+}
+
+// maxRequestIDLength caps incoming X-Request-ID values so clients cannot bloat the logs
+const maxRequestIDLength = 128
+
+// requestIDContextKey is the context key under which withRequestID stores the request ID
+type requestIDContextKey struct{}
+
+// requestIDFromContext returns the ID assigned to the request by withRequestID, or "" outside a request
+func requestIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDContextKey{}).(string)
+    return id
+}
+
+// validRequestID reports whether an incoming request ID is short and made of printable ASCII
+func validRequestID(id string) bool {
+    return validToken(id, maxRequestIDLength)
+}
+
+// validToken reports whether a client-supplied identifier is non-empty, at most maxLength bytes
+// and made of printable ASCII without spaces
+func validToken(token string, maxLength int) bool {
+    if token == "" || len(token) > maxLength {
+        return false
+    }
+    for i := 0; i < len(token); i++ {
+        if token[i] < 0x21 || token[i] > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// newRequestID returns a random 128-bit hex request ID
+func newRequestID() string {
+    var b [16]byte
+    rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
+
+// withRequestID is a middleware that honors a valid incoming X-Request-ID or generates one,
+// stores it in the request context and echoes it in the X-Request-ID response header
+func withRequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+    })
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code written
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+// WriteHeader records the status code before passing it on
+func (rec *statusRecorder) WriteHeader(status int) {
+    rec.status = status
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController, so handlers can still flush
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// withLogging is a middleware that logs method, path, status and latency of each request
+func withLogging(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+        next.ServeHTTP(rec, r)
+
+        logger.Info("request",
+            "request_id", requestIDFromContext(r.Context()),
+            "method", r.Method,
+            "path", r.URL.Path,
+            "status", rec.status,
+            "latency_ms", float64(time.Since(start).Microseconds())/1000,
+        )
+    })
+}
+
+// minGzipSize is the smallest response body worth compressing; gzip framing outweighs the savings below it
+const minGzipSize = 1024
+
+// gzipWriterPool reuses gzip writers across responses since each one allocates sizable buffers
+var gzipWriterPool = sync.Pool{
+    New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether the body is large
+// enough to compress, then either streams it through a gzip writer or passes it on unchanged
+type gzipResponseWriter struct {
+    http.ResponseWriter
+    status  int
+    buf     []byte
+    gz      *gzip.Writer
+    started bool
+}
+
+// WriteHeader records the status code; it is sent once the compression decision is made
+func (w *gzipResponseWriter) WriteHeader(status int) {
+    if !w.started {
+        w.status = status
+    }
+}
+
+// Write buffers the body until minGzipSize bytes have been written, then starts compressing
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+    if !w.started {
+        w.buf = append(w.buf, p...)
+        if len(w.buf) >= minGzipSize {
+            if err := w.start(true); err != nil {
+                return 0, err
+            }
+        }
+        return len(p), nil
+    }
+    if w.gz != nil {
+        return w.gz.Write(p)
+    }
+    return w.ResponseWriter.Write(p)
+}
+
+// start sends the headers and the buffered body, compressing them when compress is set and the
+// handler produced text that is not already encoded
+func (w *gzipResponseWriter) start(compress bool) error {
+    w.started = true
+    header := w.Header()
+    if compress && header.Get("Content-Encoding") == "" && compressibleType(header.Get("Content-Type")) {
+        header.Set("Content-Encoding", "gzip")
+        header.Del("Content-Length")
+        w.gz = gzipWriterPool.Get().(*gzip.Writer)
+        w.gz.Reset(w.ResponseWriter)
+    }
+    w.ResponseWriter.WriteHeader(w.status)
+
+    buf := w.buf
+    w.buf = nil
+    switch {
+    case len(buf) == 0:
+        return nil
+    case w.gz != nil:
+        _, err := w.gz.Write(buf)
+        return err
+    default:
+        _, err := w.ResponseWriter.Write(buf)
+        return err
+    }
+}
+
+// FlushError sends everything written so far, compressing it unless the handler produced content
+// that should not be; a handler that flushes is streaming, so the response is not held back for
+// size. The first flush sends the headers, including Content-Encoding, before any body bytes.
+// http.ResponseController calls it rather than unwrapping to the writer underneath.
+func (w *gzipResponseWriter) FlushError() error {
+    if !w.started {
+        if err := w.start(true); err != nil {
+            return err
+        }
+    }
+    if w.gz != nil {
+        if err := w.gz.Flush(); err != nil {
+            return err
+        }
+    }
+    return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher for handlers that assert it directly
+func (w *gzipResponseWriter) Flush() {
+    w.FlushError()
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// close sends a response too small to compress, or flushes and releases the gzip writer
+func (w *gzipResponseWriter) close() {
+    if !w.started {
+        w.start(false)
+    }
+    if w.gz != nil {
+        w.gz.Close()
+        gzipWriterPool.Put(w.gz)
+        w.gz = nil
+    }
+}
+
+// compressibleType reports whether a Content-Type is text that benefits from compression;
+// images, archives and other binary formats are usually compressed already
+func compressibleType(contentType string) bool {
+    mediaType, _, _ := strings.Cut(contentType, ";")
+    mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+    return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/x-ndjson" || strings.HasSuffix(mediaType, "+json")
+}
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding without refusing it with q=0
+func acceptsGzip(r *http.Request) bool {
+    for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+        coding, params, _ := strings.Cut(part, ";")
+        if strings.TrimSpace(strings.ToLower(coding)) != "gzip" {
+            continue
+        }
+        q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+        if !ok {
+            return true
+        }
+        weight, err := strconv.ParseFloat(q, 64)
+        return err == nil && weight > 0
+    }
+    return false
+}
+
+// withGzip is a middleware that compresses responses of at least minGzipSize bytes for clients
+// sending Accept-Encoding: gzip
+func withGzip(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // The body depends on Accept-Encoding, so caches must key on it
+        w.Header().Add("Vary", "Accept-Encoding")
+        if !acceptsGzip(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+        defer gw.close()
+        next.ServeHTTP(gw, r)
+    })
+}
+
+// timeoutErrorBody is the JSON error sent for requests exceeding the request timeout, in the shape
+// respondWithError uses
+const timeoutErrorBody = `{"error":{"code":"request_timeout","message":"Request took too long to process","status":503}}`
+
+// withTimeout is a middleware that answers requests not handled within timeout with a 503 and
+// cancels their context, so that slow database queries are abandoned too. Responses are buffered
+// until the handler returns, so it must not wrap streaming endpoints. A zero timeout disables it.
+func withTimeout(timeout time.Duration, next http.Handler) http.Handler {
+    if timeout <= 0 {
+        return next
+    }
+    timed := http.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // TimeoutHandler hands the handler a fresh header map, so the request ID that
+        // respondWithError reads from the response headers is carried over
+        if id := requestIDFromContext(r.Context()); id != "" {
+            w.Header().Set("X-Request-ID", id)
+        }
+        next.ServeHTTP(w, r)
+    }), timeout, timeoutErrorBody)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // TimeoutHandler sends its body without a Content-Type; handlers that finish in time
+        // replace this with their own
+        w.Header().Set("Content-Type", "application/json")
+        timed.ServeHTTP(w, r)
+    })
+}
+
+// prettyResponseWriter marks a response whose JSON body should be indented, as asked for with
+// ?pretty=true; respondWithJSON looks for it, so it must wrap the writer handlers receive
+type prettyResponseWriter struct {
+    http.ResponseWriter
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController
+func (w prettyResponseWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// withPretty is a middleware that has JSON responses indented for requests with ?pretty=true,
+// which is easier to read when debugging with curl; responses stay compact otherwise
+func withPretty(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+            w = prettyResponseWriter{w}
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// clientLimiter holds the token bucket and last activity time of a single client
+type clientLimiter struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+// ipRateLimiter keeps a token bucket per client IP
+type ipRateLimiter struct {
+    mu      sync.Mutex
+    clients map[string]*clientLimiter
+    limit   rate.Limit
+    burst   int
+}
+
+// newIPRateLimiter creates a limiter allowing limit events per second with the given burst per client
+func newIPRateLimiter(limit rate.Limit, burst int) *ipRateLimiter {
+    return &ipRateLimiter{
+        clients: make(map[string]*clientLimiter),
+        limit:   limit,
+        burst:   burst,
+    }
+}
+
+// get returns the token bucket for an IP, creating it on first use
+func (l *ipRateLimiter) get(ip string) *rate.Limiter {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    client, ok := l.clients[ip]
+    if !ok {
+        client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+        l.clients[ip] = client
+    }
+    client.lastSeen = time.Now()
+    return client.limiter
+}
+
+// cleanupLoop periodically forgets clients that have been idle for longer than maxIdle until ctx is done
+func (l *ipRateLimiter) cleanupLoop(ctx context.Context, interval, maxIdle time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            l.mu.Lock()
+            for ip, client := range l.clients {
+                if time.Since(client.lastSeen) > maxIdle {
+                    delete(l.clients, ip)
+                }
+            }
+            l.mu.Unlock()
+        }
+    }
+}
+
+// clientIP extracts the client IP address from the request's remote address
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// withRateLimit is a middleware that rejects POST requests with 429 once a client exceeds its rate
+func withRateLimit(limiter *ipRateLimiter, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            next(w, r)
+            return
+        }
+
+        reservation := limiter.get(clientIP(r)).Reserve()
+        if delay := reservation.Delay(); delay > 0 {
+            // Give the token back since the request is not going to be served
+            reservation.Cancel()
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+            respondWithError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+            return
+        }
+
+        next(w, r)
+    }
+}
+
+// voteTracker remembers which client IPs voted on which reviews so a client cannot vote repeatedly
+type voteTracker struct {
+    mu     sync.Mutex
+    votes  map[string]time.Time
+    window time.Duration
+}
+
+// newVoteTracker creates a tracker that allows one vote per client and review within window
+func newVoteTracker(window time.Duration) *voteTracker {
+    return &voteTracker{
+        votes:  make(map[string]time.Time),
+        window: window,
+    }
+}
+
+// voteKey identifies the vote of a client IP on a review
+func voteKey(ip string, id int) string {
+    return ip + "|" + strconv.Itoa(id)
+}
+
+// claim records a vote and reports false when the client already voted on the review within the window
+func (t *voteTracker) claim(ip string, id int) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    key := voteKey(ip, id)
+    if votedAt, ok := t.votes[key]; ok && time.Since(votedAt) < t.window {
+        return false
+    }
+    t.votes[key] = time.Now()
+    return true
+}
+
+// release forgets a claimed vote, used when the vote could not be counted
+func (t *voteTracker) release(ip string, id int) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    delete(t.votes, voteKey(ip, id))
+}
+
+// cleanupLoop periodically forgets votes older than the window until ctx is done
+func (t *voteTracker) cleanupLoop(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            t.mu.Lock()
+            for key, votedAt := range t.votes {
+                if time.Since(votedAt) >= t.window {
+                    delete(t.votes, key)
+                }
+            }
+            t.mu.Unlock()
+        }
+    }
+}
+
+// requestAPIKey returns the key sent in the X-API-Key header or, failing that, the Authorization
+// bearer token; when user tokens are enabled the bearer token carries the JWT instead
+func (s *Server) requestAPIKey(r *http.Request) string {
+    if key := r.Header.Get("X-API-Key"); key != "" || len(s.jwtSecret) > 0 {
+        return key
+    }
+    if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+        return strings.TrimSpace(token)
+    }
+    return ""
+}
+
+// withReadOnly is a middleware that rejects requests modifying data with 503 while the server
+// is in read-only mode, leaving reads and preflight requests working
+func (s *Server) withReadOnly(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            next(w, r)
+            return
+        }
+        if s.readOnly.Load() {
+            respondWithError(w, http.StatusServiceUnavailable, "read_only", "The API is in read-only mode for maintenance; writes are temporarily disabled")
+            return
+        }
+
+        next(w, r)
+    }
+}
+
+// withAPIKey is a middleware that requires the configured API key on every request that
+// modifies data, leaving reads and preflight requests public; it does nothing when no key is set
+func (s *Server) withAPIKey(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            next(w, r)
+            return
+        }
+        if s.apiKey == "" {
+            next(w, r)
+            return
+        }
+
+        if !s.checkAPIKey(w, r) {
+            return
+        }
+
+        next(w, r)
+    }
+}
+
+// checkAPIKey reports whether the request carries the configured API key, responding with an
+// error when it does not
+func (s *Server) checkAPIKey(w http.ResponseWriter, r *http.Request) bool {
+    key := s.requestAPIKey(r)
+    if key == "" {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        respondWithError(w, http.StatusUnauthorized, "missing_api_key", "Missing API key")
+        return false
+    }
+
+    // Compare digests so neither the contents nor the length of the key leak through timing
+    got := sha256.Sum256([]byte(key))
+    want := sha256.Sum256([]byte(s.apiKey))
+    if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+        respondWithError(w, http.StatusForbidden, "invalid_api_key", "Invalid API key")
+        return false
+    }
+    return true
+}
+
+// withAdmin is a middleware for admin-only endpoints: unlike the rest of the API they require the
+// API key, when one is set, and an admin token, when user tokens are enabled, for reads as well
+func (s *Server) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return s.withUser(func(w http.ResponseWriter, r *http.Request) {
+        if s.apiKey != "" && !s.checkAPIKey(w, r) {
+            return
+        }
+        if len(s.jwtSecret) > 0 {
+            user, ok := userFromContext(r.Context())
+            if !ok {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                respondWithError(w, http.StatusUnauthorized, "missing_token", "Missing bearer token")
+                return
+            }
+            if !user.Admin {
+                respondWithError(w, http.StatusForbidden, "forbidden", "Only admins may use this endpoint")
+                return
+            }
+        }
+
+        next(w, r)
+    })
+}
+
+// corsPolicy holds the origins allowed to make cross-origin requests
+type corsPolicy struct {
+    allowAll bool
+    origins  map[string]bool
+}
+
+// parseCORSOrigins builds a policy from a comma-separated origin list where "*" allows any origin
+func parseCORSOrigins(list string) corsPolicy {
+    policy := corsPolicy{origins: make(map[string]bool)}
+    for _, origin := range strings.Split(list, ",") {
+        origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+        switch origin {
+        case "":
+            // Ignore empty entries from stray commas
+        case "*":
+            policy.allowAll = true
+        default:
+            policy.origins[origin] = true
+        }
+    }
+    return policy
+}
+
+// allowedOrigin returns the value for Access-Control-Allow-Origin, or "" when the origin is not allowed
+func (p corsPolicy) allowedOrigin(origin string) string {
+    if p.allowAll {
+        return "*"
+    }
+    if origin != "" && p.origins[origin] {
+        return origin
+    }
+    return ""
+}
+
+// withCORS is a middleware function that adds CORS headers for allowed origins and
+// answers OPTIONS requests with the methods the route supports; an empty methods
+// list passes OPTIONS requests through to next
+func (s *Server) withCORS(methods string, next http.HandlerFunc) http.HandlerFunc {
+    if methods != "" {
+        methods += ", OPTIONS"
+    }
+    return func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        allowed := s.cors.allowedOrigin(origin)
+        if !s.cors.allowAll {
+            // The response depends on the request's Origin, so caches must key on it
+            w.Header().Add("Vary", "Origin")
+        }
+        if allowed != "" {
+            w.Header().Set("Access-Control-Allow-Origin", allowed)
+            if methods != "" {
+                w.Header().Set("Access-Control-Allow-Methods", methods)
+            }
+            w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Idempotency-Key, "+tenantHeader)
+        }
+
+        // Handle OPTIONS requests, including CORS preflights
+        if r.Method == http.MethodOptions && methods != "" {
+            w.Header().Set("Allow", methods)
+            if origin != "" && allowed == "" {
+                w.WriteHeader(http.StatusForbidden)
+            }
+            return
+        }
+
+        next(w, r)
+    }
+}
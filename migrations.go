@@ -0,0 +1,236 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "regexp"
+)
+
+// migration is one ordered schema change; once applied its version is recorded in
+// schema_migrations so it never runs again
+type migration struct {
+    version     int
+    description string
+    up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order it must be applied. Append new steps with
+// the next version number and never edit or reorder released ones. The steps are written to be
+// idempotent because databases created before versioning already have some of the columns.
+var migrations = []migration{
+    {1, "create reviews table", func(tx *sql.Tx) error {
+        _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS reviews (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT,
+            review TEXT,
+            rating INTEGER
+        )`)
+        return err
+    }},
+    {2, "add created_at", func(tx *sql.Tx) error {
+        // SQLite cannot add a column with a non-constant default, so backfill existing rows instead
+        added, err := addColumnIfMissing(tx, "reviews", "created_at", "DATETIME")
+        if err != nil || !added {
+            return err
+        }
+        _, err = tx.Exec("UPDATE reviews SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL")
+        return err
+    }},
+    {3, "add email", func(tx *sql.Tx) error {
+        _, err := addColumnIfMissing(tx, "reviews", "email", "TEXT")
+        return err
+    }},
+    {4, "add approved", func(tx *sql.Tx) error {
+        // Reviews stored before moderation existed were already public, so keep them approved
+        added, err := addColumnIfMissing(tx, "reviews", "approved", "INTEGER NOT NULL DEFAULT 0")
+        if err != nil || !added {
+            return err
+        }
+        _, err = tx.Exec("UPDATE reviews SET approved = 1")
+        return err
+    }},
+    {5, "add verified", func(tx *sql.Tx) error {
+        _, err := addColumnIfMissing(tx, "reviews", "verified", "INTEGER NOT NULL DEFAULT 0")
+        return err
+    }},
+    {6, "add deleted_at", func(tx *sql.Tx) error {
+        _, err := addColumnIfMissing(tx, "reviews", "deleted_at", "DATETIME")
+        return err
+    }},
+    {7, "add product_id", func(tx *sql.Tx) error {
+        // Reviews stored before products existed keep an empty product ID
+        if _, err := addColumnIfMissing(tx, "reviews", "product_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_reviews_product_id ON reviews (product_id)")
+        return err
+    }},
+    {8, "add helpful_count", func(tx *sql.Tx) error {
+        _, err := addColumnIfMissing(tx, "reviews", "helpful_count", "INTEGER NOT NULL DEFAULT 0")
+        return err
+    }},
+    {9, "add author_id", func(tx *sql.Tx) error {
+        _, err := addColumnIfMissing(tx, "reviews", "author_id", "TEXT")
+        return err
+    }},
+    {10, "create review_replies table", func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS review_replies (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            review_id INTEGER NOT NULL REFERENCES reviews (id) ON DELETE CASCADE,
+            author_id TEXT,
+            text TEXT NOT NULL,
+            created_at DATETIME NOT NULL
+        )`); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_review_replies_review_id ON review_replies (review_id)")
+        return err
+    }},
+    {11, "add language", func(tx *sql.Tx) error {
+        // Reviews stored before detection existed are left untagged
+        if _, err := addColumnIfMissing(tx, "reviews", "language", "TEXT"); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_reviews_language ON reviews (language)")
+        return err
+    }},
+    {12, "create idempotency_keys table", func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS idempotency_keys (
+            key TEXT NOT NULL,
+            author_id TEXT NOT NULL DEFAULT '',
+            review_id INTEGER NOT NULL REFERENCES reviews (id) ON DELETE CASCADE,
+            created_at DATETIME NOT NULL,
+            PRIMARY KEY (key, author_id)
+        )`); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at)")
+        return err
+    }},
+    {13, "create review_audit table", func(tx *sql.Tx) error {
+        // No foreign key: the history of a purged review must outlive it
+        if _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS review_audit (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            review_id INTEGER NOT NULL,
+            action TEXT NOT NULL,
+            actor TEXT,
+            created_at DATETIME NOT NULL
+        )`); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_review_audit_review_id ON review_audit (review_id)")
+        return err
+    }},
+    {14, "create review_images table", func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS review_images (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            review_id INTEGER NOT NULL REFERENCES reviews (id) ON DELETE CASCADE,
+            url TEXT NOT NULL
+        )`); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_review_images_review_id ON review_images (review_id)")
+        return err
+    }},
+    {15, "create blocked_names table", func(tx *sql.Tx) error {
+        // Names are blocked regardless of case, as they are matched when listing reviews by name
+        _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS blocked_names (
+            name TEXT PRIMARY KEY COLLATE NOCASE,
+            created_at DATETIME NOT NULL
+        )`)
+        return err
+    }},
+    {16, "add status", func(tx *sql.Tx) error {
+        _, err := addColumnIfMissing(tx, "reviews", "status", "TEXT NOT NULL DEFAULT 'published'")
+        return err
+    }},
+    {17, "create review_flags table", func(tx *sql.Tx) error {
+        if _, err := addColumnIfMissing(tx, "reviews", "flag_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`
+        CREATE TABLE IF NOT EXISTS review_flags (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            review_id INTEGER NOT NULL REFERENCES reviews (id) ON DELETE CASCADE,
+            author_id TEXT,
+            reason TEXT NOT NULL,
+            created_at DATETIME NOT NULL
+        )`); err != nil {
+            return err
+        }
+        _, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_review_flags_review_id ON review_flags (review_id)")
+        return err
+    }},
+}
+
+// initializeDatabase brings the schema up to date by applying every migration not yet recorded
+func initializeDatabase(conn *sql.DB) error {
+    if _, err := conn.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`); err != nil {
+        return err
+    }
+
+    for _, m := range migrations {
+        if err := applyMigration(conn, m); err != nil {
+            return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+        }
+    }
+    return nil
+}
+
+// applyMigration runs a migration and records its version in one transaction, skipping it
+// when it was already applied; the transaction's write lock keeps concurrent starts from
+// applying the same migration twice
+func applyMigration(conn *sql.DB, m migration) error {
+    tx, err := conn.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var applied bool
+    if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = ?)", m.version).Scan(&applied); err != nil {
+        return err
+    }
+    if applied {
+        return nil
+    }
+
+    if err := m.up(tx); err != nil {
+        return err
+    }
+    if _, err := tx.Exec("INSERT INTO schema_migrations (version, description) VALUES (?, ?)", m.version, m.description); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// sqlIdentifierPattern matches the table and column names addColumnIfMissing accepts; identifiers
+// cannot be bound as arguments, so only plain names are ever interpolated into its statements
+var sqlIdentifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// addColumnIfMissing adds a column to a table unless it already exists and reports whether it was added
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) (bool, error) {
+    if !sqlIdentifierPattern.MatchString(table) || !sqlIdentifierPattern.MatchString(column) {
+        return false, fmt.Errorf("invalid identifier in %s.%s", table, column)
+    }
+
+    var exists bool
+    err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+    if err != nil || exists {
+        return false, err
+    }
+
+    _, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    return err == nil, err
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+    _ "embed"
+    "net/http"
+)
+
+// openAPISpec is the hand-written OpenAPI description of every endpoint; update
+// it alongside any handler whose parameters, payloads or responses change
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIHandler serves the OpenAPI specification
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        respondMethodNotAllowed(w, "GET")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(openAPISpec)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "bufio"
+    "os"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+// Ways of handling blocked words, selected through REVIEWX_PROFANITY_MODE
+const (
+    profanityReject = "reject"
+    profanityMask   = "mask"
+)
+
+// errProfanity is returned when a review contains a blocked word and the filter rejects such reviews
+var errProfanity error = &codedError{"blocked_language", "Review contains blocked language."}
+
+// profanityFilter finds blocked words in review text and either rejects or masks them
+type profanityFilter struct {
+    pattern *regexp.Regexp
+    mask    bool
+}
+
+// newProfanityFilter creates a filter matching whole words from the blocklist regardless of case,
+// or returns nil when the blocklist is empty
+func newProfanityFilter(words []string, mode string) *profanityFilter {
+    quoted := make([]string, 0, len(words))
+    for _, word := range words {
+        if word = strings.TrimSpace(word); word != "" {
+            quoted = append(quoted, regexp.QuoteMeta(word))
+        }
+    }
+    if len(quoted) == 0 {
+        return nil
+    }
+    return &profanityFilter{
+        pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+        mask:    mode == profanityMask,
+    }
+}
+
+// loadBlocklist reads one blocked word or phrase per line, skipping blank lines and # comments
+func loadBlocklist(path string) ([]string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var words []string
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        words = append(words, line)
+    }
+    return words, scanner.Err()
+}
+
+// maskWords replaces every blocked word in text with asterisks of the same length
+func (f *profanityFilter) maskWords(text string) string {
+    return f.pattern.ReplaceAllStringFunc(text, func(word string) string {
+        return strings.Repeat("*", utf8.RuneCountInString(word))
+    })
+}
+
+// applyText checks each text field, masking blocked words in place or returning errProfanity
+// depending on the mode; a nil filter accepts everything
+func (f *profanityFilter) applyText(fields ...*string) error {
+    if f == nil {
+        return nil
+    }
+    for _, field := range fields {
+        if f.mask {
+            *field = f.maskWords(*field)
+        } else if f.pattern.MatchString(*field) {
+            return errProfanity
+        }
+    }
+    return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/mail"
+    "net/url"
+    "reflect"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Review represents a review submitted by a user
+type Review struct {
+    ID        int       `json:"id"`
+    ProductID string    `json:"product_id"`          // Identifies the product the review is about
+    AuthorID  string    `json:"author_id,omitempty"` // Set from the authenticated user; never read from the request
+    Name      string    `json:"name"`
+    Review    string    `json:"review"`
+    Rating    *int      `json:"rating"`             // Star rating; nil for text-only feedback when ratings are optional
+    Language  string    `json:"language,omitempty"` // ISO 639 code, detected from the text unless the client sends one
+    CreatedAt time.Time `json:"created_at"`
+    Email     string    `json:"email,omitempty"`   // Optional; never selected by reviewColumns so it stays private
+    Approved  bool      `json:"approved"`          // Only approved reviews are shown publicly
+    Verified  bool      `json:"verified"`          // Set for reviews from verified purchases
+    Status    string    `json:"status"`            // reviewPublished, or reviewDraft for reviews only their author sees until published
+    Helpful   int       `json:"helpful_count"`     // Number of readers who marked the review as helpful
+    Replies   []Reply   `json:"replies,omitempty"` // Loaded when reviews are read, not when they are written
+    Images    []string  `json:"images,omitempty"`  // URLs of photos hosted elsewhere; the files themselves are never stored
+}
+
+// UnmarshalJSON decodes a review, accepting the rating as a flexibleRating. Unknown fields are
+// always rejected, since a decoder's DisallowUnknownFields does not reach custom unmarshalers.
+func (r *Review) UnmarshalJSON(data []byte) error {
+    // plainReview has Review's fields but not this method, so decoding into it does not recurse
+    type plainReview Review
+    aux := struct {
+        *plainReview
+        Rating *flexibleRating `json:"rating"`
+    }{plainReview: (*plainReview)(r), Rating: (*flexibleRating)(r.Rating)}
+
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&aux); err != nil {
+        return err
+    }
+    r.Rating = (*int)(aux.Rating)
+    return nil
+}
+
+// flexibleRating is a star rating sent either as a JSON number, such as 5, or as a string holding
+// a whole number, such as "5", because some frontends send form values as strings
+type flexibleRating int
+
+// UnmarshalJSON accepts a whole number, a string holding one, or null, which leaves the rating unset
+func (f *flexibleRating) UnmarshalJSON(data []byte) error {
+    text := string(data)
+    if text == "null" {
+        return nil
+    }
+    if unquoted, err := strconv.Unquote(text); err == nil {
+        text = strings.TrimSpace(unquoted)
+    }
+    n, err := strconv.Atoi(text)
+    if err != nil {
+        return &codedError{"invalid_rating", "Invalid rating value. Must be a whole number or a string holding one, such as 5 or \"5\"."}
+    }
+    *f = flexibleRating(n)
+    return nil
+}
+
+// Reply is a public response to a review, such as one from the business being reviewed
+type Reply struct {
+    ID        int       `json:"id"`
+    ReviewID  int       `json:"review_id"`
+    AuthorID  string    `json:"author_id,omitempty"` // Set from the authenticated user; never read from the request
+    Text      string    `json:"text"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Flag is a reader's report that a review is inappropriate
+type Flag struct {
+    ID        int       `json:"id"`
+    ReviewID  int       `json:"review_id"`
+    AuthorID  string    `json:"author_id,omitempty"` // Set from the authenticated user; never read from the request
+    Reason    string    `json:"reason"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// FlaggedReview is a review reported by readers, listed for moderators with its reports
+type FlaggedReview struct {
+    Review    Review `json:"review"`
+    FlagCount int    `json:"flag_count"` // Reports made since the review was last approved
+    Flags     []Flag `json:"flags"`      // Every report in the order it was made, including those dismissed by an earlier approval
+}
+
+// AuditEntry records one change made to a review
+type AuditEntry struct {
+    ID        int       `json:"id"`
+    ReviewID  int       `json:"review_id"`
+    Action    string    `json:"action"`          // One of the audit action constants
+    Actor     string    `json:"actor,omitempty"` // The authenticated user who made the change; empty when authentication is disabled
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Actions recorded in the audit log
+const (
+    auditCreate  = "create"
+    auditUpdate  = "update"
+    auditApprove = "approve"
+    auditDelete  = "delete"
+    auditRestore = "restore"
+    auditPurge   = "purge"
+    auditPublish = "publish"
+    auditHide    = "hide" // The review was returned to moderation after being flagged too often
+)
+
+// Publication states of a review; submissions default to published
+const (
+    reviewPublished = "published"
+    reviewDraft     = "draft"
+)
+
+// ReviewStats summarizes the ratings of all submitted reviews, or of one product's reviews
+type ReviewStats struct {
+    Count           int         `json:"count"`
+    Average         float64     `json:"average"`
+    Breakdown       map[int]int `json:"breakdown"`                 // Number of reviews per star rating, from 1 to the maximum rating
+    UniqueReviewers int         `json:"uniqueReviewers"`           // Number of distinct reviewer names
+    Pending         int         `json:"pending"`                   // Reviews awaiting moderation, excluded from the figures above
+    WeightedAverage *float64    `json:"weightedAverage,omitempty"` // Average with older reviews down-weighted; only set for ?weighted=true
+}
+
+// ReviewSummary counts the stored reviews by moderation state for the admin dashboard
+type ReviewSummary struct {
+    Total    int     `json:"total"`    // Every stored review, including deleted ones that were not purged
+    Approved int     `json:"approved"` // Reviews shown publicly
+    Pending  int     `json:"pending"`  // Reviews awaiting moderation
+    Deleted  int     `json:"deleted"`  // Soft-deleted reviews that can still be restored
+    Average  float64 `json:"average"`  // Average rating of the approved reviews, as reported by /stats
+}
+
+// Maximum lengths, in characters, of the review text fields
+const (
+    maxProductIDLength  = 100
+    maxNameLength       = 100
+    maxReviewLength     = 5000
+    maxReplyLength      = 5000
+    maxEmailLength      = 254
+    maxImageURLLength   = 2048
+    maxFlagReasonLength = 500
+)
+
+// maxImages caps the number of image URLs attached to a single review
+const maxImages = 10
+
+// validateRating checks that a star rating is between 1 and maxRating
+func validateRating(rating, maxRating int) error {
+    if rating < 1 || rating > maxRating {
+        return &codedError{"invalid_rating", fmt.Sprintf("Invalid rating value. Must be between 1 and %d.", maxRating)}
+    }
+    return nil
+}
+
+// fieldError describes why one field of a submitted review was rejected
+type fieldError struct {
+    Field   string `json:"field"`
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+// newFieldError wraps a validation error of field
+func newFieldError(field string, err error) fieldError {
+    return fieldError{Field: field, Code: errorCode(err, "invalid_"+field), Message: err.Error()}
+}
+
+// validateText checks that a trimmed text field is present and at most maxLength characters long
+func validateText(field, value string, maxLength int) error {
+    if value == "" {
+        return &codedError{"invalid_" + field, fmt.Sprintf("Invalid %s value. Must not be empty.", field)}
+    }
+    if utf8.RuneCountInString(value) > maxLength {
+        return &codedError{"invalid_" + field, fmt.Sprintf("Invalid %s value. Must be at most %d characters.", field, maxLength)}
+    }
+    return nil
+}
+
+// markupPattern matches the start of an HTML tag, comment or processing instruction; a lone < as
+// in "3 < 5" does not match
+var markupPattern = regexp.MustCompile(`<[a-zA-Z/!?]`)
+
+// stripControl removes control characters such as NUL and escape sequences from text shown to
+// readers, keeping line breaks and tabs when multiline is set
+func stripControl(value string, multiline bool) string {
+    return strings.Map(func(r rune) rune {
+        if multiline && (r == '\n' || r == '\t') {
+            return r
+        }
+        if unicode.IsControl(r) {
+            return -1
+        }
+        return r
+    }, value)
+}
+
+// validatePlainText checks a text field like validateText and also rejects HTML markup. Text
+// fields are displayed as they were submitted, so markup is refused rather than escaped to keep
+// stored reviews free of script tags however a client renders them.
+func validatePlainText(field, value string, maxLength int) error {
+    if err := validateText(field, value, maxLength); err != nil {
+        return err
+    }
+    if markupPattern.MatchString(value) {
+        return &codedError{"invalid_" + field, fmt.Sprintf("Invalid %s value. Must not contain HTML tags.", field)}
+    }
+    return nil
+}
+
+// reviewFieldErrors trims the text fields of a review, strips control characters from the name and
+// text, and checks that every field is within bounds, returning one error per invalid field in the
+// order the fields are declared. The rating may only be left out when ratingOptional is set, and
+// drafts may also leave out the rating and the review text until they are published. Published
+// review text must be at least minReviewLength characters long.
+func reviewFieldErrors(review *Review, maxRating int, ratingOptional bool, minReviewLength int) []fieldError {
+    review.ProductID = strings.TrimSpace(review.ProductID)
+    review.Name = strings.TrimSpace(stripControl(review.Name, false))
+    review.Review = strings.TrimSpace(stripControl(review.Review, true))
+    review.Email = strings.TrimSpace(review.Email)
+    review.Language = strings.ToLower(strings.TrimSpace(review.Language))
+
+    var errs []fieldError
+    check := func(field string, err error) {
+        if err != nil {
+            errs = append(errs, newFieldError(field, err))
+        }
+    }
+    check("product_id", validateText("product_id", review.ProductID, maxProductIDLength))
+    if review.Status == "" {
+        review.Status = reviewPublished
+    }
+    draft := review.Status == reviewDraft
+    check("name", validatePlainText("name", review.Name, maxNameLength))
+    if !draft || review.Review != "" {
+        check("review", validatePlainText("review", review.Review, maxReviewLength))
+    }
+    if !draft && review.Review != "" && utf8.RuneCountInString(review.Review) < minReviewLength {
+        check("review", &codedError{"invalid_review", fmt.Sprintf("Invalid review value. Must be at least %d characters.", minReviewLength)})
+    }
+    switch {
+    case review.Rating != nil:
+        check("rating", validateRating(*review.Rating, maxRating))
+    case !ratingOptional && !draft:
+        // A missing rating is out of range like the zero rating it used to decode as
+        check("rating", validateRating(0, maxRating))
+    }
+    if review.Language != "" && !languageCodePattern.MatchString(review.Language) {
+        check("language", &codedError{"invalid_language", "Invalid language value. Must be an ISO 639-1 or 639-3 code such as en."})
+    }
+
+    check("images", validateImages(review.Images))
+    if !draft && review.Status != reviewPublished {
+        check("status", &codedError{"invalid_status", "Invalid status value. Must be draft or published."})
+    }
+
+    // The email is optional, but must be a bare address when present
+    if review.Email != "" {
+        addr, err := mail.ParseAddress(review.Email)
+        if err != nil || addr.Address != review.Email || len(review.Email) > maxEmailLength {
+            check("email", &codedError{"invalid_email", "Invalid email value. Must be a valid email address."})
+        }
+    }
+    return errs
+}
+
+// validateImages trims the image URLs of a review and checks that there are at most maxImages of
+// them and that each is an absolute http or https URL
+func validateImages(images []string) error {
+    if len(images) > maxImages {
+        return &codedError{"invalid_images", fmt.Sprintf("Invalid images value. Must contain at most %d URLs.", maxImages)}
+    }
+    for i := range images {
+        images[i] = strings.TrimSpace(images[i])
+        u, err := url.Parse(images[i])
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(images[i]) > maxImageURLLength {
+            return &codedError{"invalid_images", fmt.Sprintf("Invalid images value at index %d. Must be an http or https URL of at most %d characters.", i, maxImageURLLength)}
+        }
+    }
+    return nil
+}
+
+// isReviewField reports whether name is the JSON name of a Review field, compared without regard
+// to case as encoding/json matches field names
+func isReviewField(name string) bool {
+    for _, field := range reviewFieldNames() {
+        if strings.EqualFold(field, name) {
+            return true
+        }
+    }
+    return false
+}
+
+// reviewFieldNames returns the JSON names of the Review fields in declaration order
+func reviewFieldNames() []string {
+    t := reflect.TypeOf(Review{})
+    names := make([]string, 0, t.NumField())
+    for i := 0; i < t.NumField(); i++ {
+        name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        names = append(names, name)
+    }
+    return names
+}
+
+// validateReply trims the text of a reply, strips control characters from it and checks that it
+// is within bounds and free of HTML markup like review text
+func validateReply(reply *Reply) error {
+    reply.Text = strings.TrimSpace(stripControl(reply.Text, true))
+    return validatePlainText("text", reply.Text, maxReplyLength)
+}
+
+// validateFlag trims the reason of a flag, strips control characters from it and checks that it
+// is within bounds and free of HTML markup
+func validateFlag(flag *Flag) error {
+    flag.Reason = strings.TrimSpace(stripControl(flag.Reason, true))
+    return validatePlainText("reason", flag.Reason, maxFlagReasonLength)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "net/http"
+    "sync/atomic"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "golang.org/x/time/rate"
+)
+
+// Config holds the tunable behavior of a Server
+type Config struct {
+    RateLimit         rate.Limit       // Review submissions per second allowed per client IP
+    RateBurst         int              // Submissions a client may make in a burst
+    CORS              corsPolicy       // Origins allowed to make cross-origin requests
+    APIKey            string           // Key required for POST, PUT, PATCH and DELETE requests; empty disables authentication
+    JWTSecret         string           // HS256 secret of the user tokens required for writes; empty disables user authentication
+    Profanity         *profanityFilter // Blocked word filter applied to submitted reviews; nil disables it
+    MaxRating         int              // Highest star rating accepted; zero means defaultMaxRating
+    StatsTTL          time.Duration    // How long /stats results are cached; zero disables the cache
+    IdempotencyWindow time.Duration    // How long Idempotency-Key values of review submissions are remembered; zero ignores the header
+    ReadOnly          bool             // Start in read-only mode, rejecting writes until an admin turns it off
+    HoneypotField     string           // Hidden POST /reviews field only bots fill in; empty disables the honeypot
+    DefaultLimit      int              // Page size of review listings that give no limit; zero means defaultLimit
+    DefaultSort       string           // Sort order of review listings that give none; empty means id order
+    RatingHalfLife    time.Duration    // Age at which a review counts half in the weighted /stats average; zero means defaultRatingHalfLife
+    ListCache         bool             // Keep the public review listing in memory between writes
+    StaticDir         string           // Directory of frontend files served at paths no endpoint matches; empty serves none
+    RatingOptional    bool             // Accept reviews without a star rating, stored with a null rating
+    Webhooks          *webhookNotifier // Receivers notified of every new review; nil notifies none
+    RequestTimeout    time.Duration    // How long a request may take before it is answered with a 503; zero disables the limit
+    MinReviewLength   int              // Fewest characters the text of a published review may have; zero means no minimum
+    FlagThreshold     int              // Flags after which a review is hidden until an admin approves it again; zero never hides reviews
+}
+
+// Server serves the review API on top of a ReviewStore
+type Server struct {
+    store             ReviewStore
+    mux               *http.ServeMux
+    postLimiter       *ipRateLimiter
+    helpfulVotes      *voteTracker
+    flagVotes         *voteTracker
+    cors              corsPolicy
+    apiKey            string
+    jwtSecret         []byte
+    profanity         *profanityFilter
+    maxRating         int
+    statsCache        *statsCache
+    idempotencyWindow time.Duration
+    readOnly          atomic.Bool
+    honeypotField     string
+    defaultLimit      int
+    defaultSort       string
+    ratingHalfLife    time.Duration
+    listCache         *listCache
+    ratingOptional    bool
+    webhooks          *webhookNotifier
+    minReviewLength   int
+    flagThreshold     int
+    handler           http.Handler
+    timed             http.Handler
+}
+
+// NewServer creates a Server using store and registers every endpoint
+func NewServer(store ReviewStore, cfg Config) *Server {
+    s := &Server{
+        store:             store,
+        mux:               http.NewServeMux(),
+        postLimiter:       newIPRateLimiter(cfg.RateLimit, cfg.RateBurst),
+        helpfulVotes:      newVoteTracker(helpfulVoteWindow),
+        flagVotes:         newVoteTracker(flagVoteWindow),
+        cors:              cfg.CORS,
+        apiKey:            cfg.APIKey,
+        jwtSecret:         []byte(cfg.JWTSecret),
+        profanity:         cfg.Profanity,
+        maxRating:         cfg.MaxRating,
+        statsCache:        newStatsCache(cfg.StatsTTL),
+        idempotencyWindow: cfg.IdempotencyWindow,
+        honeypotField:     cfg.HoneypotField,
+        defaultLimit:      cfg.DefaultLimit,
+        defaultSort:       cfg.DefaultSort,
+        ratingHalfLife:    cfg.RatingHalfLife,
+        listCache:         newListCache(cfg.ListCache),
+        ratingOptional:    cfg.RatingOptional,
+        webhooks:          cfg.Webhooks,
+        minReviewLength:   cfg.MinReviewLength,
+        flagThreshold:     cfg.FlagThreshold,
+    }
+    if s.maxRating == 0 {
+        s.maxRating = defaultMaxRating
+    }
+    if s.defaultLimit == 0 {
+        s.defaultLimit = defaultLimit
+    }
+    if s.ratingHalfLife == 0 {
+        s.ratingHalfLife = defaultRatingHalfLife
+    }
+    s.readOnly.Store(cfg.ReadOnly)
+    s.handler = withPretty(s.mux)
+    s.timed = withTimeout(cfg.RequestTimeout, s.handler)
+
+    // Unknown paths get a JSON 404 unless a frontend is served from them
+    fallback := s.notFoundHandler
+    if cfg.StaticDir != "" {
+        fallback = s.staticHandler(cfg.StaticDir)
+    }
+
+    s.mux.HandleFunc("/reviews", s.withCORS("GET, POST, PUT, PATCH", s.withReadOnly(s.withAPIKey(s.withUser(withRateLimit(s.postLimiter, s.reviewsHandler))))))
+    s.mux.HandleFunc("/reviews/bulk", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(withRateLimit(s.postLimiter, s.bulkImportHandler)))))) // Handler for importing many reviews at once
+    s.mux.HandleFunc("/reviews/helpful", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(withRateLimit(s.postLimiter, s.helpfulHandler)))))) // Handler for marking a review as helpful
+    s.mux.HandleFunc("/reviews/flag", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(withRateLimit(s.postLimiter, s.flagHandler))))))       // Handler for reporting an inappropriate review
+    s.mux.HandleFunc("/reviews/validate", s.withCORS("POST", s.withAPIKey(s.withUser(withRateLimit(s.postLimiter, s.validateReviewHandler)))))         // Handler for checking a review without submitting it
+    s.mux.HandleFunc("/reviews/reply", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(withRateLimit(s.postLimiter, s.replyHandler))))))     // Handler for replying to a review
+    s.mux.HandleFunc("/reviews/publish", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(s.publishHandler)))))                               // Handler for publishing a draft review
+    s.mux.HandleFunc("/reviews/count", s.withCORS("GET", s.withUser(s.countReviewsHandler)))                                                           // Handler for counting the reviews a listing would return
+    s.mux.HandleFunc("/reviews/top", s.withCORS("GET", s.topReviewsHandler))                                                                           // Handler for listing the highest-rated reviews
+    s.mux.HandleFunc("/reviews/{id}", s.withCORS("DELETE", s.withReadOnly(s.withAPIKey(s.withUser(s.deleteReviewByPathHandler)))))                     // Handler for deleting a review named in the path
+    s.mux.HandleFunc("/reviews/{id}/history", s.withCORS("GET", s.withUser(s.historyHandler)))                                                         // Handler for listing the changes made to a review
+    s.mux.HandleFunc("/reviews.csv", s.withCORS("GET", s.withUser(s.exportCSVHandler)))                                                                // Handler for exporting all reviews as CSV
+    s.mux.HandleFunc("/reviews.jsonl", s.withCORS("GET", s.withUser(s.exportJSONLinesHandler)))                                                        // Handler for streaming all reviews as JSON Lines
+    s.mux.HandleFunc("/reviews.rss", s.withCORS("GET", s.feedHandler))                                                                                 // Handler for the RSS feed of the newest reviews
+    s.mux.HandleFunc("/review", s.withCORS("GET", s.withUser(s.getReviewHandler)))                                                                     // Handler for fetching a single review
+    s.mux.HandleFunc("/delete-review", s.withCORS("DELETE", s.withReadOnly(s.withAPIKey(s.withUser(s.deleteReviewHandler)))))                          // Handler for deleting a review
+    s.mux.HandleFunc("/delete-reviews", s.withCORS("DELETE", s.withReadOnly(s.withAPIKey(s.withUser(s.deleteReviewsHandler)))))                        // Handler for deleting several reviews at once
+    s.mux.HandleFunc("/restore-review", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(s.restoreReviewHandler)))))                          // Handler for restoring a soft-deleted review
+    s.mux.HandleFunc("/purge-review", s.withCORS("DELETE", s.withReadOnly(s.withAPIKey(s.withUser(s.purgeReviewHandler)))))                            // Handler for permanently removing a review
+    s.mux.HandleFunc("/approve-review", s.withCORS("POST", s.withReadOnly(s.withAPIKey(s.withUser(s.approveReviewHandler)))))                          // Handler for approving a pending review
+    s.mux.HandleFunc("/admin/read-only", s.withCORS("GET, PUT", s.withAPIKey(s.withUser(s.readOnlyHandler))))                                          // Handler for reporting and toggling read-only mode
+    s.mux.HandleFunc("/admin/summary", s.withCORS("GET", s.withAdmin(s.summaryHandler)))                                                               // Handler for the admin dashboard's review counts
+    s.mux.HandleFunc("/admin/recalculate", s.withCORS("POST", s.withAdmin(s.recalculateHandler)))                                                      // Handler for recomputing cached aggregates from the stored reviews
+    s.mux.HandleFunc("/admin/flagged", s.withCORS("GET", s.withAdmin(s.flaggedHandler)))                                                               // Handler for listing the reviews readers have flagged
+    s.mux.HandleFunc("/admin/block", s.withCORS("GET, POST", s.withReadOnly(s.withAdmin(s.blockHandler))))                                             // Handler for listing and blocking reviewer names
+    s.mux.HandleFunc("/admin/unblock", s.withCORS("POST", s.withReadOnly(s.withAdmin(s.unblockHandler))))                                              // Handler for unblocking a reviewer name
+    s.mux.HandleFunc("/stats/distribution", s.withCORS("GET", s.distributionHandler))                                                                  // Handler for the number of reviews at each star rating
+    s.mux.HandleFunc("/stats", s.withCORS("GET", s.statsHandler))                                                                                      // Handler for rating statistics
+    s.mux.HandleFunc("/config", s.withCORS("GET", s.configHandler))                                                                                    // Settings frontends need, such as the rating scale
+    s.mux.HandleFunc("/openapi.json", s.withCORS("GET", s.openAPIHandler))                                                                             // OpenAPI specification
+    s.mux.Handle("/metrics", promhttp.Handler())                                                                                                       // Prometheus metrics
+    s.mux.HandleFunc("/healthz", s.healthzHandler)                                                                                                     // Liveness probe
+    s.mux.HandleFunc("/", s.withCORS("", fallback))                                                                                                    // Static frontend files, or a JSON 404 for unknown paths
+    s.mux.HandleFunc("/readyz", s.readyzHandler)                                                                                                       // Readiness probe that checks the database
+    return s
+}
+
+// streamingRoutes are the route patterns whose responses are streamed rather than built in memory
+var streamingRoutes = map[string]bool{
+    "/reviews.csv":   true,
+    "/reviews.jsonl": true,
+}
+
+// ServeHTTP dispatches the request to the matching endpoint and records request metrics
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    // Label metrics with the matched route pattern rather than the raw path
+    _, pattern := s.mux.Handler(r)
+    if pattern == "" {
+        pattern = "unmatched"
+    }
+
+    // Exports stream for as long as they need, so only the other routes are subject to the request timeout
+    handler := s.timed
+    if streamingRoutes[pattern] {
+        handler = s.handler
+    }
+    observeRequest(pattern, handler, w, r)
+}
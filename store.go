@@ -0,0 +1,1134 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "math"
+    "slices"
+    "strings"
+    "time"
+
+    "github.com/mattn/go-sqlite3"
+)
+
+// ReviewStore persists reviews; handlers only talk to storage through this interface so the
+// backend can be swapped with REVIEWX_DB_DRIVER
+type ReviewStore interface {
+    Save(ctx context.Context, review *Review) (int, error)
+    SaveIdempotent(ctx context.Context, review *Review, key string, window time.Duration) (int, bool, error)
+    SaveAll(ctx context.Context, reviews []Review) ([]int, error)
+    GetByID(ctx context.Context, id int) (*Review, error)
+    NextID(ctx context.Context) (int, error)
+    Load(ctx context.Context, filter reviewFilter, sort string, limit, offset int) ([]Review, int, error)
+    Count(ctx context.Context, filter reviewFilter) (int, error)
+    Top(ctx context.Context, n int) ([]Review, error)
+    ForEach(ctx context.Context, filter reviewFilter, fn func(Review) error) error
+    Stats(ctx context.Context, productID string) (*ReviewStats, error)
+    Distribution(ctx context.Context, filter reviewFilter) (map[int]int, error)
+    WeightedAverage(ctx context.Context, productID string, halfLife time.Duration, now time.Time) (float64, error)
+    Summary(ctx context.Context) (*ReviewSummary, error)
+    Update(ctx context.Context, review *Review) error
+    UpdateRating(ctx context.Context, id, rating int) error
+    Approve(ctx context.Context, id int) error
+    Publish(ctx context.Context, review *Review) error
+    MarkHelpful(ctx context.Context, id int) error
+    Delete(ctx context.Context, id int) error
+    DeleteMany(ctx context.Context, ids []int) ([]int, error)
+    Restore(ctx context.Context, id int) error
+    Purge(ctx context.Context, id int) error
+    History(ctx context.Context, reviewID int) ([]AuditEntry, error)
+    BlockName(ctx context.Context, name string) error
+    UnblockName(ctx context.Context, name string) error
+    BlockedNames(ctx context.Context) ([]string, error)
+    IsBlocked(ctx context.Context, name string) (bool, error)
+    SaveReply(ctx context.Context, reply *Reply) (int, error)
+    LoadReplies(ctx context.Context, reviewIDs []int) (map[int][]Reply, error)
+    SaveFlag(ctx context.Context, flag *Flag, threshold int) (int, bool, error)
+    Flagged(ctx context.Context) ([]FlaggedReview, error)
+    IsHidden(ctx context.Context, id int) (bool, error)
+    LoadImages(ctx context.Context, reviewIDs []int) (map[int][]string, error)
+    Backup(ctx context.Context, path string) error
+    Ping(ctx context.Context) error
+    Close() error
+}
+
+// sqliteStore is the ReviewStore backed by a SQLite database
+type sqliteStore struct {
+    db              *sql.DB
+    duplicateWindow time.Duration
+    windowFunctions bool // Whether the linked SQLite supports COUNT(*) OVER (), added in 3.25
+}
+
+// newSQLiteStore creates a store on an initialized database; identical reviews saved within
+// duplicateWindow are rejected, and zero disables the check
+func newSQLiteStore(db *sql.DB, duplicateWindow time.Duration) *sqliteStore {
+    return &sqliteStore{db: db, duplicateWindow: duplicateWindow, windowFunctions: supportsWindowFunctions(db)}
+}
+
+// supportsWindowFunctions reports whether the database can evaluate window functions
+func supportsWindowFunctions(db *sql.DB) bool {
+    _, err := db.Exec("SELECT COUNT(*) OVER ()")
+    return err == nil
+}
+
+// Ping checks that the database is reachable
+func (s *sqliteStore) Ping(ctx context.Context) error {
+    return s.db.PingContext(ctx)
+}
+
+// Backup writes a consistent copy of the database to a new file at path. VACUUM INTO reads a
+// snapshot, so writers carry on while it runs, and the copy is compacted.
+func (s *sqliteStore) Backup(ctx context.Context, path string) error {
+    _, err := s.db.ExecContext(ctx, "VACUUM INTO ?", path)
+    return err
+}
+
+// Close closes the underlying database
+func (s *sqliteStore) Close() error {
+    return s.db.Close()
+}
+
+// reviewColumns lists the columns selected when loading reviews, in scanReview order
+const reviewColumns = "id, product_id, author_id, name, review, rating, language, created_at, approved, verified, helpful_count, status"
+
+// sortOrders maps the accepted sort query values to ORDER BY clauses; user input is never interpolated
+var sortOrders = map[string]string{
+    "rating_asc":  "rating ASC, id ASC",
+    "rating_desc": "rating DESC, id DESC",
+    "newest":      "created_at DESC, id DESC",
+    "oldest":      "created_at ASC, id ASC",
+    "helpful":     "helpful_count DESC, id DESC",
+}
+
+// sortNames returns the accepted sort query values in alphabetical order
+func sortNames() []string {
+    names := make([]string, 0, len(sortOrders))
+    for name := range sortOrders {
+        names = append(names, name)
+    }
+    slices.Sort(names)
+    return names
+}
+
+// defaultSortOrder is used when no sort or an unknown sort is requested
+const defaultSortOrder = "id ASC"
+
+// errReviewNotFound is returned when an operation targets a review that does not exist
+var errReviewNotFound = errors.New("review not found")
+
+// errNameNotBlocked is returned when unblocking a name that is not blocked
+var errNameNotBlocked = errors.New("name not blocked")
+
+// errDuplicateReview is returned when an identical review was saved within the duplicate window
+var errDuplicateReview = errors.New("duplicate review")
+
+// Writes that fail because the database is busy or locked are retried with
+// exponential backoff, on top of the wait already done by the busy timeout
+const (
+    maxWriteRetries     = 3
+    writeRetryBaseDelay = 50 * time.Millisecond
+)
+
+// dbtx is implemented by both *sql.DB and *sql.Tx
+type dbtx interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// isBusyError reports whether err means another connection holds the lock the write needs
+func isBusyError(err error) bool {
+    var sqliteErr sqlite3.Error
+    if !errors.As(err, &sqliteErr) {
+        return false
+    }
+    return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// retryOnBusy runs fn and retries it with exponential backoff while it fails with a busy or
+// locked error, logging every retry so the busy timeout can be tuned
+func retryOnBusy(ctx context.Context, op string, fn func() error) error {
+    delay := writeRetryBaseDelay
+    for attempt := 1; ; attempt++ {
+        err := fn()
+        if err == nil || !isBusyError(err) || attempt > maxWriteRetries {
+            return err
+        }
+
+        logger.Warn("retrying busy database write", "request_id", requestIDFromContext(ctx), "op", op, "attempt", attempt, "delay_ms", delay.Milliseconds(), "error", err.Error())
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(delay):
+        }
+        delay *= 2
+    }
+}
+
+// execWithRetry runs a single write statement, retrying it while the database is busy
+func (s *sqliteStore) execWithRetry(ctx context.Context, op, query string, args ...interface{}) (sql.Result, error) {
+    var result sql.Result
+    err := retryOnBusy(ctx, op, func() error {
+        var err error
+        result, err = s.db.ExecContext(ctx, query, args...)
+        return err
+    })
+    return result, err
+}
+
+// inTx runs fn in a transaction that is committed when fn succeeds; the whole transaction
+// is retried while the database is busy
+func (s *sqliteStore) inTx(ctx context.Context, op string, fn func(tx *sql.Tx) error) error {
+    return retryOnBusy(ctx, op, func() error {
+        tx, err := s.db.BeginTx(ctx, nil)
+        if err != nil {
+            return err
+        }
+        defer tx.Rollback()
+
+        if err := fn(tx); err != nil {
+            return err
+        }
+        return tx.Commit()
+    })
+}
+
+// execAudited runs a single statement changing the review with the given ID and records action
+// in the audit log within the same transaction, returning errReviewNotFound if no row changed
+func (s *sqliteStore) execAudited(ctx context.Context, op, action string, id int, query string, args ...interface{}) error {
+    return s.inTx(ctx, op, func(tx *sql.Tx) error {
+        result, err := tx.ExecContext(ctx, query, args...)
+        if err != nil {
+            return err
+        }
+
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            return err
+        }
+
+        if rowsAffected == 0 {
+            return errReviewNotFound
+        }
+
+        return recordAudit(ctx, tx, id, action)
+    })
+}
+
+// recordAudit appends an entry for the review to the audit log, attributed to the user
+// authenticated by withUser if there is one
+func recordAudit(ctx context.Context, exec dbtx, reviewID int, action string) error {
+    user, _ := userFromContext(ctx)
+    actor := sql.NullString{String: user.ID, Valid: user.ID != ""}
+    _, err := exec.ExecContext(ctx, "INSERT INTO review_audit (review_id, action, actor, created_at) VALUES (?, ?, ?, ?)", reviewID, action, actor, time.Now().UTC())
+    return err
+}
+
+// Save inserts a new review into the database and returns the ID assigned by SQLite.
+// When duplicate detection is enabled the check and the insert share a transaction, so two
+// identical concurrent submissions cannot both be saved.
+func (s *sqliteStore) Save(ctx context.Context, review *Review) (int, error) {
+    var id int
+    err := s.inTx(ctx, "Save", func(tx *sql.Tx) error {
+        var err error
+        id, err = s.saveInTx(ctx, tx, review)
+        return err
+    })
+    return id, err
+}
+
+// SaveIdempotent saves a review like Save and records key, scoped to the review's author, for
+// window. When the key was already recorded it saves nothing and returns the ID of the review
+// saved with it, reporting true. Expired keys are removed on the way so the table stays small.
+func (s *sqliteStore) SaveIdempotent(ctx context.Context, review *Review, key string, window time.Duration) (int, bool, error) {
+    var (
+        id       int
+        replayed bool
+    )
+    err := s.inTx(ctx, "SaveIdempotent", func(tx *sql.Tx) error {
+        now := time.Now().UTC()
+        if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", now.Add(-window)); err != nil {
+            return err
+        }
+
+        err := tx.QueryRowContext(ctx, "SELECT review_id FROM idempotency_keys WHERE key = ? AND author_id = ?", key, review.AuthorID).Scan(&id)
+        if err == nil {
+            replayed = true
+            return nil
+        }
+        if !errors.Is(err, sql.ErrNoRows) {
+            return err
+        }
+
+        if id, err = s.saveInTx(ctx, tx, review); err != nil {
+            return err
+        }
+        _, err = tx.ExecContext(ctx, "INSERT INTO idempotency_keys (key, author_id, review_id, created_at) VALUES (?, ?, ?, ?)", key, review.AuthorID, id, now)
+        return err
+    })
+    return id, replayed, err
+}
+
+// saveInTx rejects duplicates when detection is enabled and inserts the review within tx
+func (s *sqliteStore) saveInTx(ctx context.Context, tx *sql.Tx, review *Review) (int, error) {
+    if s.duplicateWindow > 0 {
+        duplicate, err := isDuplicateReview(ctx, tx, review, s.duplicateWindow)
+        if err != nil {
+            return 0, err
+        }
+        if duplicate {
+            return 0, errDuplicateReview
+        }
+    }
+    return insertReview(ctx, tx, review)
+}
+
+// insertReview inserts a review with its images and records its creation in the audit log; exec
+// should be a transaction so nothing is written partially
+func insertReview(ctx context.Context, exec dbtx, review *Review) (int, error) {
+    review.CreatedAt = time.Now().UTC()
+    email := sql.NullString{String: review.Email, Valid: review.Email != ""}
+    authorID := sql.NullString{String: review.AuthorID, Valid: review.AuthorID != ""}
+    language := sql.NullString{String: review.Language, Valid: review.Language != ""}
+    if review.Status == "" {
+        review.Status = reviewPublished
+    }
+    result, err := exec.ExecContext(ctx, "INSERT INTO reviews (product_id, author_id, name, review, rating, language, created_at, email, verified, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", review.ProductID, authorID, review.Name, review.Review, review.Rating, language, review.CreatedAt, email, review.Verified, review.Status)
+    if err != nil {
+        return 0, err
+    }
+
+    id, err := result.LastInsertId()
+    if err != nil {
+        return 0, err
+    }
+    if err := insertImages(ctx, exec, int(id), review.Images); err != nil {
+        return 0, err
+    }
+    return int(id), recordAudit(ctx, exec, int(id), auditCreate)
+}
+
+// NextID returns the id the next saved review will be assigned, as the AUTOINCREMENT sequence
+// never reuses the ids of deleted reviews
+func (s *sqliteStore) NextID(ctx context.Context) (int, error) {
+    var id int
+    err := s.db.QueryRowContext(ctx, "SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'reviews'), 0) + 1").Scan(&id)
+    return id, err
+}
+
+// insertImages stores the image URLs of a review in order
+func insertImages(ctx context.Context, exec dbtx, reviewID int, images []string) error {
+    for _, image := range images {
+        if _, err := exec.ExecContext(ctx, "INSERT INTO review_images (review_id, url) VALUES (?, ?)", reviewID, image); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// SaveAll inserts several reviews in a single transaction so either all or none are saved
+func (s *sqliteStore) SaveAll(ctx context.Context, reviews []Review) ([]int, error) {
+    ids := make([]int, len(reviews))
+    err := s.inTx(ctx, "SaveAll", func(tx *sql.Tx) error {
+        for i := range reviews {
+            id, err := insertReview(ctx, tx, &reviews[i])
+            if err != nil {
+                return fmt.Errorf("review at index %d: %w", i, err)
+            }
+            ids[i] = id
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return ids, nil
+}
+
+// isDuplicateReview reports whether a review of the same product with the same name and text was saved within the window
+func isDuplicateReview(ctx context.Context, query dbtx, review *Review, window time.Duration) (bool, error) {
+    var exists bool
+    since := time.Now().UTC().Add(-window)
+    row := query.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM reviews WHERE product_id = ? AND name = ? AND review = ? AND created_at >= ? AND deleted_at IS NULL)", review.ProductID, review.Name, review.Review, since)
+    err := row.Scan(&exists)
+    return exists, err
+}
+
+// Update overwrites the product, name, text, rating, language, approval and images of an existing review
+func (s *sqliteStore) Update(ctx context.Context, review *Review) error {
+    language := sql.NullString{String: review.Language, Valid: review.Language != ""}
+    return s.inTx(ctx, "Update", func(tx *sql.Tx) error {
+        result, err := tx.ExecContext(ctx, "UPDATE reviews SET product_id = ?, name = ?, review = ?, rating = ?, language = ?, approved = ? WHERE id = ? AND deleted_at IS NULL", review.ProductID, review.Name, review.Review, review.Rating, language, review.Approved, review.ID)
+        if err != nil {
+            return err
+        }
+
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            return err
+        }
+
+        if rowsAffected == 0 {
+            return errReviewNotFound
+        }
+
+        if _, err := tx.ExecContext(ctx, "DELETE FROM review_images WHERE review_id = ?", review.ID); err != nil {
+            return err
+        }
+        if err := insertImages(ctx, tx, review.ID, review.Images); err != nil {
+            return err
+        }
+        return recordAudit(ctx, tx, review.ID, auditUpdate)
+    })
+}
+
+// Publish saves the checked fields of a draft and publishes it, returning errReviewNotFound when
+// there is no such draft
+func (s *sqliteStore) Publish(ctx context.Context, review *Review) error {
+    language := sql.NullString{String: review.Language, Valid: review.Language != ""}
+    return s.execAudited(ctx, "Publish", auditPublish, review.ID, "UPDATE reviews SET name = ?, review = ?, rating = ?, language = ?, status = ? WHERE id = ? AND status = ? AND deleted_at IS NULL", review.Name, review.Review, review.Rating, language, reviewPublished, review.ID, reviewDraft)
+}
+
+// UpdateRating changes only the star rating of an existing review
+func (s *sqliteStore) UpdateRating(ctx context.Context, id, rating int) error {
+    return s.execAudited(ctx, "UpdateRating", auditUpdate, id, "UPDATE reviews SET rating = ? WHERE id = ? AND deleted_at IS NULL", rating, id)
+}
+
+// Approve marks a review as approved so it is shown publicly
+func (s *sqliteStore) Approve(ctx context.Context, id int) error {
+    return s.execAudited(ctx, "Approve", auditApprove, id, "UPDATE reviews SET approved = 1, flag_count = 0 WHERE id = ? AND deleted_at IS NULL", id)
+}
+
+// MarkHelpful atomically increments the helpful count of a published review
+func (s *sqliteStore) MarkHelpful(ctx context.Context, id int) error {
+    result, err := s.execWithRetry(ctx, "MarkHelpful", "UPDATE reviews SET helpful_count = helpful_count + 1 WHERE id = ? AND approved = 1 AND deleted_at IS NULL", id)
+    if err != nil {
+        return err
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+
+    if rowsAffected == 0 {
+        return errReviewNotFound
+    }
+
+    return nil
+}
+
+// Delete soft-deletes a review by ID, keeping the row so it can be restored, and returns
+// errReviewNotFound if no review is found
+func (s *sqliteStore) Delete(ctx context.Context, id int) error {
+    return s.execAudited(ctx, "Delete", auditDelete, id, "UPDATE reviews SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().UTC(), id)
+}
+
+// reviewFilter holds the optional conditions used to narrow down a review listing
+type reviewFilter struct {
+    ProductID    string    // Empty means reviews of every product
+    Name         string    // Reviewer name matched exactly but case-insensitively; empty means every reviewer
+    Language     string    // ISO 639 code of the review language; empty means every language
+    MinRating    int       // Zero means no minimum rating
+    From         time.Time // Earliest creation time included; zero means no lower bound
+    To           time.Time // Creation time before which reviews are included; zero means no upper bound
+    Search       string    // Empty means no text search
+    Status       string    // One of the status constants; empty means approved only
+    AuthorID     string    // Empty means reviews of every author
+    VerifiedOnly bool      // Only include reviews from verified purchases
+    HideBlocked  bool      // Leave out reviews whose reviewer name is blocked
+    AfterID      int       // Keyset cursor; zero means start from the first review
+}
+
+// Moderation states accepted by the status query parameter
+const (
+    statusApproved = "approved"
+    statusPending  = "pending"
+    statusAll      = "all"
+    statusDraft    = "draft"
+)
+
+// whereClause builds the SQL WHERE clause and its arguments for the filter; the clause is made of
+// fixed conditions only, with every value bound as an argument
+func (f reviewFilter) whereClause() (string, []interface{}) {
+    // Soft-deleted reviews are never listed, and drafts only when asked for
+    conditions := []string{"deleted_at IS NULL"}
+    var args []interface{}
+    switch f.Status {
+    case statusDraft:
+        // Drafts are listed whether or not a moderator approved them
+        conditions = append(conditions, "status = ?")
+        args = append(args, reviewDraft)
+    case statusAll:
+        // Moderators may list every published review regardless of approval
+        conditions = append(conditions, "status = ?")
+        args = append(args, reviewPublished)
+    case statusPending:
+        conditions = append(conditions, "status = ?", "approved = 0")
+        args = append(args, reviewPublished)
+    default:
+        conditions = append(conditions, "status = ?", "approved = 1")
+        args = append(args, reviewPublished)
+    }
+    if f.AuthorID != "" {
+        conditions = append(conditions, "author_id = ?")
+        args = append(args, f.AuthorID)
+    }
+    if f.ProductID != "" {
+        conditions = append(conditions, "product_id = ?")
+        args = append(args, f.ProductID)
+    }
+    if f.Name != "" {
+        conditions = append(conditions, "name = ? COLLATE NOCASE")
+        args = append(args, f.Name)
+    }
+    if f.Language != "" {
+        conditions = append(conditions, "language = ?")
+        args = append(args, f.Language)
+    }
+    if f.VerifiedOnly {
+        conditions = append(conditions, "verified = 1")
+    }
+    if f.HideBlocked {
+        conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM blocked_names WHERE blocked_names.name = reviews.name)")
+    }
+    if f.AfterID > 0 {
+        conditions = append(conditions, "id > ?")
+        args = append(args, f.AfterID)
+    }
+    if f.MinRating > 0 {
+        conditions = append(conditions, "rating >= ?")
+        args = append(args, f.MinRating)
+    }
+    if !f.From.IsZero() {
+        conditions = append(conditions, "created_at >= ?")
+        args = append(args, f.From.UTC())
+    }
+    if !f.To.IsZero() {
+        conditions = append(conditions, "created_at < ?")
+        args = append(args, f.To.UTC())
+    }
+    if f.Search != "" {
+        pattern := "%" + escapeLike(f.Search) + "%"
+        conditions = append(conditions, `(review LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\')`)
+        args = append(args, pattern, pattern)
+    }
+    return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// DeleteMany soft-deletes the reviews with the given IDs in a single transaction
+// and returns the IDs that existed and were deleted
+func (s *sqliteStore) DeleteMany(ctx context.Context, ids []int) ([]int, error) {
+    placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+    args := make([]interface{}, len(ids))
+    for i, id := range ids {
+        args[i] = id
+    }
+
+    var deleted []int
+    err := s.inTx(ctx, "DeleteMany", func(tx *sql.Tx) error {
+        // Find which of the requested reviews exist so the caller can report the rest
+        rows, err := tx.QueryContext(ctx, "SELECT id FROM reviews WHERE id IN ("+placeholders+") AND deleted_at IS NULL ORDER BY id", args...)
+        if err != nil {
+            return err
+        }
+        deleted = []int{}
+        for rows.Next() {
+            var id int
+            if err := rows.Scan(&id); err != nil {
+                rows.Close()
+                return err
+            }
+            deleted = append(deleted, id)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        deleteArgs := append([]interface{}{time.Now().UTC()}, args...)
+        if _, err := tx.ExecContext(ctx, "UPDATE reviews SET deleted_at = ? WHERE id IN ("+placeholders+") AND deleted_at IS NULL", deleteArgs...); err != nil {
+            return err
+        }
+        for _, id := range deleted {
+            if err := recordAudit(ctx, tx, id, auditDelete); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return deleted, nil
+}
+
+// Restore clears the deletion mark of a soft-deleted review
+func (s *sqliteStore) Restore(ctx context.Context, id int) error {
+    return s.execAudited(ctx, "Restore", auditRestore, id, "UPDATE reviews SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+}
+
+// Purge permanently removes a review, whether or not it was soft-deleted, along with its replies and images
+func (s *sqliteStore) Purge(ctx context.Context, id int) error {
+    return s.execAudited(ctx, "Purge", auditPurge, id, "DELETE FROM reviews WHERE id = ?", id)
+}
+
+// History retrieves the audit log entries of a review in the order they were recorded; the
+// history of a purged review is kept
+func (s *sqliteStore) History(ctx context.Context, reviewID int) ([]AuditEntry, error) {
+    rows, err := s.db.QueryContext(ctx, "SELECT id, review_id, action, actor, created_at FROM review_audit WHERE review_id = ? ORDER BY id", reviewID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    entries := []AuditEntry{}
+    for rows.Next() {
+        var (
+            entry AuditEntry
+            actor sql.NullString
+        )
+        if err := rows.Scan(&entry.ID, &entry.ReviewID, &entry.Action, &actor, &entry.CreatedAt); err != nil {
+            return nil, err
+        }
+        entry.Actor = actor.String
+        entries = append(entries, entry)
+    }
+    return entries, rows.Err()
+}
+
+// GetByID retrieves a single review by ID and returns errReviewNotFound if it does not exist
+func (s *sqliteStore) GetByID(ctx context.Context, id int) (*Review, error) {
+    row := s.db.QueryRowContext(ctx, "SELECT "+reviewColumns+" FROM reviews WHERE id = ? AND deleted_at IS NULL", id)
+    review, err := scanReview(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, errReviewNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &review, nil
+}
+
+// BlockName hides the reviews of a reviewer from public listings; blocking a name twice is not an error
+func (s *sqliteStore) BlockName(ctx context.Context, name string) error {
+    _, err := s.execWithRetry(ctx, "BlockName", "INSERT OR IGNORE INTO blocked_names (name, created_at) VALUES (?, ?)", name, time.Now().UTC())
+    return err
+}
+
+// UnblockName shows the reviews of a blocked reviewer again, returning errNameNotBlocked if the name was not blocked
+func (s *sqliteStore) UnblockName(ctx context.Context, name string) error {
+    result, err := s.execWithRetry(ctx, "UnblockName", "DELETE FROM blocked_names WHERE name = ?", name)
+    if err != nil {
+        return err
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+
+    if rowsAffected == 0 {
+        return errNameNotBlocked
+    }
+
+    return nil
+}
+
+// BlockedNames lists the blocked reviewer names alphabetically, ignoring case
+func (s *sqliteStore) BlockedNames(ctx context.Context) ([]string, error) {
+    rows, err := s.db.QueryContext(ctx, "SELECT name FROM blocked_names ORDER BY name")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    names := []string{}
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+        names = append(names, name)
+    }
+    return names, rows.Err()
+}
+
+// IsBlocked reports whether a reviewer name is blocked, ignoring case
+func (s *sqliteStore) IsBlocked(ctx context.Context, name string) (bool, error) {
+    var blocked bool
+    err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM blocked_names WHERE name = ?)", name).Scan(&blocked)
+    return blocked, err
+}
+
+// SaveReply adds a reply to a review that has not been deleted and returns the ID assigned by
+// SQLite, or errReviewNotFound when there is no such review
+func (s *sqliteStore) SaveReply(ctx context.Context, reply *Reply) (int, error) {
+    var id int
+    err := s.inTx(ctx, "SaveReply", func(tx *sql.Tx) error {
+        var exists bool
+        if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM reviews WHERE id = ? AND deleted_at IS NULL)", reply.ReviewID).Scan(&exists); err != nil {
+            return err
+        }
+        if !exists {
+            return errReviewNotFound
+        }
+
+        reply.CreatedAt = time.Now().UTC()
+        authorID := sql.NullString{String: reply.AuthorID, Valid: reply.AuthorID != ""}
+        result, err := tx.ExecContext(ctx, "INSERT INTO review_replies (review_id, author_id, text, created_at) VALUES (?, ?, ?, ?)", reply.ReviewID, authorID, reply.Text, reply.CreatedAt)
+        if err != nil {
+            return err
+        }
+        lastID, err := result.LastInsertId()
+        id = int(lastID)
+        return err
+    })
+    return id, err
+}
+
+// LoadReplies retrieves the replies to the given reviews in the order they were posted, keyed by review ID
+func (s *sqliteStore) LoadReplies(ctx context.Context, reviewIDs []int) (map[int][]Reply, error) {
+    replies := make(map[int][]Reply)
+    if len(reviewIDs) == 0 {
+        return replies, nil
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(reviewIDs)), ", ")
+    args := make([]interface{}, len(reviewIDs))
+    for i, id := range reviewIDs {
+        args[i] = id
+    }
+
+    rows, err := s.db.QueryContext(ctx, "SELECT id, review_id, author_id, text, created_at FROM review_replies WHERE review_id IN ("+placeholders+") ORDER BY id", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var (
+            reply    Reply
+            authorID sql.NullString
+        )
+        if err := rows.Scan(&reply.ID, &reply.ReviewID, &authorID, &reply.Text, &reply.CreatedAt); err != nil {
+            return nil, err
+        }
+        reply.AuthorID = authorID.String
+        replies[reply.ReviewID] = append(replies[reply.ReviewID], reply)
+    }
+    return replies, rows.Err()
+}
+
+// SaveFlag records a reader's report of a published, approved review and increments its flag
+// count. Once the count reaches threshold the review goes back to moderation, which hides it from
+// public listings until it is approved again; a zero threshold never hides reviews. It returns the
+// ID assigned by SQLite and whether the review was hidden, or errReviewNotFound when there is no
+// such review.
+func (s *sqliteStore) SaveFlag(ctx context.Context, flag *Flag, threshold int) (int, bool, error) {
+    var (
+        id     int
+        hidden bool
+    )
+    err := s.inTx(ctx, "SaveFlag", func(tx *sql.Tx) error {
+        hidden = false
+        result, err := tx.ExecContext(ctx, "UPDATE reviews SET flag_count = flag_count + 1 WHERE id = ? AND approved = 1 AND status = ? AND deleted_at IS NULL", flag.ReviewID, reviewPublished)
+        if err != nil {
+            return err
+        }
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            return err
+        }
+        if rowsAffected == 0 {
+            return errReviewNotFound
+        }
+
+        flag.CreatedAt = time.Now().UTC()
+        authorID := sql.NullString{String: flag.AuthorID, Valid: flag.AuthorID != ""}
+        result, err = tx.ExecContext(ctx, "INSERT INTO review_flags (review_id, author_id, reason, created_at) VALUES (?, ?, ?, ?)", flag.ReviewID, authorID, flag.Reason, flag.CreatedAt)
+        if err != nil {
+            return err
+        }
+        lastID, err := result.LastInsertId()
+        if err != nil {
+            return err
+        }
+        id = int(lastID)
+
+        var count int
+        if err := tx.QueryRowContext(ctx, "SELECT flag_count FROM reviews WHERE id = ?", flag.ReviewID).Scan(&count); err != nil {
+            return err
+        }
+        if threshold == 0 || count < threshold {
+            return nil
+        }
+        if _, err := tx.ExecContext(ctx, "UPDATE reviews SET approved = 0 WHERE id = ?", flag.ReviewID); err != nil {
+            return err
+        }
+        hidden = true
+        return recordAudit(ctx, tx, flag.ReviewID, auditHide)
+    })
+    return id, hidden, err
+}
+
+// Flagged retrieves the reviews flagged since they were last approved, most flagged first, along
+// with every flag they have received
+func (s *sqliteStore) Flagged(ctx context.Context) ([]FlaggedReview, error) {
+    rows, err := s.db.QueryContext(ctx, "SELECT "+reviewColumns+", flag_count FROM reviews WHERE flag_count > 0 AND deleted_at IS NULL ORDER BY flag_count DESC, id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    flagged := []FlaggedReview{}
+    index := make(map[int]int)
+    for rows.Next() {
+        // flag_count trails the review columns like the total read by Load
+        item := FlaggedReview{Flags: []Flag{}}
+        item.Review, err = scanReview(totalScanner{rows, &item.FlagCount})
+        if err != nil {
+            return nil, err
+        }
+        index[item.Review.ID] = len(flagged)
+        flagged = append(flagged, item)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(flagged) == 0 {
+        return flagged, nil
+    }
+
+    flagRows, err := s.db.QueryContext(ctx, "SELECT f.id, f.review_id, f.author_id, f.reason, f.created_at FROM review_flags f JOIN reviews r ON r.id = f.review_id WHERE r.flag_count > 0 AND r.deleted_at IS NULL ORDER BY f.id")
+    if err != nil {
+        return nil, err
+    }
+    defer flagRows.Close()
+
+    for flagRows.Next() {
+        var (
+            flag     Flag
+            authorID sql.NullString
+        )
+        if err := flagRows.Scan(&flag.ID, &flag.ReviewID, &authorID, &flag.Reason, &flag.CreatedAt); err != nil {
+            return nil, err
+        }
+        flag.AuthorID = authorID.String
+        // Skip flags of a review flagged after the reviews were read
+        if i, ok := index[flag.ReviewID]; ok {
+            flagged[i].Flags = append(flagged[i].Flags, flag)
+        }
+    }
+    return flagged, flagRows.Err()
+}
+
+// IsHidden reports whether a review went back to moderation after reaching the flag threshold.
+// Only approved reviews can be flagged and approval clears the count, so a pending review with
+// flags is one that was hidden.
+func (s *sqliteStore) IsHidden(ctx context.Context, id int) (bool, error) {
+    var hidden bool
+    err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM reviews WHERE id = ? AND approved = 0 AND flag_count > 0)", id).Scan(&hidden)
+    return hidden, err
+}
+
+// LoadImages retrieves the image URLs of the given reviews in the order they were attached, keyed by review ID
+func (s *sqliteStore) LoadImages(ctx context.Context, reviewIDs []int) (map[int][]string, error) {
+    images := make(map[int][]string)
+    if len(reviewIDs) == 0 {
+        return images, nil
+    }
+    placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(reviewIDs)), ", ")
+    args := make([]interface{}, len(reviewIDs))
+    for i, id := range reviewIDs {
+        args[i] = id
+    }
+
+    rows, err := s.db.QueryContext(ctx, "SELECT review_id, url FROM review_images WHERE review_id IN ("+placeholders+") ORDER BY id", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var (
+            reviewID int
+            url      string
+        )
+        if err := rows.Scan(&reviewID, &url); err != nil {
+            return nil, err
+        }
+        images[reviewID] = append(images[reviewID], url)
+    }
+    return images, rows.Err()
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+// scanReview reads a single review selected with reviewColumns
+func scanReview(row rowScanner) (Review, error) {
+    var review Review
+    var createdAt sql.NullTime
+    var authorID, language sql.NullString
+    err := row.Scan(&review.ID, &review.ProductID, &authorID, &review.Name, &review.Review, &review.Rating, &language, &createdAt, &review.Approved, &review.Verified, &review.Helpful, &review.Status)
+    review.CreatedAt = createdAt.Time
+    review.AuthorID = authorID.String
+    review.Language = language.String
+    return review, err
+}
+
+// orderByClause translates a sort query value into a whitelisted ORDER BY clause
+func orderByClause(sort string) string {
+    if order, ok := sortOrders[sort]; ok {
+        return order
+    }
+    return defaultSortOrder
+}
+
+// likeEscaper escapes the LIKE wildcard characters and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike makes a search term match literally inside a LIKE pattern
+func escapeLike(term string) string {
+    return likeEscaper.Replace(term)
+}
+
+// Load retrieves a page of reviews matching the filter in the given sort order, along with the
+// number of reviews matching the filter whatever the page and the AfterID cursor. The total comes
+// from the same query through COUNT(*) OVER (); without window functions, or when the page is
+// empty and so carries no total, it is counted separately.
+func (s *sqliteStore) Load(ctx context.Context, filter reviewFilter, sort string, limit, offset int) ([]Review, int, error) {
+    countFilter := filter
+    countFilter.AfterID = 0
+    if !s.windowFunctions {
+        reviews, err := s.loadPage(ctx, filter, sort, limit, offset)
+        if err != nil {
+            return nil, 0, err
+        }
+        total, err := s.Count(ctx, countFilter)
+        return reviews, total, err
+    }
+
+    // The cursor is applied outside the window so the total still counts the reviews before it
+    where, args := countFilter.whereClause()
+    query := "SELECT " + reviewColumns + ", COUNT(*) OVER () FROM reviews" + where
+    if filter.AfterID > 0 {
+        query = "SELECT * FROM (" + query + ") WHERE id > ?"
+        args = append(args, filter.AfterID)
+    }
+    args = append(args, limit, offset)
+    rows, err := s.db.QueryContext(ctx, query+" ORDER BY "+orderByClause(sort)+" LIMIT ? OFFSET ?", args...)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    var total int
+    reviews := []Review{}
+    for rows.Next() {
+        review, err := scanReview(totalScanner{rows, &total})
+        if err != nil {
+            return nil, 0, err
+        }
+        reviews = append(reviews, review)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, 0, err
+    }
+
+    if len(reviews) == 0 && (offset > 0 || filter.AfterID > 0) {
+        total, err = s.Count(ctx, countFilter)
+    }
+    return reviews, total, err
+}
+
+// totalScanner scans a row selected with reviewColumns followed by a COUNT(*) OVER () column,
+// storing the count in total
+type totalScanner struct {
+    rows  *sql.Rows
+    total *int
+}
+
+// Scan reads the review columns into dest and the trailing count into total
+func (t totalScanner) Scan(dest ...interface{}) error {
+    return t.rows.Scan(append(dest, t.total)...)
+}
+
+// loadPage retrieves a page of reviews matching the filter in the given sort order
+func (s *sqliteStore) loadPage(ctx context.Context, filter reviewFilter, sort string, limit, offset int) ([]Review, error) {
+    where, args := filter.whereClause()
+    args = append(args, limit, offset)
+    rows, err := s.db.QueryContext(ctx, "SELECT "+reviewColumns+" FROM reviews"+where+" ORDER BY "+orderByClause(sort)+" LIMIT ? OFFSET ?", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    reviews := []Review{}
+    for rows.Next() {
+        review, err := scanReview(rows)
+        if err != nil {
+            return nil, err
+        }
+        reviews = append(reviews, review)
+    }
+    return reviews, rows.Err()
+}
+
+// Top loads the n highest-rated public reviews, breaking ties in favor of the most recent;
+// reviews without a rating are left out
+func (s *sqliteStore) Top(ctx context.Context, n int) ([]Review, error) {
+    where, args := reviewFilter{Status: statusApproved, HideBlocked: true}.whereClause()
+    args = append(args, n)
+    rows, err := s.db.QueryContext(ctx, "SELECT "+reviewColumns+" FROM reviews"+where+" AND rating IS NOT NULL ORDER BY rating DESC, created_at DESC, id DESC LIMIT ?", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    reviews := []Review{}
+    for rows.Next() {
+        review, err := scanReview(rows)
+        if err != nil {
+            return nil, err
+        }
+        reviews = append(reviews, review)
+    }
+    return reviews, rows.Err()
+}
+
+// ForEach calls fn for every review matching the filter in ID order without loading them all into memory
+func (s *sqliteStore) ForEach(ctx context.Context, filter reviewFilter, fn func(Review) error) error {
+    where, args := filter.whereClause()
+    rows, err := s.db.QueryContext(ctx, "SELECT "+reviewColumns+" FROM reviews"+where+" ORDER BY id", args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        review, err := scanReview(rows)
+        if err != nil {
+            return err
+        }
+        if err := fn(review); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+// Count returns the total number of reviews matching the filter
+func (s *sqliteStore) Count(ctx context.Context, filter reviewFilter) (int, error) {
+    where, args := filter.whereClause()
+    var total int
+    err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reviews"+where, args...).Scan(&total)
+    return total, err
+}
+
+// Summary counts every stored review by moderation state in a single pass over the table
+func (s *sqliteStore) Summary(ctx context.Context) (*ReviewSummary, error) {
+    var summary ReviewSummary
+    // SUM and AVG return NULL on an empty table, so fall back to zero
+    row := s.db.QueryRowContext(ctx, `
+    SELECT
+        COUNT(*),
+        COALESCE(SUM(deleted_at IS NULL AND status = 'published' AND approved = 1), 0),
+        COALESCE(SUM(deleted_at IS NULL AND status = 'published' AND approved = 0), 0),
+        COALESCE(SUM(deleted_at IS NOT NULL), 0),
+        COALESCE(AVG(CASE WHEN deleted_at IS NULL AND status = 'published' AND approved = 1 THEN rating END), 0)
+    FROM reviews`)
+    err := row.Scan(&summary.Total, &summary.Approved, &summary.Pending, &summary.Deleted, &summary.Average)
+    if err != nil {
+        return nil, err
+    }
+    return &summary, nil
+}
+
+// Stats computes the approved review count, average rating and per-star breakdown of reviews
+// not hidden by a blocked name, restricted to one product when productID is not empty
+func (s *sqliteStore) Stats(ctx context.Context, productID string) (*ReviewStats, error) {
+    stats := &ReviewStats{}
+
+    approved, args := reviewFilter{ProductID: productID, Status: statusApproved, HideBlocked: true}.whereClause()
+    pending, pendingArgs := reviewFilter{ProductID: productID, Status: statusPending}.whereClause()
+
+    // AVG skips reviews without a rating and returns NULL when none has one, so fall back to zero;
+    // reviewers are told apart by name regardless of case, as when listing reviews by name
+    row := s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(AVG(rating), 0), COUNT(DISTINCT name COLLATE NOCASE) FROM reviews"+approved, args...)
+    if err := row.Scan(&stats.Count, &stats.Average, &stats.UniqueReviewers); err != nil {
+        return nil, err
+    }
+
+    if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reviews"+pending, pendingArgs...).Scan(&stats.Pending); err != nil {
+        return nil, err
+    }
+
+    breakdown, err := s.Distribution(ctx, reviewFilter{ProductID: productID, Status: statusApproved, HideBlocked: true})
+    if err != nil {
+        return nil, err
+    }
+    stats.Breakdown = breakdown
+    return stats, nil
+}
+
+// Distribution counts the reviews matching filter at each star rating; reviews without a rating
+// are left out and ratings nobody gave are missing from the map
+func (s *sqliteStore) Distribution(ctx context.Context, filter reviewFilter) (map[int]int, error) {
+    where, args := filter.whereClause()
+    rows, err := s.db.QueryContext(ctx, "SELECT rating, COUNT(*) FROM reviews"+where+" AND rating IS NOT NULL GROUP BY rating", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    distribution := make(map[int]int)
+    for rows.Next() {
+        var rating, count int
+        if err := rows.Scan(&rating, &count); err != nil {
+            return nil, err
+        }
+        distribution[rating] = count
+    }
+    return distribution, rows.Err()
+}
+
+// WeightedAverage computes the average approved rating with each review weighted by its age, so
+// that a review halfLife older than now counts half as much, leaving out blocked names and
+// restricted to one product when productID is not empty
+func (s *sqliteStore) WeightedAverage(ctx context.Context, productID string, halfLife time.Duration, now time.Time) (float64, error) {
+    approved, args := reviewFilter{ProductID: productID, Status: statusApproved, HideBlocked: true}.whereClause()
+    rows, err := s.db.QueryContext(ctx, "SELECT rating, created_at FROM reviews"+approved+" AND rating IS NOT NULL", args...)
+    if err != nil {
+        return 0, err
+    }
+    defer rows.Close()
+
+    var sum, weights float64
+    for rows.Next() {
+        var rating int
+        var createdAt sql.NullTime
+        if err := rows.Scan(&rating, &createdAt); err != nil {
+            return 0, err
+        }
+        // Reviews without a timestamp or from the future count fully
+        weight := 1.0
+        if age := now.Sub(createdAt.Time); createdAt.Valid && age > 0 {
+            weight = math.Pow(0.5, float64(age)/float64(halfLife))
+        }
+        sum += weight * float64(rating)
+        weights += weight
+    }
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    // Like AVG, fall back to zero when there is nothing to average
+    if weights == 0 {
+        return 0, nil
+    }
+    return sum / weights, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// tenantHeader names the tenant of a request that does not name one in its path
+const tenantHeader = "X-Tenant"
+
+// tenantPathPrefix starts the paths of requests addressed to a tenant, as in /t/{tenant}/reviews
+const tenantPathPrefix = "/t/"
+
+// tenantNamePattern matches the tenant names accepted in REVIEWX_TENANTS; they become part of
+// database file names, so they are limited to lower-case letters, digits, - and _
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// tenantPrefixContextKey is the context key under which tenantRouter stores the path prefix it stripped
+type tenantPrefixContextKey struct{}
+
+// tenantPrefixFromContext returns the /t/{tenant} prefix stripped from the request path, or "" when
+// the tenant was not named in the path
+func tenantPrefixFromContext(ctx context.Context) string {
+    prefix, _ := ctx.Value(tenantPrefixContextKey{}).(string)
+    return prefix
+}
+
+// tenantDBPath returns the database file of a tenant, kept next to the default database and named
+// after it, so that reviews.db becomes reviews.acme.db for the tenant acme
+func tenantDBPath(dbPath, tenant string) string {
+    ext := filepath.Ext(dbPath)
+    return strings.TrimSuffix(dbPath, ext) + "." + tenant + ext
+}
+
+// tenantRouter dispatches each request to the handler of the tenant named by its /t/{tenant}/ path
+// prefix or its X-Tenant header, and requests naming no tenant to the default handler. Each tenant
+// is served by its own Server on its own database, so reviews, caches and moderation never mix.
+type tenantRouter struct {
+    fallback *Server
+    tenants  map[string]http.Handler
+}
+
+// newTenantRouter creates a router serving the given tenants, and requests naming none with fallback
+func newTenantRouter(fallback *Server, tenants map[string]http.Handler) *tenantRouter {
+    return &tenantRouter{fallback: fallback, tenants: tenants}
+}
+
+// ServeHTTP routes the request to its tenant's handler, stripping the /t/{tenant} prefix from the
+// path so the tenant's Server sees the same paths as the default one
+func (t *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    name, inPath := tenantFromPath(r.URL.Path)
+    header := r.Header.Get(tenantHeader)
+    switch {
+    case inPath && header != "" && header != name:
+        t.respondWithError(w, r, http.StatusBadRequest, "tenant_mismatch", fmt.Sprintf("The %s header %q does not match the tenant %q in the path", tenantHeader, header, name))
+        return
+    case !inPath && header == "":
+        t.fallback.ServeHTTP(w, r)
+        return
+    case !inPath:
+        name = header
+    }
+
+    next, ok := t.tenants[name]
+    if !ok {
+        t.respondWithError(w, r, http.StatusNotFound, "tenant_not_found", fmt.Sprintf("No tenant named %q", name))
+        return
+    }
+    if !inPath {
+        next.ServeHTTP(w, r)
+        return
+    }
+    prefix := tenantPathPrefix + name
+    ctx := context.WithValue(r.Context(), tenantPrefixContextKey{}, prefix)
+    http.StripPrefix(prefix, next).ServeHTTP(w, r.WithContext(ctx))
+}
+
+// respondWithError answers a request naming no served tenant with the default Server's CORS
+// headers, so browsers on other origins can read the error
+func (t *tenantRouter) respondWithError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+    t.fallback.withCORS("", func(w http.ResponseWriter, r *http.Request) {
+        respondWithError(w, status, code, msg)
+    })(w, r)
+}
+
+// tenantFromPath returns the tenant named by a path starting with /t/{tenant}/
+func tenantFromPath(path string) (string, bool) {
+    rest, ok := strings.CutPrefix(path, tenantPathPrefix)
+    if !ok {
+        return "", false
+    }
+    name, _, ok := strings.Cut(rest, "/")
+    if !ok || name == "" {
+        return "", false
+    }
+    return name, true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+// Webhook delivery settings; a delivery is tried webhookAttempts times, waiting webhookBackoff
+// before the first retry and twice as long before each later one
+const (
+    webhookTimeout  = 10 * time.Second
+    webhookAttempts = 3
+    webhookBackoff  = time.Second
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the body keyed with the shared secret,
+// prefixed with "sha256=", so receivers can check that a notification came from this service
+const webhookSignatureHeader = "X-ReviewX-Signature"
+
+// webhookNotifier posts every newly submitted review to the configured webhook URLs in the
+// background, so slow or failing receivers never delay or fail the submission itself
+type webhookNotifier struct {
+    urls    []*url.URL
+    secret  []byte
+    client  *http.Client
+    backoff time.Duration
+    pending sync.WaitGroup
+}
+
+// newWebhookNotifier creates a notifier for the given http or https URLs, signing bodies with
+// secret unless it is empty, or returns nil when there are no URLs
+func newWebhookNotifier(rawURLs []string, secret string) (*webhookNotifier, error) {
+    var urls []*url.URL
+    for _, raw := range rawURLs {
+        u, err := url.Parse(raw)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return nil, fmt.Errorf("invalid webhook URL %q: must be an http or https URL", raw)
+        }
+        urls = append(urls, u)
+    }
+    if len(urls) == 0 {
+        return nil, nil
+    }
+    return &webhookNotifier{
+        urls:    urls,
+        secret:  []byte(secret),
+        client:  &http.Client{Timeout: webhookTimeout},
+        backoff: webhookBackoff,
+    }, nil
+}
+
+// notify starts delivering review to every webhook URL; a nil notifier does nothing
+func (n *webhookNotifier) notify(review Review) {
+    if n == nil {
+        return
+    }
+    body, err := json.Marshal(review)
+    if err != nil {
+        logger.Error("failed to encode webhook payload", "review_id", review.ID, "error", err.Error())
+        return
+    }
+    for _, u := range n.urls {
+        n.pending.Add(1)
+        go func(u *url.URL) {
+            defer n.pending.Done()
+            n.deliver(u, body, review.ID)
+        }(u)
+    }
+}
+
+// deliver posts body to u, retrying failed attempts, and logs the failure once every attempt
+// failed; only the host is logged since webhook URLs often embed access tokens
+func (n *webhookNotifier) deliver(u *url.URL, body []byte, reviewID int) {
+    backoff := n.backoff
+    for attempt := 1; ; attempt++ {
+        err := n.post(u, body)
+        if err == nil {
+            return
+        }
+        if attempt == webhookAttempts {
+            webhookFailures.Inc()
+            logger.Error("webhook delivery failed", "host", u.Host, "review_id", reviewID, "attempts", attempt, "error", err.Error())
+            return
+        }
+        time.Sleep(backoff)
+        backoff *= 2
+    }
+}
+
+// post makes one delivery attempt, treating any status other than 2xx as a failure
+func (n *webhookNotifier) post(u *url.URL, body []byte) error {
+    req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if len(n.secret) > 0 {
+        mac := hmac.New(sha256.New, n.secret)
+        mac.Write(body)
+        req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    resp, err := n.client.Do(req)
+    if err != nil {
+        // The client error names the full URL, so only its cause is reported
+        var urlErr *url.Error
+        if errors.As(err, &urlErr) {
+            err = urlErr.Err
+        }
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, resp.Body)
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    return nil
+}
+
+// wait blocks until every started delivery has succeeded or given up, so that shutting down does
+// not drop notifications; a nil notifier returns at once
+func (n *webhookNotifier) wait() {
+    if n == nil {
+        return
+    }
+    n.pending.Wait()
+}